@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// latencySlack keeps jitter on very fast services from looking like a
+// doubling in latency.
+const latencySlack = 50 * time.Millisecond
+
+// adaptiveLimiter bounds the number of tiles being fetched at once, raising
+// the bound while the service stays fast and healthy and halving it when the
+// service pushes back.
+type adaptiveLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	max    int
+	active int
+
+	// baseline is the fastest smoothed latency seen, and latency the current
+	// smoothed latency.
+	baseline time.Duration
+	latency  time.Duration
+	// successes counts fetches since the limit last changed.
+	successes int
+}
+
+func newAdaptiveLimiter(initial, max int) *adaptiveLimiter {
+	if initial > max {
+		initial = max
+	}
+
+	l := &adaptiveLimiter{
+		limit: initial,
+		max:   max,
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until another fetch may start.
+func (l *adaptiveLimiter) acquire() {
+	l.mu.Lock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+}
+
+// release records the outcome of a fetch started with acquire.
+func (l *adaptiveLimiter) release(d time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	defer l.cond.Broadcast()
+
+	if err != nil {
+		if isRetryable(err) {
+			l.setLimit(l.limit / 2)
+		}
+		return
+	}
+
+	if l.latency == 0 {
+		l.latency = d
+	} else {
+		l.latency = (l.latency*9 + d) / 10
+	}
+	if l.baseline == 0 || l.latency < l.baseline {
+		l.baseline = l.latency
+	}
+
+	l.successes++
+	if l.successes < l.limit {
+		return
+	}
+
+	if l.latency > 2*l.baseline+latencySlack {
+		// Requests are queueing up somewhere, so ease off.
+		l.setLimit(l.limit - 1)
+	} else {
+		l.setLimit(l.limit + 1)
+	}
+}
+
+func (l *adaptiveLimiter) setLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > l.max {
+		limit = l.max
+	}
+
+	if limit != l.limit {
+		log.Printf("Adjusting concurrency from %d to %d", l.limit, limit)
+		l.limit = limit
+	}
+	l.successes = 0
+}
+
+func (l *adaptiveLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// isRetryable reports whether err is the service asking us to slow down or
+// failing in a way that's likely to be temporary.
+func isRetryable(err error) bool {
+	var httpErr *esriservice.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500
+	}
+
+	var serviceErr *esriservice.ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Code == http.StatusTooManyRequests || serviceErr.Code >= 500
+	}
+
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, esriservice.ErrIncompleteImage) || err == errErrorImage
+}
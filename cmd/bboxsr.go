@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// parseBoundInSR parses a --bbox value given in the spatial reference wkid,
+// either minX,minY,maxX,maxY or the path to a file whose bounds should be
+// used, and returns it in EPSG:4326. Web mercator is converted here, and any
+// other spatial reference by client's service.
+func parseBoundInSR(ctx context.Context, value string, wkid int, client *esriservice.EsriService, timeout time.Duration) (orb.Bound, error) {
+	if wkid == 4326 {
+		return parseBound(value)
+	}
+
+	var b orb.Bound
+	if parts := strings.Split(value, ","); len(parts) == 4 {
+		var coords [4]float64
+		for i, part := range parts {
+			f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return orb.Bound{}, fmt.Errorf("invalid bbox coordinate %q: %w", part, err)
+			}
+			coords[i] = f
+		}
+		b = orb.Bound{Min: orb.Point{coords[0], coords[1]}, Max: orb.Point{coords[2], coords[3]}}
+	} else {
+		g, err := loadGeometry(value)
+		if err != nil {
+			return orb.Bound{}, err
+		}
+		b = g.Bound()
+	}
+	if b.Min.X() >= b.Max.X() || b.Min.Y() >= b.Max.Y() {
+		return orb.Bound{}, fmt.Errorf("bbox %q must be minX,minY,maxX,maxY", value)
+	}
+
+	sr := esriservice.SpatialReferenceType{Wkid: wkid}
+	if sr.IsWebMercator() {
+		return extentBound(esriservice.ExtentType{XMin: b.Min.X(), YMin: b.Min.Y(), XMax: b.Max.X(), YMax: b.Max.Y(), SpatialReference: sr})
+	}
+	if client == nil {
+		return orb.Bound{}, fmt.Errorf("only web mercator or EPSG:4326 can be converted without an esri service, not wkid %d", wkid)
+	}
+
+	// The corners and the middle of each edge are converted one at a time,
+	// since the service widens the extent of a whole box to fit the image.
+	var out orb.Bound
+	for i, p := range []orb.Point{
+		b.Min, b.Max, {b.Min.X(), b.Max.Y()}, {b.Max.X(), b.Min.Y()},
+		{b.Center().X(), b.Min.Y()}, {b.Center().X(), b.Max.Y()},
+		{b.Min.X(), b.Center().Y()}, {b.Max.X(), b.Center().Y()},
+	} {
+		converted, err := convertPoint(ctx, client, p, sr, (b.Max.X()-b.Min.X())*1e-6, timeout)
+		if err != nil {
+			return orb.Bound{}, fmt.Errorf("couldn't convert bbox from wkid %d: %w", wkid, err)
+		}
+		if i == 0 {
+			out = converted.Bound()
+		} else {
+			out = out.Extend(converted)
+		}
+	}
+
+	if out.Min.X() < -180 || out.Max.X() > 180 || out.Min.Y() < -90 || out.Max.Y() > 90 {
+		return orb.Bound{}, fmt.Errorf("bbox converted from wkid %d to %0.5f,%0.5f,%0.5f,%0.5f, outside of EPSG:4326", wkid, out.Min.X(), out.Min.Y(), out.Max.X(), out.Max.Y())
+	}
+	return out, nil
+}
+
+// parseBoundsInSR parses each --bbox value like parseBoundInSR, logging the
+// ones that were converted.
+func parseBoundsInSR(ctx context.Context, values []string, wkid int, client *esriservice.EsriService, timeout time.Duration) ([]orb.Bound, error) {
+	var bounds []orb.Bound
+	for _, value := range values {
+		b, err := parseBoundInSR(ctx, value, wkid, client, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if wkid != 4326 {
+			log.Printf("Converted --bbox %s from wkid %d to %0.5f,%0.5f,%0.5f,%0.5f", value, wkid, b.Min.X(), b.Min.Y(), b.Max.X(), b.Max.Y())
+		}
+		bounds = append(bounds, b)
+	}
+	return bounds, nil
+}
+
+// unionBound returns the bound around all of bounds, which mustn't be empty.
+func unionBound(bounds []orb.Bound) orb.Bound {
+	u := bounds[0]
+	for _, b := range bounds[1:] {
+		u = u.Union(b)
+	}
+	return u
+}
+
+// convertPoint converts p from sr to EPSG:4326 with an esri service, by
+// exporting a tiny image around it in EPSG:4326 and reading back where the
+// image's center is, like the startup probe does with the service's extent.
+func convertPoint(ctx context.Context, client *esriservice.EsriService, p orb.Point, sr esriservice.SpatialReferenceType, radius float64, timeout time.Duration) (orb.Point, error) {
+	input := &esriservice.ExportImageInput{
+		ImageSR: esriservice.SpatialReferenceType{Wkid: 4326},
+		BoundingBox: esriservice.ExtentType{
+			XMin: p.X() - radius, YMin: p.Y() - radius,
+			XMax: p.X() + radius, YMax: p.Y() + radius,
+			SpatialReference: sr,
+		},
+		Size:      esriservice.RectType{Width: 1, Height: 1},
+		Format:    "png",
+		PixelType: "u8",
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := client.ExportImage(ctx, input)
+	if err != nil {
+		return orb.Point{}, err
+	}
+
+	extent := resp.Extent
+	if extent.SpatialReference.IsZero() {
+		extent.SpatialReference = input.ImageSR
+	}
+	b, err := extentBound(extent)
+	if err != nil {
+		return orb.Point{}, err
+	}
+	return b.Center(), nil
+}
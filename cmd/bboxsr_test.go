@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// TestParseBoundInStatePlane converts a bbox in a state plane spatial
+// reference through a stub service, which answers each point probe with
+// the point moved by a linear stand-in for the projection.
+func TestParseBoundInStatePlane(t *testing.T) {
+	toWGS84 := func(x, y float64) (float64, float64) {
+		return -125 + x/100000, 45 + y/100000
+	}
+
+	probes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if sr := r.Form.Get("bboxSR"); sr != "2927" {
+			t.Errorf("probe has bboxSR %q, want 2927", sr)
+		}
+		if sr := r.Form.Get("imageSR"); sr != "4326" {
+			t.Errorf("probe has imageSR %q, want 4326", sr)
+		}
+		b, err := parseBound(r.Form.Get("bbox"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		probes++
+
+		minX, minY := toWGS84(b.Min.X(), b.Min.Y())
+		maxX, maxY := toWGS84(b.Max.X(), b.Max.Y())
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"href":   "http://" + r.Host + "/image",
+			"width":  1,
+			"height": 1,
+			"extent": map[string]interface{}{
+				"xmin": minX, "ymin": minY, "xmax": maxX, "ymax": maxY,
+				"spatialReference": map[string]int{"wkid": 4326},
+			},
+		})
+	}))
+	defer server.Close()
+
+	client := esriservice.NewClient(server.URL + "/arcgis/rest/services/Plane/ImageServer")
+	b, err := parseBoundInSR(context.Background(), "1000000,500000,1100000,600000", 2927, client, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probes != 8 {
+		t.Errorf("made %d probes, want one for each corner and edge", probes)
+	}
+
+	want := orb.Bound{Min: orb.Point{-115, 50}, Max: orb.Point{-114, 51}}
+	for i, v := range []float64{b.Min.X() - want.Min.X(), b.Min.Y() - want.Min.Y(), b.Max.X() - want.Max.X(), b.Max.Y() - want.Max.Y()} {
+		if math.Abs(v) > 1e-6 {
+			t.Errorf("converted bound is %v, want %v (coordinate %d is off by %v)", b, want, i, v)
+			break
+		}
+	}
+
+	// A bound that converts to somewhere off the globe is an error, not a
+	// crawl of nothing.
+	if b, err := parseBoundInSR(context.Background(), "0,5000000,100000,5100000", 2927, client, time.Second); err == nil {
+		t.Errorf("bbox converted to %v, which is past the pole", b)
+	}
+}
+
+func TestParseBoundInSRWithoutService(t *testing.T) {
+	b, err := parseBoundInSR(context.Background(), "-13692297,6274861,-13688515,6276556", 3857, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(b.Min.X()+123) > 0.001 || math.Abs(b.Max.Y()-49.01) > 0.001 {
+		t.Errorf("web mercator bbox converted to %v", b)
+	}
+
+	if _, err := parseBoundInSR(context.Background(), "1000000,500000,1100000,600000", 2927, nil, time.Second); err == nil {
+		t.Error("state plane was converted without a service")
+	}
+}
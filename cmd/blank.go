@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+
+	// Samples may be saved from a service in any of these formats.
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+// emptyMarker is the 1x1 transparent PNG stored in place of blank tiles with
+// --store-empty-as-marker, so a blank tile can be told apart from one that
+// wasn't crawled.
+var emptyMarker = func() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	return buf.Bytes()
+}()
+
+// transparentTile is stored for tiles the service has no image for with
+// --no-blank-skip.
+var transparentTile = func() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 256, 256)))
+	return buf.Bytes()
+}()
+
+// blankSample recognizes the placeholder tile a service returns where it has
+// no data, even when compression noise keeps it from matching byte for
+// byte. Every tile has to be decoded to compare it, which costs about as
+// much CPU as --optimize-png.
+type blankSample struct {
+	img *image.NRGBA64
+	// tolerance is the largest mean difference per channel, from 0 to 1,
+	// for a tile to count as blank.
+	tolerance float64
+}
+
+func loadBlankSample(filename string, tolerance float64) (*blankSample, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blankSample{img: toNRGBA64(img, img.Bounds()), tolerance: tolerance}, nil
+}
+
+// matches reports whether data is close enough to the sample to be blank.
+func (s *blankSample) matches(data []byte) bool {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+
+	if img.Bounds().Size() != s.img.Bounds().Size() {
+		return false
+	}
+
+	return meanDifference(toNRGBA64(img, img.Bounds()), s.img) <= s.tolerance
+}
+
+// fillTolerance is how far each channel of a pixel can be from a fill color
+// and still match it, to allow for JPEG noise. 16-bit images have to match
+// exactly, since a small difference there is a real value, like a low
+// elevation, rather than noise.
+const fillTolerance = 4
+
+// isFillTile reports whether every pixel of data is one of the fill colors,
+// which a service paints where it has no data. Decoding costs CPU like
+// --blank-tile.
+func isFillTile(data []byte, fills []color.NRGBA) bool {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+
+	tolerance := fillTolerance * 0x101
+	if is16Bit(img) {
+		tolerance = 0
+	}
+
+	n := toNRGBA64(img, img.Bounds())
+	if len(n.Pix) == 0 {
+		return false
+	}
+
+	for _, fill := range fills {
+		want := [4]int{int(fill.R) * 0x101, int(fill.G) * 0x101, int(fill.B) * 0x101, int(fill.A) * 0x101}
+		matches := true
+		for i := 0; i+1 < len(n.Pix) && matches; i += 2 {
+			d := (int(n.Pix[i])<<8 | int(n.Pix[i+1])) - want[i/2%4]
+			matches = d <= tolerance && d >= -tolerance
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// meanDifference returns the mean absolute difference of two images of the
+// same size across all channels, scaled from 0 to 1.
+func meanDifference(a, b *image.NRGBA64) float64 {
+	var total uint64
+	for i := 0; i+1 < len(a.Pix); i += 2 {
+		d := (int(a.Pix[i])<<8 | int(a.Pix[i+1])) - (int(b.Pix[i])<<8 | int(b.Pix[i+1]))
+		if d < 0 {
+			d = -d
+		}
+		total += uint64(d)
+	}
+	return float64(total) / float64(len(a.Pix)/2*0xffff)
+}
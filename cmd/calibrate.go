@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// probeTilesPerWorker is how many tiles each worker fetches in a probe burst.
+const probeTilesPerWorker = 2
+
+// calibrateConcurrency fetches bursts of tiles with 1, 2, 4, and so on
+// workers, up to max or 8 per CPU, and returns the most workers that got
+// through a burst without errors and without the mean latency more than
+// doubling. Each burst uses new tiles, so a cache doesn't flatter it.
+func calibrateConcurrency(ctx context.Context, source tilesource.Source, tiles <-chan maptile.Tile, max int, timeout time.Duration) int {
+	if cpuMax := 8 * runtime.NumCPU(); max > cpuMax {
+		max = cpuMax
+	}
+
+	best := 1
+	var baseline time.Duration
+	for workers := 1; workers <= max; workers *= 2 {
+		mean, failed, ok := probeBurst(ctx, source, tiles, workers, timeout)
+		if !ok {
+			break
+		}
+		log.Printf("Probe with %d workers: mean %s per tile, %d failed", workers, mean.Round(time.Millisecond), failed)
+
+		if failed > 0 {
+			break
+		}
+		if workers == 1 {
+			baseline = mean
+		} else if mean > 2*baseline+latencySlack {
+			break
+		}
+		best = workers
+	}
+	return best
+}
+
+// probeBurst fetches probeTilesPerWorker tiles per worker from tiles, and
+// reports their mean latency and how many failed. It isn't ok if there
+// weren't enough tiles left for a full burst.
+func probeBurst(ctx context.Context, source tilesource.Source, tiles <-chan maptile.Tile, workers int, timeout time.Duration) (mean time.Duration, failed int, ok bool) {
+	var burst []maptile.Tile
+	for t := range tiles {
+		burst = append(burst, t)
+		if len(burst) == workers*probeTilesPerWorker {
+			break
+		}
+	}
+	if len(burst) < workers*probeTilesPerWorker {
+		return 0, 0, false
+	}
+
+	var mu sync.Mutex
+	var total time.Duration
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(mine []maptile.Tile) {
+			defer wg.Done()
+			for _, t := range mine {
+				start := time.Now()
+				_, err := fetchTileWithTimeout(ctx, source, t, timeout)
+				elapsed := time.Since(start)
+
+				mu.Lock()
+				total += elapsed
+				if err != nil {
+					failed++
+				}
+				mu.Unlock()
+			}
+		}(burst[i*probeTilesPerWorker : (i+1)*probeTilesPerWorker])
+	}
+	wg.Wait()
+
+	return total / time.Duration(len(burst)), failed, true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// printCheck prints a summary of an esri service for --check, from its
+// description and one sample tile, to confirm the endpoint and flags are
+// right before crawling. It returns the sample tile's error, if any.
+func printCheck(ctx context.Context, w io.Writer, client *esriservice.EsriService, details *esriservice.ServiceDetails, extent orb.Bound, tokenRequired string, source tilesource.Source, t maptile.Tile, timeout time.Duration) error {
+	if details.Name != "" {
+		fmt.Fprintf(w, "Service:        %s %q\n", client.ServiceType(), details.Name)
+	} else {
+		fmt.Fprintf(w, "Service:        %s\n", client.ServiceType())
+	}
+	fmt.Fprintf(w, "Native SR:      %s\n", describeSR(details.SpatialReference))
+	fmt.Fprintf(w, "Full extent:    %0.5f,%0.5f,%0.5f,%0.5f (EPSG:4326)\n", extent.Min.X(), extent.Min.Y(), extent.Max.X(), extent.Max.Y())
+
+	formats := details.SupportedImageFormatTypes
+	if formats == "" {
+		formats = "not listed"
+	}
+	fmt.Fprintf(w, "Formats:        %s\n", formats)
+
+	if details.MaxImageWidth > 0 || details.MaxImageHeight > 0 {
+		fmt.Fprintf(w, "Max image size: %dx%d\n", details.MaxImageWidth, details.MaxImageHeight)
+	} else {
+		fmt.Fprintf(w, "Max image size: not listed\n")
+	}
+
+	fmt.Fprintf(w, "Token required: %s\n", tokenRequired)
+
+	if ti := details.TileInfo; ti != nil {
+		fmt.Fprintf(w, "Tile cache:     yes, %d levels of %dx%d %s tiles in %s\n", len(ti.LODs), ti.Cols, ti.Rows, ti.Format, describeSR(ti.SpatialReference))
+	} else {
+		fmt.Fprintf(w, "Tile cache:     no\n")
+	}
+
+	start := time.Now()
+	data, err := fetchTileWithTimeout(ctx, source, t, timeout)
+	if err != nil {
+		fmt.Fprintf(w, "Sample tile:    %d/%d/%d failed: %v\n", t.Z, t.X, t.Y, err)
+		return err
+	}
+	took := time.Since(start).Round(time.Millisecond)
+	if isBlankTile(data) {
+		fmt.Fprintf(w, "Sample tile:    %d/%d/%d is blank (%d bytes in %s)\n", t.Z, t.X, t.Y, len(data), took)
+		return nil
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintf(w, "Sample tile:    %d/%d/%d isn't an image: %v\n", t.Z, t.X, t.Y, err)
+		return err
+	}
+	fmt.Fprintf(w, "Sample tile:    %d/%d/%d is a %dx%d %s (%d bytes in %s)\n", t.Z, t.X, t.Y, config.Width, config.Height, format, len(data), took)
+	return nil
+}
+
+// tokenRequirement describes whether an esri service needs a token. If one
+// was supplied, the service description is fetched again without it to see.
+func tokenRequirement(ctx context.Context, endpoint string, header http.Header, transport http.RoundTripper, credentialed bool, timeout time.Duration) string {
+	if !credentialed {
+		return "no"
+	}
+
+	anonymous := esriservice.NewClient(endpoint, esriservice.WithTransport(transport), esriservice.WithUserAgent(header.Get("User-Agent")))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := anonymous.GetDetails(ctx)
+	switch {
+	case err == nil:
+		return "no, though one was supplied"
+	case esriservice.IsTokenRequired(err):
+		return "yes"
+	}
+	return fmt.Sprintf("unknown (%v)", err)
+}
+
+func describeSR(sr esriservice.SpatialReferenceType) string {
+	switch {
+	case sr.Wkid != 0 && sr.LatestWkid != 0 && sr.Wkid != sr.LatestWkid:
+		return fmt.Sprintf("wkid %d (%d)", sr.LatestWkid, sr.Wkid)
+	case sr.Wkid != 0:
+		return fmt.Sprintf("wkid %d", sr.Wkid)
+	case sr.LatestWkid != 0:
+		return fmt.Sprintf("wkid %d", sr.LatestWkid)
+	case sr.Wkt != "":
+		return "custom WKT"
+	}
+	return "unknown"
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// The checkpoint records the last tile a file's writer committed, updated in
+// the same transaction as the tiles, so a crawl that dies partway through
+// can say where its output got to, and a --resume run can report where it's
+// picking up from.
+const checkpointSchema = `
+	CREATE TABLE IF NOT EXISTS crawl_checkpoint (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		zoom_level INT NOT NULL,
+		tile_column INT NOT NULL,
+		tile_row INT NOT NULL,
+		committed_at TEXT NOT NULL
+	);
+`
+
+// checkpoint is the last committed tile, with its row in XYZ.
+type checkpoint struct {
+	tile        maptile.Tile
+	committedAt string
+}
+
+func (c *checkpoint) String() string {
+	return fmt.Sprintf("%d/%d/%d, committed at %s", c.tile.Z, c.tile.X, c.tile.Y, c.committedAt)
+}
+
+// loadCheckpoint returns the checkpoint of a file opened for writing, or nil
+// if nothing has been committed to it since checkpoints were kept.
+func loadCheckpoint(db *sql.DB) (*checkpoint, error) {
+	if _, err := db.Exec(checkpointSchema); err != nil {
+		return nil, err
+	}
+	return queryCheckpoint(db)
+}
+
+// readCheckpoint returns the checkpoint of an existing mbtiles file without
+// changing it, or nil if it doesn't have one.
+func readCheckpoint(filename string) (*checkpoint, error) {
+	db, err := openMBTiles(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'crawl_checkpoint')").Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+	return queryCheckpoint(db)
+}
+
+func queryCheckpoint(db *sql.DB) (*checkpoint, error) {
+	var z, x, row uint32
+	c := &checkpoint{}
+	err := db.QueryRow("SELECT zoom_level, tile_column, tile_row, committed_at FROM crawl_checkpoint WHERE id = 1").Scan(&z, &x, &row, &c.committedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c.tile = maptile.New(x, flipY(z, row), maptile.Zoom(z))
+	return c, nil
+}
+
+// saveCheckpoint records t, an XYZ tile, as the last one committed by tx.
+func saveCheckpoint(tx *sqliteTx, t maptile.Tile) (*checkpoint, error) {
+	c := &checkpoint{tile: t, committedAt: time.Now().UTC().Format(time.RFC3339)}
+	_, err := tx.Exec("INSERT OR REPLACE INTO crawl_checkpoint (id, zoom_level, tile_column, tile_row, committed_at) VALUES (1, ?, ?, ?, ?)",
+		t.Z, t.X, flipY(uint32(t.Z), t.Y), c.committedAt)
+	return c, err
+}
+
+// writeError is a failure to write to a file, with the last tile that was
+// committed to it before the failure.
+type writeError struct {
+	filename  string
+	committed *checkpoint
+	err       error
+}
+
+func (e *writeError) Error() string {
+	return fmt.Sprintf("writing %s: %v", e.filename, e.err)
+}
+
+func (e *writeError) Unwrap() error {
+	return e.err
+}
+
+// writeFailed aborts the crawl after the output couldn't be written, saying
+// where it got to and how to carry on. The tiles written since the last
+// commit are lost, but --resume skips the ones before it.
+func (c *crawler) writeFailed(err error) {
+	resume := "rerun with --resume to skip the tiles already written"
+	var we *writeError
+	if errors.As(err, &we) && we.committed != nil {
+		resume = fmt.Sprintf("rerun with --resume to continue; the last tile saved to %s was %s", we.filename, we.committed)
+	}
+
+	if isDiskFull(err) {
+		log.Fatalf("Ran out of disk space: %v. Free some space and %s", err, resume)
+	}
+	log.Fatalf("Couldn't write tile: %+v. Once the problem is fixed, %s", err, resume)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// TestWriteFailureCheckpoint fills a file whose size is capped until a
+// write fails, and checks that the error is seen as a full disk and names
+// the last tile that was committed.
+func TestWriteFailureCheckpoint(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "full.mbtiles")
+	w, err := createMBTiles(filename, mbtilesOptions{name: "Full", pageSize: 4096, batchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.db.Close()
+
+	// max_page_count is per connection, so keep the writer on the one the
+	// pragma was set on.
+	w.db.SetMaxOpenConns(1)
+	var pages int
+	if err := w.tx.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.tx.Exec(fmt.Sprintf("PRAGMA max_page_count = %d", pages+20)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Random tiles don't compress into fewer pages.
+	data := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	var committed *maptile.Tile
+	for i := 0; i < 1000; i++ {
+		tile := maptile.New(uint32(i), 0, 14)
+		err = w.put(tile, data)
+		if err != nil {
+			break
+		}
+		// Every second put commits the batch it completes.
+		if i%2 == 1 {
+			committed = &tile
+		}
+	}
+	if err == nil {
+		t.Fatal("writes never failed")
+	}
+	if committed == nil {
+		t.Fatalf("the first batch failed, so there's no checkpoint to check: %v", err)
+	}
+
+	if !isDiskFull(err) {
+		t.Errorf("isDiskFull(%v) is false", err)
+	}
+	var we *writeError
+	if !errors.As(err, &we) {
+		t.Fatalf("%v isn't a writeError", err)
+	}
+	if we.filename != filename {
+		t.Errorf("writeError is for %s, want %s", we.filename, filename)
+	}
+	if we.committed == nil {
+		t.Fatalf("writeError has no checkpoint, want %v", *committed)
+	}
+	if we.committed.tile != *committed {
+		t.Errorf("writeError's checkpoint is %v, want %v", we.committed.tile, *committed)
+	}
+}
+
+func TestIsDiskFull(t *testing.T) {
+	full := &os.PathError{Op: "write", Path: "tile.png", Err: syscall.ENOSPC}
+	if !isDiskFull(full) {
+		t.Errorf("isDiskFull(%v) is false", full)
+	}
+	if other := errors.New("connection reset"); isDiskFull(other) {
+		t.Errorf("isDiskFull(%v) is true", other)
+	}
+}
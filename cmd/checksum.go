@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checksumManifest describes finished output files for distribution, so
+// whoever downloads them can check they arrived intact.
+type checksumManifest struct {
+	Files []checksumFile `json:"files"`
+}
+
+type checksumFile struct {
+	// Name is the file's name without its directory, since the manifest
+	// is shipped alongside it.
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+	// Tiles is the number of tiles at each zoom.
+	Tiles map[string]int64 `json:"tiles"`
+}
+
+// writeChecksumManifest writes a manifest of the mbtiles or GeoPackage files
+// in filenames to manifestFilename.
+func writeChecksumManifest(manifestFilename string, filenames []string) error {
+	m := checksumManifest{}
+	for _, filename := range filenames {
+		f, err := describeFile(filename)
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, f)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestFilename, append(data, '\n'), 0644)
+}
+
+func describeFile(filename string) (checksumFile, error) {
+	f := checksumFile{Name: filepath.Base(filename), Tiles: map[string]int64{}}
+
+	db, err := openMBTiles(filename)
+	if err != nil {
+		return f, err
+	}
+	rows, err := db.Query("SELECT zoom_level, COUNT(*) FROM tiles GROUP BY zoom_level")
+	if err != nil {
+		db.Close()
+		return f, err
+	}
+	for rows.Next() {
+		var zoom string
+		var count int64
+		if err := rows.Scan(&zoom, &count); err != nil {
+			rows.Close()
+			db.Close()
+			return f, err
+		}
+		f.Tiles[zoom] = count
+	}
+	err = rows.Err()
+	rows.Close()
+	db.Close()
+	if err != nil {
+		return f, err
+	}
+
+	// The file is hashed after it's closed, so it's hashed as it'll be
+	// shipped.
+	file, err := os.Open(filename)
+	if err != nil {
+		return f, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if f.Bytes, err = io.Copy(h, file); err != nil {
+		return f, err
+	}
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return f, nil
+}
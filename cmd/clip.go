@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// loadGeometry reads the geometry in a GeoJSON file or shapefile, picking the
+// parser by extension.
+func loadGeometry(filename string) (orb.Geometry, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".shp":
+		return readShapefile(filename)
+	case ".geojson", ".json":
+		return readGeoJSON(filename)
+	}
+
+	return nil, fmt.Errorf("don't know how to read %s, expected a .geojson or .shp file", filename)
+}
+
+// readGeoJSON reads a GeoJSON feature collection, feature, or bare geometry.
+func readGeoJSON(filename string) (orb.Geometry, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if fc, err := geojson.UnmarshalFeatureCollection(data); err == nil && fc.Type == "FeatureCollection" {
+		var c orb.Collection
+		for _, f := range fc.Features {
+			c = append(c, f.Geometry)
+		}
+		return c, nil
+	}
+
+	if f, err := geojson.UnmarshalFeature(data); err == nil && f.Type == "Feature" {
+		return f.Geometry, nil
+	}
+
+	g, err := geojson.UnmarshalGeometry(data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s as GeoJSON: %w", filename, err)
+	}
+
+	return g.Geometry(), nil
+}
+
+// parseBound parses a --bbox value, either minLon,minLat,maxLon,maxLat or the
+// path to a file whose bounds should be used.
+func parseBound(value string) (orb.Bound, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		g, err := loadGeometry(value)
+		if err != nil {
+			return orb.Bound{}, err
+		}
+		return g.Bound(), nil
+	}
+
+	var coords [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return orb.Bound{}, fmt.Errorf("invalid bbox coordinate %q: %w", part, err)
+		}
+		coords[i] = f
+	}
+
+	if coords[0] == coords[2] || coords[1] >= coords[3] {
+		return orb.Bound{}, fmt.Errorf("bbox %q must be minLon,minLat,maxLon,maxLat", value)
+	}
+	if coords[0] > coords[2] {
+		// The bbox crosses the antimeridian, which is kept as a maximum
+		// longitude past 180.
+		coords[2] += 360
+	}
+
+	return orb.Bound{
+		Min: orb.Point{coords[0], coords[1]},
+		Max: orb.Point{coords[2], coords[3]},
+	}, nil
+}
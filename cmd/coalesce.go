@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// tileFlights makes sure a tile is fetched by at most one worker at a time.
+// A worker that asks for a tile that's already being fetched waits for that
+// fetch and shares its result, rather than fetching it again. Unlike
+// requestedTiles, which keeps a tile from being queued twice, this catches
+// the same tile reaching two workers at once, like a retry racing a
+// duplicate request.
+type tileFlights struct {
+	mu      sync.Mutex
+	flights map[maptile.Tile]*tileFlight
+	// coalesced counts the fetches that shared another's result.
+	coalesced int
+}
+
+type tileFlight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newTileFlights() *tileFlights {
+	return &tileFlights{flights: map[maptile.Tile]*tileFlight{}}
+}
+
+// do returns the result of fetch for t, or of the fetch for t already in
+// flight.
+func (f *tileFlights) do(t maptile.Tile, fetch func() ([]byte, error)) ([]byte, error) {
+	f.mu.Lock()
+	if flight, ok := f.flights[t]; ok {
+		f.coalesced++
+		f.mu.Unlock()
+		<-flight.done
+		return flight.data, flight.err
+	}
+	flight := &tileFlight{done: make(chan struct{})}
+	f.flights[t] = flight
+	f.mu.Unlock()
+
+	flight.data, flight.err = fetch()
+
+	f.mu.Lock()
+	delete(f.flights, t)
+	f.mu.Unlock()
+	close(flight.done)
+
+	return flight.data, flight.err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// TestTileFlights has three workers get each of three tiles at once, with
+// every fetch held open until all of them have arrived, and checks that
+// each tile is fetched once and its result shared with the others.
+func TestTileFlights(t *testing.T) {
+	tiles := []maptile.Tile{maptile.New(0, 0, 1), maptile.New(1, 0, 1), maptile.New(0, 1, 1)}
+	errFailed := errors.New("failed")
+
+	f := newTileFlights()
+	release := make(chan struct{})
+	var mu sync.Mutex
+	fetches := map[maptile.Tile]int{}
+	fetch := func(tile maptile.Tile) ([]byte, error) {
+		mu.Lock()
+		fetches[tile]++
+		mu.Unlock()
+		<-release
+		if tile == tiles[2] {
+			return nil, errFailed
+		}
+		return []byte{byte(tile.X), byte(tile.Y)}, nil
+	}
+
+	type result struct {
+		tile maptile.Tile
+		data []byte
+		err  error
+	}
+	results := make(chan result, 9)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 9; i++ {
+		tile := tiles[i%3]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := f.do(tile, func() ([]byte, error) { return fetch(tile) })
+			results <- result{tile, data, err}
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		coalesced := f.coalesced
+		f.mu.Unlock()
+		if coalesced == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of 6 workers waited on a fetch in flight", coalesced)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for _, tile := range tiles {
+		if fetches[tile] != 1 {
+			t.Errorf("%d/%d/%d was fetched %d times, want once", tile.Z, tile.X, tile.Y, fetches[tile])
+		}
+	}
+	for r := range results {
+		if r.tile == tiles[2] {
+			if r.err != errFailed {
+				t.Errorf("%d/%d/%d got error %v, want the shared fetch's", r.tile.Z, r.tile.X, r.tile.Y, r.err)
+			}
+			continue
+		}
+		if r.err != nil || len(r.data) != 2 || r.data[0] != byte(r.tile.X) || r.data[1] != byte(r.tile.Y) {
+			t.Errorf("%d/%d/%d got %v, %v, want its own tile", r.tile.Z, r.tile.X, r.tile.Y, r.data, r.err)
+		}
+	}
+
+	// A fetch that's finished isn't cached, so the next one fetches again.
+	if _, err := f.do(tiles[0], func() ([]byte, error) { return fetch(tiles[0]) }); err != nil {
+		t.Fatal(err)
+	}
+	if fetches[tiles[0]] != 2 {
+		t.Errorf("a later fetch of a finished tile was shared, fetched %d times", fetches[tiles[0]])
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// runCompare implements the compare subcommand, which reports the tiles
+// that are only in one of two mbtiles files or whose images differ.
+func runCompare(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	diffFilename := flags.String("geojson", "", "Write a GeoJSON file marking the tiles that differ")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s compare [--geojson diff.geojson] a.mbtiles b.mbtiles\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	a, err := openMBTiles(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Couldn't open %s: %+v", flags.Arg(0), err)
+	}
+	defer a.Close()
+
+	b, err := openMBTiles(flags.Arg(1))
+	if err != nil {
+		log.Fatalf("Couldn't open %s: %+v", flags.Arg(1), err)
+	}
+	defer b.Close()
+
+	hashes, err := tileHashes(a)
+	if err != nil {
+		log.Fatalf("Couldn't read %s: %+v", flags.Arg(0), err)
+	}
+
+	var onlyA, onlyB, different []maptile.Tile
+	same := 0
+	err = eachTileHash(b, func(t maptile.Tile, hash [md5.Size]byte) {
+		aHash, ok := hashes[t]
+		switch {
+		case !ok:
+			onlyB = append(onlyB, t)
+		case aHash != hash:
+			different = append(different, t)
+		default:
+			same++
+		}
+		delete(hashes, t)
+	})
+	if err != nil {
+		log.Fatalf("Couldn't read %s: %+v", flags.Arg(1), err)
+	}
+	for t := range hashes {
+		onlyA = append(onlyA, t)
+	}
+
+	for _, group := range []struct {
+		label string
+		tiles []maptile.Tile
+	}{{"Only in " + flags.Arg(0), onlyA}, {"Only in " + flags.Arg(1), onlyB}, {"Different", different}} {
+		fmt.Printf("%s: %d\n", group.label, len(group.tiles))
+		for i, t := range group.tiles {
+			if i == maxReported {
+				fmt.Println("\t...")
+				break
+			}
+			fmt.Printf("\t%d/%d/%d\n", t.Z, t.X, t.Y)
+		}
+	}
+	fmt.Printf("Same: %d\n", same)
+
+	if *diffFilename != "" {
+		metadata, err := readMetadata(a)
+		if err != nil {
+			log.Fatalf("Couldn't read metadata: %+v", err)
+		}
+		groups := []tileGroup{{"only-a", onlyA}, {"only-b", onlyB}, {"different", different}}
+		if err := writeTileGroups(*diffFilename, metadataGrid(metadata), groups); err != nil {
+			log.Fatalf("Couldn't write %s: %+v", *diffFilename, err)
+		}
+	}
+
+	if len(onlyA)+len(onlyB)+len(different) > 0 {
+		os.Exit(1)
+	}
+}
+
+// tileHashes returns the MD5 hash of every tile in db, by its XYZ
+// coordinates.
+func tileHashes(db *sql.DB) (map[maptile.Tile][md5.Size]byte, error) {
+	hashes := map[maptile.Tile][md5.Size]byte{}
+	err := eachTileHash(db, func(t maptile.Tile, hash [md5.Size]byte) {
+		hashes[t] = hash
+	})
+	return hashes, err
+}
+
+// eachTileHash calls fn with the XYZ coordinates and MD5 hash of every tile
+// in db.
+func eachTileHash(db *sql.DB, fn func(t maptile.Tile, hash [md5.Size]byte)) error {
+	rows, err := db.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var z, x, row uint32
+		var data []byte
+		if err := rows.Scan(&z, &x, &row, &data); err != nil {
+			return err
+		}
+		fn(maptile.New(x, flipY(z, row), maptile.Zoom(z)), md5.Sum(data))
+	}
+	return rows.Err()
+}
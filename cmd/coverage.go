@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// coverageReport records which tiles came back blank and which had imagery,
+// so gaps in a service's coverage can be seen on a map.
+type coverageReport struct {
+	// maxZoom limits the report to tiles at this zoom or lower, since the
+	// deepest zooms can have millions of tiles.
+	maxZoom maptile.Zoom
+	grid    tilesource.Grid
+
+	blank     []maptile.Tile
+	populated []maptile.Tile
+}
+
+func (r *coverageReport) add(t maptile.Tile, blank bool) {
+	if t.Z > r.maxZoom {
+		return
+	}
+
+	if blank {
+		r.blank = append(r.blank, t)
+	} else {
+		r.populated = append(r.populated, t)
+	}
+}
+
+// write saves the report as a GeoJSON FeatureCollection with a polygon for
+// each tile.
+func (r *coverageReport) write(filename string) error {
+	return writeTileGroups(filename, r.grid, []tileGroup{{"blank", r.blank}, {"populated", r.populated}})
+}
+
+// tileGroup is a set of tiles with the same status in a GeoJSON report.
+type tileGroup struct {
+	status string
+	tiles  []maptile.Tile
+}
+
+// writeTileGroups saves a GeoJSON FeatureCollection with a polygon for each
+// tile, with its group's status and its coordinates as properties.
+func writeTileGroups(filename string, grid tilesource.Grid, groups []tileGroup) error {
+	fc := geojson.NewFeatureCollection()
+	for _, group := range groups {
+		for _, t := range group.tiles {
+			f := geojson.NewFeature(grid.Bound(t).ToPolygon())
+			f.Properties["status"] = group.status
+			f.Properties["z"] = t.Z
+			f.Properties["x"] = t.X
+			f.Properties["y"] = t.Y
+			fc.Append(f)
+		}
+	}
+
+	data, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+type imageResult struct {
+	imageBytes []byte
+	tile       maptile.Tile
+
+	// alreadyStored marks a tile that was found in the output when resuming,
+	// so it needs its children requested but isn't written again.
+	alreadyStored bool
+
+	// zoomComplete marks a result that isn't a tile, but a signal that every
+	// tile at tile.Z has been written.
+	zoomComplete bool
+
+	// err is why a tile that's being skipped couldn't be fetched.
+	err error
+
+	// blank is set by processTile for tiles without imagery, and
+	// unoptimizedSize is the size of a tile before optimizePNG shrank it.
+	blank           bool
+	unoptimizedSize int
+}
+
+// siblingGroup tracks the children of a tile as they're written.
+type siblingGroup struct {
+	size      int
+	remaining int
+	// streak is the number of sparse levels above this one.
+	streak int
+	// recurse is the siblings whose children should be crawled.
+	recurse []maptile.Tile
+}
+
+type imageRequest struct {
+	tile maptile.Tile
+
+	// attempt counts previous tries at fetching tile.
+	attempt int
+}
+
+// crawler fetches tiles from an ESRI service and writes them to an mbtiles
+// file, recursing into the children of every tile that isn't blank.
+type crawler struct {
+	source  tilesource.Source
+	metrics *crawlMetrics
+
+	output      string
+	mbtiles     mbtilesOptions
+	concurrency int
+	// tileTimeout bounds the time spent fetching a single tile.
+	tileTimeout time.Duration
+	minZoom     maptile.Zoom
+	maxZoom     maptile.Zoom
+	// seedZoom is the zoom the crawl starts at. Tiles above minZoom are
+	// fetched but not stored, and tiles between minZoom and seedZoom are
+	// only fetched if they're the parent of a seed.
+	seedZoom maptile.Zoom
+
+	// timeoutScale, if set, scales tileTimeout for each tile's zoom.
+	timeoutScale *zoomScale
+
+	// breadthFirst completes each zoom level before starting the next.
+	breadthFirst bool
+	// planned fetches exactly the seeds, from a plan file, without
+	// recursing.
+	planned bool
+
+	// grid is the tiling scheme tiles are crawled in.
+	grid tilesource.Grid
+
+	// extent, bboxes and clip, if set, limit the crawl to tiles that
+	// intersect them, or any of the bboxes. extent only limits tiles up to
+	// minZoom, like the seeds, since the edges of a service's extent are
+	// approximate.
+	extent *orb.Bound
+	bboxes []orb.Bound
+	clip   orb.Geometry
+	// exclude are areas to skip. Tiles entirely inside one aren't fetched,
+	// while tiles that straddle an edge are, for the part outside it.
+	exclude []orb.Bound
+
+	optimizePNG     bool
+	optimizePalette bool
+	recordLatency   bool
+
+	// canonicalPNG re-encodes PNG tiles with canonicalPNG before they're
+	// optimized, if they are.
+	canonicalPNG bool
+
+	// edgeBuffer is the number of pixels to crop from each side of fetched
+	// tiles.
+	edgeBuffer int
+	// supersample is the factor fetched tiles are shrunk by after cropping.
+	supersample int
+	// reproject warps fetched tiles from EPSG:4326 to web mercator.
+	reproject bool
+	// clipMask, if set, crops tiles to the clip's polygons.
+	clipMask *clipMask
+
+	// blankSample, if set, also treats tiles that look like it as blank.
+	blankSample *blankSample
+	// storeEmpty writes emptyMarker in place of each blank tile.
+	storeEmpty bool
+	// noBlankSkip stores blank tiles like any other and recurses into them,
+	// so every tile down to maxZoom is stored.
+	noBlankSkip bool
+	// fillColors, if set, also treats tiles that are entirely one of these
+	// colors as blank. Solid tiles of other colors are real imagery, like
+	// water, so they're still crawled.
+	fillColors []color.NRGBA
+	// errorSample, if set, is an image the service renders in place of a
+	// tile when it fails, like "Image unavailable". Tiles that look like it
+	// are retried and then skipped.
+	errorSample *blankSample
+
+	// skipErrors skips tiles that still fail after any retries instead of
+	// stopping the crawl, and records them in failed.
+	skipErrors bool
+	failed     []failedTile
+
+	// maxBlankStreak, if set, stops recursing into a branch after this many
+	// levels in a row where no more than one tile among its siblings had
+	// imagery. The writer tracks each group of siblings in siblingGroups.
+	maxBlankStreak int
+	siblingGroups  map[maptile.Tile]*siblingGroup
+
+	// minCoverage, if set, aborts the crawl if less than this fraction of
+	// the seeds at minZoom have imagery, since the extent or spatial
+	// reference is probably wrong.
+	minCoverage      float64
+	minZoomTiles     int
+	minZoomSeen      int
+	minZoomPopulated int
+
+	// strict records blank tiles that are entirely inside the extent and
+	// bbox in strictFailures, since a service expected to cover the whole
+	// area shouldn't have any.
+	strict         bool
+	strictFailures []maptile.Tile
+
+	// coverage, if set, records which tiles were blank.
+	coverage *coverageReport
+
+	// geoPackage writes a GeoPackage tile pyramid instead of mbtiles.
+	geoPackage bool
+	// tileTree writes a file per tile to a directory or S3 instead.
+	tileTree bool
+	// lossyOutput, if set, is a second mbtiles file to write a JPEG copy of
+	// each tile to, at lossyQuality.
+	lossyOutput  string
+	lossyQuality int
+
+	// splitZooms, if set, starts a new output file at each of these zooms.
+	splitZooms []maptile.Zoom
+
+	// existing, if set, has the tiles already in the output from a previous
+	// run, which aren't fetched again.
+	existing tileIndex
+
+	// rampDuration staggers the start of the fetch workers over this long
+	// to avoid a burst of requests at startup.
+	rampDuration time.Duration
+	// jitter, if set, waits a random time up to this long before each
+	// request so the workers don't send requests in lockstep.
+	jitter time.Duration
+
+	// finalMetadata, if set, returns extra metadata rows to write once every
+	// tile has been written.
+	finalMetadata func() []metadataRow
+	// onZoomComplete, if set, is called with each zoom's stats once it's
+	// been written, in breadth-first mode.
+	onZoomComplete func(zoom maptile.Zoom, stats zoomStats)
+
+	// limiter, if set, adapts the number of concurrent fetches to how the
+	// service responds, up to concurrency.
+	limiter *adaptiveLimiter
+	// throttle, if set, limits the rate of requests while they're failing.
+	throttle *errorThrottle
+
+	requestPipe chan *imageRequest
+	resultPipe  chan *imageResult
+
+	// decodeConcurrency is the number of workers that decode and transform
+	// fetched tiles between resultPipe and processedPipe, apart from the
+	// fetch workers, since that work is bound by CPU rather than the network.
+	decodeConcurrency int
+	processedPipe     chan *imageResult
+
+	// pending counts tiles that have been requested but not yet written
+	// (or, in breadth-first mode, tiles at the current level).
+	pending sync.WaitGroup
+
+	nextLevelMu sync.Mutex
+	nextLevel   []maptile.Tile
+
+	// verbose logs the outcome of every tile.
+	verbose bool
+
+	// retriesPerTile is how many more times a tile is fetched after a
+	// retryable error, like a 503, an incomplete image, or the service's
+	// error image. The client doesn't retry requests itself, so this is the
+	// only layer of retries for errors.
+	retriesPerTile int
+
+	// retryOnBlank fetches blank tiles this many more times in case the
+	// service returned them by mistake, counting in blankRecovered the ones
+	// that turned out to have imagery.
+	retryOnBlank   int
+	blankRecovered uint64
+
+	// requested keeps a tile from being requested twice, and flights from
+	// being fetched by two workers at once.
+	requested *requestedTiles
+	flights   *tileFlights
+
+	// maxFanOut, if set, meters children into the request pipe through
+	// fanOut, at most this many per finished tile. requestDepth samples the
+	// pipe's depth to show how bursty it is.
+	maxFanOut    int
+	fanOut       *fanOut
+	requestDepth depthStats
+
+	// shard, if set, limits the crawl to the seeds in one part of it.
+	shard *shard
+
+	// maxOutputBytes, if set, stops adding tiles once the output would grow
+	// past about this size. outputFull is set once it has, and
+	// deepestZoom and completeZoom, if any zoom was completed, record how
+	// far the crawl got.
+	maxOutputBytes int64
+	outputFull     int32
+	deepestZoom    maptile.Zoom
+	completeZoom   *maptile.Zoom
+
+	// maxIdleTime, if set, aborts the crawl if no tile has been fetched for
+	// this long. lastProgress is when one last was, in Unix nanoseconds.
+	maxIdleTime  time.Duration
+	lastProgress int64
+}
+
+// tileOverheadBytes estimates the space a tile takes in the output beyond
+// its data, for its row and index entries and unused space in pages, since
+// the file's size lags the tiles written to it.
+const tileOverheadBytes = 100
+
+func newCrawler(source tilesource.Source, output string) *crawler {
+	return &crawler{
+		source:        source,
+		metrics:       newCrawlMetrics(),
+		output:        output,
+		tileTimeout:   tileTimeout,
+		grid:          tilesource.WebMercator{},
+		siblingGroups: map[maptile.Tile]*siblingGroup{},
+		flights:       newTileFlights(),
+		requestPipe:   make(chan *imageRequest, 5000000),
+		resultPipe:    make(chan *imageResult, 1000),
+		processedPipe: make(chan *imageResult, 1000),
+
+		decodeConcurrency: runtime.GOMAXPROCS(0),
+	}
+}
+
+// run crawls outward from the given seed tiles until every branch is blank
+// or reaches maxZoom.
+func (c *crawler) run(ctx context.Context, seeds maptile.Set) {
+	requestWG := &sync.WaitGroup{}
+	decodeWG := &sync.WaitGroup{}
+	writerWG := &sync.WaitGroup{}
+	c.requested = newRequestedTiles(seeds)
+
+	if c.minCoverage > 0 {
+		for t := range seeds {
+			if t.Z == c.minZoom {
+				c.minZoomTiles++
+			}
+		}
+		if c.minZoomTiles == 0 {
+			log.Printf("Not checking --min-coverage since there are no seeds at z%d", c.minZoom)
+		}
+	}
+
+	if c.breadthFirst {
+		go c.enqueueLevels(seeds)
+	} else {
+		if c.maxFanOut > 0 {
+			c.fanOut = newFanOut(c.maxFanOut, c.concurrency)
+			go c.fanOut.feed(c.requestPipe)
+		}
+
+		c.pending.Add(len(seeds))
+		go func() {
+			for t := range seeds {
+				c.requestPipe <- &imageRequest{
+					tile: t,
+				}
+			}
+			log.Printf("Done inserting first zoom")
+		}()
+
+		go func() {
+			c.pending.Wait()
+			close(c.requestPipe)
+		}()
+	}
+
+	go func() {
+		for range time.Tick(1 * time.Second) {
+			c.requestDepth.observe(len(c.requestPipe))
+			log.Printf("Requests: %4d, Results: %4d, Processed: %4d", len(c.requestPipe), len(c.resultPipe), len(c.processedPipe))
+		}
+	}()
+
+	if c.maxIdleTime > 0 {
+		atomic.StoreInt64(&c.lastProgress, time.Now().UnixNano())
+		go c.watchIdle()
+	}
+
+	for i := 0; i < c.concurrency; i++ {
+		requestWG.Add(1)
+		delay := c.rampDuration * time.Duration(i) / time.Duration(c.concurrency)
+		go func() {
+			defer requestWG.Done()
+			time.Sleep(delay)
+			c.fetchTiles(ctx)
+		}()
+	}
+
+	for i := 0; i < c.decodeConcurrency; i++ {
+		decodeWG.Add(1)
+		go func() {
+			defer decodeWG.Done()
+			c.processTiles()
+		}()
+	}
+
+	writerWG.Add(1)
+	go func() {
+		defer writerWG.Done()
+		c.writeTiles()
+	}()
+
+	requestWG.Wait()
+	close(c.resultPipe)
+	decodeWG.Wait()
+	close(c.processedPipe)
+	writerWG.Wait()
+
+	if c.limiter != nil {
+		log.Printf("Adaptive concurrency settled at %d workers", c.limiter.current())
+	}
+	if n := c.requested.duplicates; n > 0 {
+		log.Printf("Skipped %d duplicate tile requests", n)
+	}
+	if n := c.flights.coalesced; n > 0 {
+		log.Printf("Shared %d fetches of tiles that were already being fetched", n)
+	}
+	if n, mean, stddev := c.requestDepth.summary(); n > 0 {
+		log.Printf("Request queue depth: mean %.1f, standard deviation %.1f over %d samples", mean, stddev, n)
+	}
+}
+
+// enqueueLevels feeds the request pipe one zoom level at a time, waiting for
+// each level to be written before requesting the children found in it.
+func (c *crawler) enqueueLevels(seeds maptile.Set) {
+	seedLevels := map[maptile.Zoom][]maptile.Tile{}
+	z := c.maxZoom
+	for t := range seeds {
+		seedLevels[t.Z] = append(seedLevels[t.Z], t)
+		if t.Z < z {
+			z = t.Z
+		}
+	}
+
+	level := seedLevels[z]
+	for len(level) > 0 {
+		log.Printf("Fetching %d tiles at z%d", len(level), z)
+
+		c.pending.Add(len(level))
+		for _, t := range level {
+			c.requestPipe <- &imageRequest{
+				tile: t,
+			}
+		}
+		c.pending.Wait()
+
+		c.resultPipe <- &imageResult{
+			tile:         maptile.Tile{Z: z},
+			zoomComplete: true,
+		}
+
+		c.nextLevelMu.Lock()
+		level, c.nextLevel = c.nextLevel, nil
+		c.nextLevelMu.Unlock()
+
+		z++
+		level = append(level, seedLevels[z]...)
+	}
+
+	close(c.requestPipe)
+}
+
+const (
+	// tileTimeout is the default bound on the time spent fetching a single
+	// tile.
+	tileTimeout = 15 * time.Second
+
+	// maxAdaptiveRetries is how many times a tile the service pushed back on
+	// is retried in adaptive concurrency mode, unless --retries-per-tile says
+	// otherwise.
+	maxAdaptiveRetries = 10
+)
+
+// fetchTileWithTimeout fetches t from source, giving up after timeout.
+func fetchTileWithTimeout(ctx context.Context, source tilesource.Source, t maptile.Tile, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return source.FetchTile(ctx, t)
+}
+
+// errErrorImage is the error for a tile that looks like the service's error
+// image.
+var errErrorImage = errors.New("tile looks like the service's error image")
+
+// fetchTiles fetches each requested tile and passes it on to the writer.
+func (c *crawler) fetchTiles(ctx context.Context) {
+	for req := range c.requestPipe {
+		if c.existing != nil && c.existing.has(req.tile) {
+			c.resultPipe <- &imageResult{
+				tile:          req.tile,
+				alreadyStored: true,
+			}
+			continue
+		}
+
+		if atomic.LoadInt32(&c.outputFull) != 0 {
+			// The writer drops tiles once the output is full.
+			c.resultPipe <- &imageResult{tile: req.tile}
+			continue
+		}
+
+		// Wait before taking a slot from the limiter, so jitter doesn't
+		// count against its concurrency.
+		if c.jitter > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(c.jitter))))
+		}
+
+		if c.throttle != nil {
+			c.throttle.wait()
+		}
+		if c.limiter != nil {
+			c.limiter.acquire()
+		}
+
+		start := time.Now()
+		atomic.AddInt64(&c.metrics.inFlight, 1)
+		imageBytes, err := c.flights.do(req.tile, func() ([]byte, error) {
+			return fetchTileWithTimeout(ctx, c.source, req.tile, c.timeoutAt(req.tile.Z))
+		})
+		atomic.AddInt64(&c.metrics.inFlight, -1)
+		if err == nil && c.errorSample != nil && c.errorSample.matches(imageBytes) {
+			err = errErrorImage
+		}
+
+		if c.limiter != nil {
+			c.limiter.release(time.Since(start), err)
+		}
+		if c.throttle != nil {
+			c.throttle.record(err != nil)
+		}
+
+		if err != nil {
+			atomic.AddUint64(&c.metrics.tilesErrored, 1)
+			if isRetryable(err) && req.attempt < c.retriesPerTile {
+				log.Printf("Retrying tile %d/%d/%d after error: %+v", req.tile.Z, req.tile.X, req.tile.Y, err)
+				time.Sleep(time.Duration(req.attempt+1) * time.Second)
+				req.attempt++
+				c.requestPipe <- req
+				continue
+			}
+			if err == errErrorImage || c.skipErrors {
+				log.Printf("Skipping tile %d/%d/%d: %+v", req.tile.Z, req.tile.X, req.tile.Y, err)
+				c.resultPipe <- &imageResult{tile: req.tile, err: err}
+				continue
+			}
+			log.Fatalf("Couldn't fetch tile: %+v", err)
+		}
+
+		if err == nil && c.retryOnBlank > 0 && c.looksBlank(imageBytes) {
+			imageBytes = c.refetchBlank(ctx, req.tile, imageBytes)
+		}
+
+		atomic.AddUint64(&c.metrics.tilesFetched, 1)
+		if c.recordLatency {
+			c.metrics.latency.observe(time.Since(start))
+		}
+
+		c.resultPipe <- &imageResult{
+			imageBytes: imageBytes,
+			tile:       req.tile,
+		}
+	}
+	log.Printf("Closing request pipe")
+}
+
+// processTiles decodes and transforms fetched tiles, like blank detection,
+// reshaping and optimizing, and passes them on to the writer.
+func (c *crawler) processTiles() {
+	for r := range c.resultPipe {
+		if !r.zoomComplete && !r.alreadyStored && r.err == nil && c.grid.Valid(r.tile) &&
+			atomic.LoadInt32(&c.outputFull) == 0 {
+			c.processTile(r)
+		}
+		c.processedPipe <- r
+	}
+}
+
+// processTile does the work on a fetched tile that doesn't depend on the
+// output, in any order with other tiles.
+func (c *crawler) processTile(r *imageResult) {
+	r.blank = c.looksBlank(r.imageBytes)
+	// Blank tiles that are stored still need to be the right shape.
+	reshape := !r.blank || (c.noBlankSkip && len(r.imageBytes) > 0)
+	if c.reproject && reshape {
+		reprojected, transparent, err := reprojectTile(r.imageBytes, c.imageBound(r.tile))
+		if err != nil {
+			log.Fatalf("Couldn't reproject tile %d/%d/%d: %+v", r.tile.Z, r.tile.X, r.tile.Y, err)
+		}
+		r.imageBytes, r.blank = reprojected, transparent
+	}
+	if (c.edgeBuffer > 0 || c.supersample > 1) && reshape {
+		reshaped, transparent, err := reshapeTile(r.imageBytes, c.edgeBuffer, c.supersample)
+		if err != nil {
+			log.Fatalf("Couldn't reshape tile %d/%d/%d: %+v", r.tile.Z, r.tile.X, r.tile.Y, err)
+		}
+		r.imageBytes, r.blank = reshaped, transparent
+	}
+	if c.clipMask != nil && !r.blank {
+		// A tile left empty only has slivers of the clip narrower than
+		// a pixel, so it's treated as blank.
+		cropped, empty, err := c.clipMask.crop(r.imageBytes, c.grid.Bound(r.tile))
+		if err != nil {
+			log.Fatalf("Couldn't crop tile %d/%d/%d: %+v", r.tile.Z, r.tile.X, r.tile.Y, err)
+		}
+		r.imageBytes, r.blank = cropped, empty
+	}
+	if c.noBlankSkip && len(r.imageBytes) == 0 {
+		// There's no image where the service has no tile.
+		r.imageBytes = transparentTile
+	}
+
+	// Only tiles that will be stored are encoded again.
+	if (r.blank && !c.noBlankSkip) || r.tile.Z < c.minZoom {
+		return
+	}
+
+	if c.canonicalPNG && detectFormat(r.imageBytes) == "png" {
+		canonical, err := canonicalPNG(r.imageBytes)
+		if err != nil {
+			log.Printf("Couldn't canonicalize tile %d/%d/%d, storing as-is: %+v", r.tile.Z, r.tile.X, r.tile.Y, err)
+		} else {
+			r.imageBytes = canonical
+		}
+	}
+
+	if c.optimizePNG && detectFormat(r.imageBytes) == "png" {
+		optimized, err := optimizePNG(r.imageBytes, c.optimizePalette)
+		if err != nil {
+			log.Printf("Couldn't optimize tile %d/%d/%d, storing as-is: %+v", r.tile.Z, r.tile.X, r.tile.Y, err)
+		} else {
+			r.unoptimizedSize = len(r.imageBytes)
+			r.imageBytes = optimized
+		}
+	}
+}
+
+// writeTiles stores fetched tiles and requests the children of the ones that
+// weren't blank.
+func (c *crawler) writeTiles() {
+	opts := c.mbtiles
+	opts.minZoom, opts.maxZoom = c.minZoom, c.maxZoom
+
+	var w tileOutput
+	var err error
+	switch {
+	case c.geoPackage:
+		w, err = createGeoPackage(c.output, opts)
+	case c.tileTree:
+		w, err = createTileTree(c.output, opts)
+	case len(c.splitZooms) > 0:
+		w, err = createSplitMBTiles(c.output, opts, splitZoomRanges(c.minZoom, c.maxZoom, c.splitZooms))
+	default:
+		w, err = createMBTiles(c.output, opts)
+	}
+	if err != nil {
+		log.Fatalf("Couldn't create mbtiles: %+v", err)
+	}
+	if c.lossyOutput != "" {
+		w, err = createLossyWriter(w, c.lossyOutput, opts, c.lossyQuality)
+		if err != nil {
+			log.Fatalf("Couldn't create --lossy-refine output: %+v", err)
+		}
+	}
+
+	var outputBytes int64
+	if c.maxOutputBytes > 0 {
+		// Resumed files start with the tiles they already have.
+		for _, filename := range c.outputFilenames() {
+			if info, err := os.Stat(filename); err == nil {
+				outputBytes += info.Size()
+			}
+		}
+	}
+
+	var bytesBeforeOptimize, bytesAfterOptimize int
+	zooms := map[maptile.Zoom]*zoomStats{}
+	statsFor := func(z maptile.Zoom) *zoomStats {
+		if zooms[z] == nil {
+			zooms[z] = &zoomStats{}
+		}
+		return zooms[z]
+	}
+	for r := range c.processedPipe {
+		if r.zoomComplete {
+			stats := statsFor(r.tile.Z)
+			delete(zooms, r.tile.Z)
+			if r.tile.Z < c.minZoom || atomic.LoadInt32(&c.outputFull) != 0 {
+				continue
+			}
+			z := r.tile.Z
+			c.completeZoom = &z
+			if err := w.markZoomComplete(r.tile.Z); err != nil {
+				c.writeFailed(err)
+			}
+			log.Printf("Finished z%d", r.tile.Z)
+			if c.onZoomComplete != nil {
+				c.onZoomComplete(r.tile.Z, *stats)
+			}
+			continue
+		}
+
+		if r.err == nil {
+			atomic.StoreInt64(&c.lastProgress, time.Now().UnixNano())
+		}
+
+		if r.alreadyStored {
+			c.logTile(r.tile, "already stored", 0)
+			c.checkMinCoverage(r.tile, false)
+			c.finishTile(r.tile, c.recurses(r.tile))
+			c.pending.Done()
+			continue
+		}
+
+		if r.err != nil {
+			c.logTile(r.tile, fmt.Sprintf("error: %v", r.err), 0)
+			c.failed = append(c.failed, failedTile{tile: r.tile, err: r.err})
+			statsFor(r.tile.Z).failed++
+			c.finishTile(r.tile, false)
+			c.pending.Done()
+			continue
+		}
+
+		if atomic.LoadInt32(&c.outputFull) != 0 {
+			c.logTile(r.tile, "skipped, output full", len(r.imageBytes))
+			c.finishTile(r.tile, false)
+			c.pending.Done()
+			continue
+		}
+
+		if !c.grid.Valid(r.tile) {
+			log.Printf("Skipping tile %d/%d/%d, which is out of range for its zoom", r.tile.Z, r.tile.X, r.tile.Y)
+			atomic.AddUint64(&c.metrics.tilesSkipped, 1)
+			c.finishTile(r.tile, false)
+			c.pending.Done()
+			continue
+		}
+
+		blank := r.blank
+		if blank {
+			statsFor(r.tile.Z).blank++
+		}
+		if c.coverage != nil {
+			c.coverage.add(r.tile, blank)
+		}
+
+		c.checkMinCoverage(r.tile, blank)
+
+		if blank && c.strict && c.fullyCovered(r.tile) {
+			log.Printf("Tile %d/%d/%d is blank inside the expected coverage", r.tile.Z, r.tile.X, r.tile.Y)
+			c.strictFailures = append(c.strictFailures, r.tile)
+		}
+
+		if blank && c.storeEmpty && r.tile.Z >= c.minZoom && atomic.LoadInt32(&c.outputFull) == 0 {
+			if err := w.put(r.tile, emptyMarker); err != nil {
+				c.writeFailed(err)
+			}
+			outputBytes += int64(len(emptyMarker)) + tileOverheadBytes
+		}
+		if blank && !c.noBlankSkip {
+			c.logTile(r.tile, "blank", len(r.imageBytes))
+			// Don't write or recurse into the next level because this tile was completely blank
+			atomic.AddUint64(&c.metrics.tilesSkipped, 1)
+			c.finishTile(r.tile, false)
+			c.pending.Done()
+			continue
+		}
+
+		if r.tile.Z < c.minZoom {
+			// Tiles above the stored zooms only show where to recurse.
+			c.logTile(r.tile, "not stored above min zoom", len(r.imageBytes))
+			c.finishTile(r.tile, c.recurses(r.tile))
+			c.pending.Done()
+			continue
+		}
+
+		if r.unoptimizedSize > 0 {
+			bytesBeforeOptimize += r.unoptimizedSize
+			bytesAfterOptimize += len(r.imageBytes)
+		}
+
+		if c.maxOutputBytes > 0 {
+			size := int64(len(r.imageBytes)) + tileOverheadBytes
+			if outputBytes+size > c.maxOutputBytes {
+				log.Printf("Output reached --max-output-bytes, so no more tiles will be added")
+				atomic.StoreInt32(&c.outputFull, 1)
+				c.logTile(r.tile, "skipped, output full", len(r.imageBytes))
+				c.finishTile(r.tile, false)
+				c.pending.Done()
+				continue
+			}
+			outputBytes += size
+		}
+
+		if err := w.put(r.tile, r.imageBytes); err != nil {
+			c.writeFailed(err)
+		}
+		if r.tile.Z > c.deepestZoom {
+			c.deepestZoom = r.tile.Z
+		}
+
+		atomic.AddUint64(&c.metrics.tilesWritten, 1)
+		atomic.AddUint64(&c.metrics.bytesWritten, uint64(len(r.imageBytes)))
+		stats := statsFor(r.tile.Z)
+		stats.written++
+		stats.bytes += int64(len(r.imageBytes))
+
+		c.logTile(r.tile, "written", len(r.imageBytes))
+
+		c.finishTile(r.tile, c.recurses(r.tile))
+		c.pending.Done()
+	}
+
+	if c.optimizePNG && bytesBeforeOptimize > 0 {
+		log.Printf("Optimized PNGs from %d to %d bytes (%0.1f%% smaller)", bytesBeforeOptimize, bytesAfterOptimize,
+			100*(1-float64(bytesAfterOptimize)/float64(bytesBeforeOptimize)))
+	}
+
+	if c.finalMetadata != nil {
+		for _, m := range c.finalMetadata() {
+			if err := w.setMetadata(m.name, m.value); err != nil {
+				log.Fatalf("Couldn't write metadata: %+v", err)
+			}
+		}
+	}
+
+	if err := w.close(); err != nil {
+		c.writeFailed(err)
+	}
+}
+
+// watchIdle aborts the crawl if no tile is fetched for maxIdleTime, like when
+// the service stops responding and every request times out and is retried.
+func (c *crawler) watchIdle() {
+	for range time.Tick(time.Second) {
+		last := time.Unix(0, atomic.LoadInt64(&c.lastProgress))
+		if idle := time.Since(last); idle > c.maxIdleTime {
+			log.Fatalf("No tile has been fetched since %s (%s ago), longer than --max-idle-time %s; the service may have stopped responding",
+				last.Format(time.RFC3339), idle.Round(time.Second), c.maxIdleTime)
+		}
+	}
+}
+
+// looksBlank reports whether a tile is empty, a service's blank tile, or a
+// fill color.
+func (c *crawler) looksBlank(data []byte) bool {
+	return isBlankTile(data) || (c.blankSample != nil && c.blankSample.matches(data)) ||
+		(len(c.fillColors) > 0 && isFillTile(data, c.fillColors))
+}
+
+// refetchBlank fetches a blank tile up to retryOnBlank more times, returning
+// the first image that isn't blank, or the original if they all are.
+func (c *crawler) refetchBlank(ctx context.Context, t maptile.Tile, blank []byte) []byte {
+	for i := 0; i < c.retryOnBlank; i++ {
+		data, err := fetchTileWithTimeout(ctx, c.source, t, c.timeoutAt(t.Z))
+		if err != nil {
+			continue
+		}
+		if !c.looksBlank(data) {
+			atomic.AddUint64(&c.blankRecovered, 1)
+			c.logTile(t, fmt.Sprintf("had imagery on blank retry %d", i+1), len(data))
+			return data
+		}
+	}
+	return blank
+}
+
+// timeoutAt returns the time a tile at z can take to fetch.
+func (c *crawler) timeoutAt(z maptile.Zoom) time.Duration {
+	if c.timeoutScale == nil {
+		return c.tileTimeout
+	}
+	return time.Duration(float64(c.tileTimeout) * c.timeoutScale.at(z))
+}
+
+// logTile logs what happened to a tile with --verbose.
+func (c *crawler) logTile(t maptile.Tile, outcome string, size int) {
+	if c.verbose {
+		log.Printf("Tile %d/%d/%d: %s, %d bytes", t.Z, t.X, t.Y, outcome, size)
+	}
+}
+
+// checkMinCoverage counts the seeds at minZoom, and once they've all been
+// fetched, aborts if too few of them had imagery.
+func (c *crawler) checkMinCoverage(t maptile.Tile, blank bool) {
+	if c.minZoomTiles == 0 || t.Z != c.minZoom {
+		return
+	}
+
+	c.minZoomSeen++
+	if !blank {
+		c.minZoomPopulated++
+	}
+	if c.minZoomSeen != c.minZoomTiles {
+		return
+	}
+
+	coverage := float64(c.minZoomPopulated) / float64(c.minZoomTiles)
+	if coverage < c.minCoverage {
+		log.Fatalf("Only %d of %d tiles (%0.1f%%) at z%d had imagery, less than --min-coverage %0.1f%%; check the extent and spatial reference",
+			c.minZoomPopulated, c.minZoomTiles, 100*coverage, c.minZoom, 100*c.minCoverage)
+	}
+	log.Printf("%0.1f%% of tiles at z%d had imagery", 100*coverage, c.minZoom)
+}
+
+// recurses reports whether t's children should be crawled if it isn't
+// blank. The parents of seeds finer than minZoom don't recurse since their
+// children are already seeded.
+func (c *crawler) recurses(t maptile.Tile) bool {
+	return !c.planned && t.Z >= c.seedZoom && t.Z+1 <= c.maxZoom
+}
+
+// finishTile requests t's children if recurse is set. With a maximum blank
+// streak, the request waits until all of t's siblings are finished, so the
+// branch can be pruned if only t has imagery.
+func (c *crawler) finishTile(t maptile.Tile, recurse bool) {
+	c.requested.finish(t)
+	if c.fanOut != nil {
+		defer c.fanOut.finished()
+	}
+
+	if c.maxBlankStreak <= 0 {
+		if recurse {
+			c.requestChildren(t)
+		}
+		return
+	}
+
+	parent := c.grid.Parent(t)
+	g, ok := c.siblingGroups[parent]
+	if !ok {
+		// Seeds aren't part of a group.
+		if recurse {
+			c.requestSiblingGroup(t, 0)
+		}
+		return
+	}
+
+	g.remaining--
+	if recurse {
+		g.recurse = append(g.recurse, t)
+	}
+	if g.remaining > 0 {
+		return
+	}
+	delete(c.siblingGroups, parent)
+
+	streak := 0
+	if g.size > 1 && len(g.recurse) <= 1 {
+		streak = g.streak + 1
+	}
+
+	for _, sibling := range g.recurse {
+		if streak > c.maxBlankStreak {
+			atomic.AddUint64(&c.metrics.branchesPruned, 1)
+			continue
+		}
+		c.requestSiblingGroup(sibling, streak)
+	}
+}
+
+// requestSiblingGroup requests t's children and starts tracking them as a
+// group.
+func (c *crawler) requestSiblingGroup(t maptile.Tile, streak int) {
+	if n := c.requestChildren(t); n > 0 {
+		c.siblingGroups[t] = &siblingGroup{size: n, remaining: n, streak: streak}
+	}
+}
+
+// requestChildren queues the children of t, either immediately or, in
+// breadth-first mode, once t's zoom level is complete.
+func (c *crawler) requestChildren(t maptile.Tile) int {
+	var children []maptile.Tile
+	for _, child := range c.grid.Children(t) {
+		if c.inCoverage(child) && c.requested.add(child) {
+			children = append(children, child)
+		}
+	}
+
+	if c.breadthFirst {
+		c.nextLevelMu.Lock()
+		c.nextLevel = append(c.nextLevel, children...)
+		c.nextLevelMu.Unlock()
+		return len(children)
+	}
+
+	c.pending.Add(len(children))
+	if c.fanOut != nil {
+		c.fanOut.add(children)
+		return len(children)
+	}
+	for _, child := range children {
+		c.requestPipe <- &imageRequest{
+			tile: child,
+		}
+	}
+
+	return len(children)
+}
+
+// inCoverage reports whether t is inside the area being crawled.
+func (c *crawler) inCoverage(t maptile.Tile) bool {
+	b := c.grid.Bound(t)
+	return (c.extent == nil || t.Z > c.minZoom || tilesource.BoundsOverlap(*c.extent, b)) &&
+		c.inBBoxes(b) &&
+		(c.clip == nil || tilesource.BoundIntersects(c.clip, b)) &&
+		!c.excluded(b)
+}
+
+// inBBoxes reports whether b overlaps any of the bboxes, or there are none.
+func (c *crawler) inBBoxes(b orb.Bound) bool {
+	for _, bbox := range c.bboxes {
+		if tilesource.BoundsOverlap(bbox, b) {
+			return true
+		}
+	}
+	return len(c.bboxes) == 0
+}
+
+// excluded reports whether b is entirely inside one of the excluded areas.
+func (c *crawler) excluded(b orb.Bound) bool {
+	for _, e := range c.exclude {
+		if tilesource.BoundContains(e, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageBound returns the area of the image fetched for t, including any
+// edge buffer.
+func (c *crawler) imageBound(t maptile.Tile) orb.Bound {
+	b := c.grid.Bound(t)
+	if c.edgeBuffer > 0 {
+		b = c.grid.Pad(b, 256*c.supersample, c.edgeBuffer)
+	}
+	return b
+}
+
+// fullyCovered reports whether t is entirely inside the extent and one of
+// the bboxes.
+func (c *crawler) fullyCovered(t maptile.Tile) bool {
+	b := c.grid.Bound(t)
+	if c.extent != nil && !tilesource.BoundContains(*c.extent, b) {
+		return false
+	}
+	for _, bbox := range c.bboxes {
+		if tilesource.BoundContains(bbox, b) {
+			return true
+		}
+	}
+	return len(c.bboxes) == 0
+}
+
+// seedTiles returns the tiles at seedZoom that cover extent and the clip,
+// along with their parents up to minZoom if seedZoom is finer. The grid's
+// cover can include the tiles past an extent that ends exactly on a tile
+// boundary, so those are dropped too.
+func (c *crawler) seedTiles(extent orb.Bound) maptile.Set {
+	seeds := maptile.Set{}
+	for _, area := range c.seedAreas(extent) {
+		for t := range c.grid.Cover(area, c.seedZoom) {
+			seeds[t] = true
+		}
+	}
+	for t := range seeds {
+		if !tilesource.BoundsOverlap(extent, c.grid.Bound(t)) || !c.inCoverage(t) {
+			delete(seeds, t)
+		}
+	}
+
+	level := seeds
+	for z := c.seedZoom; z > c.minZoom; z-- {
+		parents := maptile.Set{}
+		for t := range level {
+			parents[c.grid.Parent(t)] = true
+		}
+		for t := range parents {
+			seeds[t] = true
+		}
+		level = parents
+	}
+
+	return seeds
+}
+
+// seedAreas returns the areas to cover with seeds: each bbox, or each of
+// several clips, so disjoint areas don't seed the space between them, or
+// else the whole extent.
+func (c *crawler) seedAreas(extent orb.Bound) []orb.Bound {
+	if len(c.bboxes) > 0 {
+		return c.bboxes
+	}
+	if clips, ok := c.clip.(orb.Collection); ok && len(clips) > 1 {
+		var areas []orb.Bound
+		for _, g := range clips {
+			areas = append(areas, g.Bound())
+		}
+		return areas
+	}
+	return []orb.Bound{extent}
+}
+
+// outputFilenames returns the files the crawl writes to.
+func (c *crawler) outputFilenames() []string {
+	if len(c.splitZooms) == 0 {
+		return []string{c.output}
+	}
+
+	var filenames []string
+	for _, r := range splitZoomRanges(c.minZoom, c.maxZoom, c.splitZooms) {
+		filenames = append(filenames, splitFilename(c.output, r))
+	}
+	return filenames
+}
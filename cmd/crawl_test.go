@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// TestCrawlEndToEnd crawls a tiny extent from a fake service into an mbtiles
+// file and checks the tiles and metadata that were written.
+func TestCrawlEndToEnd(t *testing.T) {
+	server := newFakeESRI(t)
+	output := filepath.Join(t.TempDir(), "out.mbtiles")
+
+	extent := orb.Bound{Min: orb.Point{-123.1, 49.0}, Max: orb.Point{-123.08, 49.01}}
+	c := newCrawler(newFakeESRISource(server), output)
+	c.concurrency = 4
+	c.minZoom, c.maxZoom, c.seedZoom = 12, 14, 12
+	c.extent = &extent
+	c.bboxes = []orb.Bound{extent}
+	c.mbtiles = mbtilesOptions{name: "Fake", format: "png", bounds: &extent}
+	c.run(context.Background(), c.seedTiles(extent))
+
+	// The fake service has imagery everywhere, so every tile overlapping
+	// the extent should have been crawled.
+	want := maptile.Set{}
+	for z := c.minZoom; z <= c.maxZoom; z++ {
+		for tile := range c.grid.Cover(extent, z) {
+			if tilesource.BoundsOverlap(extent, c.grid.Bound(tile)) {
+				want[tile] = true
+			}
+		}
+	}
+
+	db, err := openMBTiles(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	got := 0
+	for rows.Next() {
+		var z, x, row uint32
+		var data []byte
+		if err := rows.Scan(&z, &x, &row, &data); err != nil {
+			t.Fatal(err)
+		}
+		got++
+
+		// Rows are TMS, so the tile stored at a row is the XYZ tile with
+		// its row flipped, and the image says which tile it was rendered
+		// for.
+		tile := maptile.New(x, flipY(z, row), maptile.Zoom(z))
+		if !want[tile] {
+			t.Errorf("tile %d/%d/%d at TMS row %d isn't in the extent", tile.Z, tile.X, tile.Y, row)
+		}
+		rendered := fakeTileOf(t, data)
+		if rendered.Z != tile.Z || rendered.X != tile.X&0xff || rendered.Y != tile.Y&0xff {
+			t.Errorf("tile %d/%d/%d at TMS row %d has the image of %d/%d/%d (mod 256)", tile.Z, tile.X, tile.Y, row, rendered.Z, rendered.X, rendered.Y)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got != len(want) {
+		t.Errorf("got %d tiles, want %d", got, len(want))
+	}
+
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, m := range metadata {
+		values[m.name] = m.value
+	}
+	for name, value := range map[string]string{
+		"name":    "Fake",
+		"format":  "png",
+		"minzoom": "12",
+		"maxzoom": "14",
+		"scheme":  "tms",
+		"bounds":  "-123.100000,49.000000,-123.080000,49.010000",
+	} {
+		if values[name] != value {
+			t.Errorf("metadata %s is %q, want %q", name, values[name], value)
+		}
+	}
+}
+
+// TestCrawlBBoxOnTileBoundaries crawls a bbox that is exactly one tile,
+// which must not pull in the tiles that share its edges.
+func TestCrawlBBoxOnTileBoundaries(t *testing.T) {
+	server := newFakeESRI(t)
+	output := filepath.Join(t.TempDir(), "out.mbtiles")
+
+	tile := maptile.New(163, 357, 10)
+	bbox := tile.Bound()
+	c := newCrawler(newFakeESRISource(server), output)
+	c.concurrency = 4
+	c.minZoom, c.maxZoom, c.seedZoom = 10, 12, 10
+	c.extent = &bbox
+	c.bboxes = []orb.Bound{bbox}
+	c.mbtiles = mbtilesOptions{name: "Fake", format: "png"}
+
+	seeds := c.seedTiles(bbox)
+	if len(seeds) != 1 || !seeds[tile] {
+		t.Fatalf("seeded %v, want just %v", seeds, tile)
+	}
+	c.run(context.Background(), seeds)
+
+	db, err := openMBTiles(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM tiles").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1+4+16 {
+		t.Errorf("crawled %d tiles, want the tile and its 20 descendants", n)
+	}
+}
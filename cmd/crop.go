@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+
+	"github.com/paulmach/orb"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// clipMask crops tiles to the polygons of a clip, for a clean cutline where
+// tiles straddle its edge. Other geometries in the clip are ignored.
+type clipMask struct {
+	polygons []orb.Polygon
+	// mercator is set when tile rows are evenly spaced in web mercator
+	// rather than in latitude.
+	mercator bool
+}
+
+func newClipMask(g orb.Geometry, mercator bool) *clipMask {
+	m := &clipMask{mercator: mercator}
+	m.add(g)
+	return m
+}
+
+func (m *clipMask) add(g orb.Geometry) {
+	switch g := g.(type) {
+	case orb.Polygon:
+		m.polygons = append(m.polygons, g)
+	case orb.MultiPolygon:
+		m.polygons = append(m.polygons, g...)
+	case orb.Bound:
+		m.polygons = append(m.polygons, g.ToPolygon())
+	case orb.Collection:
+		for _, child := range g {
+			m.add(child)
+		}
+	}
+}
+
+// inside reports which pixels of a width by height image covering b have
+// their centers inside the clip, row by row, and how many do.
+func (m *clipMask) inside(b orb.Bound, width, height int) ([]bool, int) {
+	mask := make([]bool, width*height)
+	count := 0
+	minY, maxY := b.Min.Y(), b.Max.Y()
+	if m.mercator {
+		minY, maxY = mercatorY(minY), mercatorY(maxY)
+	}
+
+	var polygons []orb.Polygon
+	for _, p := range m.polygons {
+		if tilesource.BoundsOverlap(p.Bound(), b) {
+			polygons = append(polygons, p)
+		}
+	}
+
+	var crossings []float64
+	for y := 0; y < height; y++ {
+		lat := maxY - (float64(y)+0.5)/float64(height)*(maxY-minY)
+		if m.mercator {
+			lat = mercatorLatitude(lat)
+		}
+
+		for _, p := range polygons {
+			// Between each pair of places the row crosses the polygon's
+			// rings is inside it, which leaves out its holes.
+			crossings = crossings[:0]
+			for _, ring := range p {
+				for i := 1; i < len(ring); i++ {
+					a, c := ring[i-1], ring[i]
+					if (a.Y() > lat) != (c.Y() > lat) {
+						crossings = append(crossings, a.X()+(lat-a.Y())*(c.X()-a.X())/(c.Y()-a.Y()))
+					}
+				}
+			}
+			sort.Float64s(crossings)
+
+			for i := 0; i+1 < len(crossings); i += 2 {
+				for x := 0; x < width; x++ {
+					lon := b.Min.X() + (float64(x)+0.5)/float64(width)*(b.Max.X()-b.Min.X())
+					if lon >= crossings[i] && lon < crossings[i+1] && !mask[y*width+x] {
+						mask[y*width+x] = true
+						count++
+					}
+				}
+			}
+		}
+	}
+	return mask, count
+}
+
+// crop makes the pixels of a PNG tile covering b that are outside the clip
+// transparent. Tiles entirely inside it are returned as they are, and it
+// reports whether nothing is left.
+func (m *clipMask) crop(data []byte, b orb.Bound) ([]byte, bool, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't decode image: %w", err)
+	}
+
+	mask, count := m.inside(b, config.Width, config.Height)
+	switch count {
+	case len(mask):
+		return data, false, nil
+	case 0:
+		return nil, true, nil
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't decode image: %w", err)
+	}
+
+	cropped := toNRGBA64(img, img.Bounds())
+	for i, in := range mask {
+		if !in {
+			cropped.SetNRGBA64(i%config.Width, i/config.Width, color.NRGBA64{})
+		}
+	}
+
+	// 16-bit grayscale has no alpha, so it becomes 16-bit RGBA.
+	like := img
+	if _, ok := img.(*image.Gray16); ok {
+		like = cropped
+	}
+	encoded, err := encodeLike(cropped, like, format)
+	if err != nil {
+		return nil, false, err
+	}
+	return encoded, false, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// secretHeaders are redacted from printed requests.
+var secretHeaders = map[string]bool{
+	"Authorization":        true,
+	"Cookie":               true,
+	"Proxy-Authorization":  true,
+	"X-Esri-Authorization": true,
+}
+
+// parseTile parses a tile written as z/x/y.
+func parseTile(value string) (maptile.Tile, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 3 {
+		return maptile.Tile{}, fmt.Errorf("tile %q must be z/x/y", value)
+	}
+
+	var coords [3]uint32
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return maptile.Tile{}, fmt.Errorf("invalid tile coordinate %q: %w", part, err)
+		}
+		coords[i] = uint32(v)
+	}
+
+	return maptile.New(coords[1], coords[2], maptile.Zoom(coords[0])), nil
+}
+
+// curlCommand formats req as a curl command line, sending its body as form
+// data if it has one. Tokens and credential
+// headers are replaced with REDACTED unless showSecrets is set.
+func curlCommand(req *http.Request, showSecrets bool) string {
+	u := req.URL.String()
+	if !showSecrets {
+		u = redactToken(u)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := []string{"curl"}
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			if secretHeaders[name] && !showSecrets {
+				value = "REDACTED"
+			}
+			args = append(args, "-H", shellQuote(name+": "+value))
+		}
+	}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := ioutil.ReadAll(body)
+			if !showSecrets {
+				data = []byte(redactToken("?" + string(data))[1:])
+			}
+			args = append(args, "--data", shellQuote(string(data)))
+		}
+	}
+	args = append(args, shellQuote(u))
+
+	return strings.Join(args, " ")
+}
+
+// redactToken hides the token parameter in u.
+func redactToken(u string) string {
+	i := strings.Index(u, "?")
+	if i < 0 {
+		return u
+	}
+
+	params := strings.Split(u[i+1:], "&")
+	for j, param := range params {
+		if strings.HasPrefix(param, "token=") {
+			params[j] = "token=REDACTED"
+		}
+	}
+	return u[:i+1] + strings.Join(params, "&")
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
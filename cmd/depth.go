@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+// is16Bit reports whether img has 16 bits per channel, like the PNGs
+// services export for U16 and S16 rasters.
+func is16Bit(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		return true
+	}
+	return false
+}
+
+// toNRGBA64 copies the r part of img into a new image at the origin. Tiles
+// are processed at 16 bits per channel so 16-bit tiles keep their precision.
+func toNRGBA64(img image.Image, r image.Rectangle) *image.NRGBA64 {
+	n := image.NewNRGBA64(image.Rect(0, 0, r.Dx(), r.Dy()))
+	src, ok := img.(*image.NRGBA)
+	if !ok {
+		draw.Draw(n, n.Bounds(), img, r.Min, draw.Src)
+		return n
+	}
+
+	// Drawing goes through premultiplied alpha, which would round the
+	// colors of translucent pixels, so these are copied as they are.
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			c := src.NRGBAAt(r.Min.X+x, r.Min.Y+y)
+			n.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(c.R) * 0x101,
+				G: uint16(c.G) * 0x101,
+				B: uint16(c.B) * 0x101,
+				A: uint16(c.A) * 0x101,
+			})
+		}
+	}
+	return n
+}
+
+// toNRGBA reduces n to 8 bits per channel without premultiplying it.
+func toNRGBA(n *image.NRGBA64) *image.NRGBA {
+	out := image.NewNRGBA(n.Rect)
+	for i := 0; i+1 < len(n.Pix); i += 2 {
+		out.Pix[i/2] = n.Pix[i]
+	}
+	return out
+}
+
+// encodeLike encodes processed pixels in format at the bit depth of the
+// original image: 8 bits per channel, 16-bit RGBA, or 16-bit grayscale, so
+// a grayscale raster doesn't come back as RGBA.
+func encodeLike(processed *image.NRGBA64, original image.Image, format string) ([]byte, error) {
+	var img image.Image
+	switch original.(type) {
+	case *image.Gray16:
+		gray := image.NewGray16(processed.Rect)
+		draw.Draw(gray, gray.Rect, processed, image.Point{}, draw.Src)
+		img = gray
+	case *image.RGBA64, *image.NRGBA64:
+		img = processed
+	default:
+		img = toNRGBA(processed)
+	}
+
+	buf := &bytes.Buffer{}
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(buf, img)
+	case "jpeg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 90})
+	default:
+		return nil, fmt.Errorf("can't re-encode %s images", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+// gray16PNG encodes a size by size 16-bit grayscale PNG with each pixel set
+// by value, like the tiles services export for U16 rasters.
+func gray16PNG(t *testing.T, size int, value func(x, y int) uint16) []byte {
+	t.Helper()
+	img := image.NewGray16(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetGray16(x, y, color.Gray16{Y: value(x, y)})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeGray16 decodes data, failing t unless it's a 16-bit grayscale PNG.
+func decodeGray16(t *testing.T, data []byte) *image.Gray16 {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := img.(*image.Gray16)
+	if !ok {
+		t.Fatalf("a 16-bit grayscale tile came back as %T", img)
+	}
+	return gray
+}
+
+// elevation gives each 2x2 block of pixels its own value, with low bytes
+// that 8 bits would lose.
+func elevation(x, y int) uint16 {
+	return 0x1234 + uint16(x/2)*3 + uint16(y/2)*1000
+}
+
+func TestReshapeGray16(t *testing.T) {
+	data, blank, err := reshapeTile(gray16PNG(t, 20, elevation), 2, 2)
+	if err != nil || blank {
+		t.Fatalf("reshaping gave blank %v and error %v", blank, err)
+	}
+
+	gray := decodeGray16(t, data)
+	if size := gray.Bounds().Size(); size != image.Pt(8, 8) {
+		t.Fatalf("reshaped tile is %v, want 8x8", size)
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if got, want := gray.Gray16At(x, y).Y, elevation(2+2*x, 2+2*y); got != want {
+				t.Fatalf("pixel %d,%d is %#x, want %#x", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestReprojectGray16(t *testing.T) {
+	bound := orb.Bound{Min: orb.Point{-123, 48}, Max: orb.Point{-122, 49}}
+	data, blank, err := reprojectTile(gray16PNG(t, 16, func(x, y int) uint16 { return 0x1234 }), bound)
+	if err != nil || blank {
+		t.Fatalf("reprojecting gave blank %v and error %v", blank, err)
+	}
+
+	// Rows are blended, but blending equal values must give the same
+	// value, not one rounded to 8 bits.
+	gray := decodeGray16(t, data)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if got := gray.Gray16At(x, y).Y; got != 0x1234 {
+				t.Fatalf("pixel %d,%d is %#x, want 0x1234", x, y, got)
+			}
+		}
+	}
+}
+
+func TestOptimizePNGGray16(t *testing.T) {
+	original := gray16PNG(t, 16, elevation)
+	for _, palette := range []bool{false, true} {
+		data, err := optimizePNG(original, palette)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gray := decodeGray16(t, data)
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				if got, want := gray.Gray16At(x, y).Y, elevation(x, y); got != want {
+					t.Fatalf("palette %v: pixel %d,%d is %#x, want %#x", palette, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestFillGray16 checks that 16-bit tiles only match a fill color exactly,
+// while 8-bit tiles are allowed some noise.
+func TestFillGray16(t *testing.T) {
+	fills := []color.NRGBA{{R: 0x12, G: 0x12, B: 0x12, A: 0xff}}
+	constant := func(v uint16) func(x, y int) uint16 {
+		return func(x, y int) uint16 { return v }
+	}
+
+	if !isFillTile(gray16PNG(t, 8, constant(0x1212)), fills) {
+		t.Error("a 16-bit tile of the fill color isn't fill")
+	}
+	if isFillTile(gray16PNG(t, 8, constant(0x1213)), fills) {
+		t.Error("a 16-bit tile one value off the fill color is fill")
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range gray.Pix {
+		gray.Pix[i] = 0x14
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, gray)
+	if !isFillTile(buf.Bytes(), fills) {
+		t.Error("an 8-bit tile within the fill tolerance isn't fill")
+	}
+}
+
+func TestBlankSampleGray16(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "blank.png")
+	if err := ioutil.WriteFile(filename, gray16PNG(t, 8, elevation), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sample, err := loadBlankSample(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sample.matches(gray16PNG(t, 8, elevation)) {
+		t.Error("the blank sample doesn't match itself")
+	}
+	nearby := gray16PNG(t, 8, func(x, y int) uint16 { return elevation(x, y) + 1 })
+	if sample.matches(nearby) {
+		t.Error("a tile differing in the low bytes matches at zero tolerance")
+	}
+	sample.tolerance = 0.001
+	if !sample.matches(nearby) {
+		t.Error("a tile within tolerance doesn't match")
+	}
+}
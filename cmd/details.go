@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// runDetails implements the details subcommand, which prints an ESRI
+// service's parsed description as JSON.
+func runDetails(args []string) {
+	flags := flag.NewFlagSet("details", flag.ExitOnError)
+	token := flags.String("token", "", "An ArcGIS token to send with every request (defaults to $ESRI_TOKEN)")
+	username := flags.String("username", "", "ArcGIS username to generate a token with (defaults to $ESRI_USERNAME)")
+	password := flags.String("password", "", "ArcGIS password to generate a token with (defaults to $ESRI_PASSWORD)")
+	slices := flags.Bool("slices", false, "Print the slices of a multidimensional image service, for --slice-id, instead of its description")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s details [--token token] [--slices] https://.../ImageServer\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	client, err := newEsriClient(ctx, flags.Arg(0), http.Header{"User-Agent": {defaultUserAgent()}}, nil, false, false, *token, *username, *password)
+	if err != nil {
+		log.Fatalf("Couldn't sign in: %+v", err)
+	}
+
+	if *slices {
+		printSlices(ctx, client)
+		return
+	}
+
+	details, err := client.GetDetails(ctx)
+	if err != nil {
+		log.Fatalf("Couldn't get service details: %+v", err)
+	}
+
+	out := struct {
+		ServiceType string                      `json:"serviceType"`
+		Details     *esriservice.ServiceDetails `json:"details"`
+	}{client.ServiceType(), details}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		log.Fatalf("Couldn't encode details: %+v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// printSlices prints each slice's ID and its value along each dimension.
+func printSlices(ctx context.Context, client *esriservice.EsriService) {
+	slices, err := client.GetSlices(ctx)
+	if err != nil {
+		log.Fatalf("Couldn't get slices: %+v", err)
+	}
+
+	for _, slice := range slices {
+		var dimensions []string
+		for _, d := range slice.Definition {
+			values, _ := json.Marshal(d.Values)
+			dimensions = append(dimensions, fmt.Sprintf("%s %s=%s", d.VariableName, d.DimensionName, values))
+		}
+		fmt.Printf("%d\t%s\n", slice.ID, strings.Join(dimensions, ", "))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// detailsCache keeps service descriptions on disk so repeated crawls of the
+// same endpoint can skip fetching them.
+type detailsCache struct {
+	dir string
+	ttl time.Duration
+}
+
+// newDetailsCache returns a cache in the user's cache directory, or nil if
+// ttl is 0 or there's no cache directory.
+func newDetailsCache(ttl time.Duration) *detailsCache {
+	if ttl <= 0 {
+		return nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Printf("Not caching service details: %+v", err)
+		return nil
+	}
+	return &detailsCache{dir: filepath.Join(dir, "imageservice-to-mbtiles", "details"), ttl: ttl}
+}
+
+// filename returns where the details for endpoint are cached. Credentials
+// are part of the key because services can describe themselves differently
+// to different users.
+func (d *detailsCache) filename(endpoint, credentials string) string {
+	sum := sha256.Sum256([]byte(endpoint + "\n" + credentials))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// get returns the cached details for endpoint, or nil if there aren't any
+// newer than the cache's TTL.
+func (d *detailsCache) get(endpoint, credentials string) *esriservice.ServiceDetails {
+	filename := d.filename(endpoint, credentials)
+	info, err := os.Stat(filename)
+	if err != nil || time.Since(info.ModTime()) > d.ttl {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	details := &esriservice.ServiceDetails{}
+	if err := json.Unmarshal(data, details); err != nil {
+		return nil
+	}
+	return details
+}
+
+func (d *detailsCache) put(endpoint, credentials string, details *esriservice.ServiceDetails) error {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.dir, 0o700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.filename(endpoint, credentials), data, 0o600)
+}
+
+// getDetails fetches the service's details, using cache if it's not nil and
+// refresh isn't set.
+func getDetails(ctx context.Context, client *esriservice.EsriService, cache *detailsCache, endpoint, credentials string, refresh bool) (*esriservice.ServiceDetails, error) {
+	if cache != nil && !refresh {
+		if details := cache.get(endpoint, credentials); details != nil {
+			log.Printf("Using cached service details")
+			return details, nil
+		}
+	}
+
+	details, err := client.GetDetails(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		if err := cache.put(endpoint, credentials, details); err != nil {
+			log.Printf("Couldn't cache service details: %+v", err)
+		}
+	}
+	return details, nil
+}
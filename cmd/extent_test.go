@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// newTinyESRI starts a service that won't render images bigger than 200x150
+// pixels, or any images at all if broken is set, and records the sizes it
+// was asked for.
+func newTinyESRI(t *testing.T, broken bool, sizes *[]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		size := r.Form.Get("size")
+		*sizes = append(*sizes, size)
+		if broken || size != "150,150" {
+			w.Write([]byte(`{"error":{"code":400,"message":"Requested image exceeds the size limit.","details":[]}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"href":   "http://" + r.Host + "/image",
+			"width":  150,
+			"height": 150,
+			"extent": map[string]interface{}{
+				"xmin": -123.5, "ymin": 48.5, "xmax": -122.5, "ymax": 49.5,
+				"spatialReference": map[string]int{"wkid": 4326},
+			},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestServiceExtentTinyMaxSize(t *testing.T) {
+	var sizes []string
+	server := newTinyESRI(t, false, &sizes)
+	client := esriservice.NewClient(server.URL + "/arcgis/rest/services/Tiny/ImageServer")
+	details := &esriservice.ServiceDetails{
+		MaxImageWidth:  200,
+		MaxImageHeight: 150,
+		FullExtent: esriservice.ExtentType{
+			XMin: 1000000, YMin: 500000, XMax: 1100000, YMax: 600000,
+			SpatialReference: esriservice.SpatialReferenceType{Wkid: 2927},
+		},
+	}
+
+	b, err := serviceExtent(context.Background(), client, details, 512, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 1 || sizes[0] != "150,150" {
+		t.Errorf("probed with sizes %v, want one 150,150 image", sizes)
+	}
+	if want := (orb.Bound{Min: orb.Point{-123.5, 48.5}, Max: orb.Point{-122.5, 49.5}}); b != want {
+		t.Errorf("extent is %v, want %v", b, want)
+	}
+}
+
+// TestServiceExtentFallback checks that a service that can't render the
+// probe at all has its extent read from its description, where that's in a
+// spatial reference that can be converted here.
+func TestServiceExtentFallback(t *testing.T) {
+	var sizes []string
+	server := newTinyESRI(t, true, &sizes)
+	client := esriservice.NewClient(server.URL + "/arcgis/rest/services/Tiny/ImageServer")
+	details := &esriservice.ServiceDetails{
+		MaxImageWidth:  200,
+		MaxImageHeight: 150,
+		FullExtent: esriservice.ExtentType{
+			XMin: -13692297, YMin: 6274861, XMax: -13688515, YMax: 6276556,
+			SpatialReference: esriservice.SpatialReferenceType{Wkid: 102100, LatestWkid: 3857},
+		},
+	}
+
+	b, err := serviceExtent(context.Background(), client, details, 512, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(b.Min.X()+123) > 0.001 || math.Abs(b.Max.Y()-49.01) > 0.001 {
+		t.Errorf("extent is %v, want the description's extent in EPSG:4326", b)
+	}
+
+	details.FullExtent.SpatialReference = esriservice.SpatialReferenceType{Wkid: 2927}
+	if b, err := serviceExtent(context.Background(), client, details, 512, time.Second); err == nil {
+		t.Errorf("got extent %v from a description in a spatial reference that can't be converted", b)
+	}
+}
+
+func TestExtentBound(t *testing.T) {
+	vancouver := orb.Bound{Min: orb.Point{-123.1, 49.0}, Max: orb.Point{-123.08, 49.01}}
+	m := project.Bound(vancouver, project.WGS84.ToMercator)
+	for _, sr := range []esriservice.SpatialReferenceType{
+		{Wkid: 4326},
+		{LatestWkid: 4326},
+		{Wkid: 3857},
+		{Wkid: 102100, LatestWkid: 3857},
+	} {
+		e := esriservice.ExtentType{XMin: vancouver.Min.X(), YMin: vancouver.Min.Y(), XMax: vancouver.Max.X(), YMax: vancouver.Max.Y(), SpatialReference: sr}
+		if sr.IsWebMercator() {
+			e = esriservice.ExtentType{XMin: m.Min.X(), YMin: m.Min.Y(), XMax: m.Max.X(), YMax: m.Max.Y(), SpatialReference: sr}
+		}
+		b, err := extentBound(e)
+		if err != nil {
+			t.Errorf("%+v: %v", sr, err)
+			continue
+		}
+		if !boundNear(b, vancouver) {
+			t.Errorf("%+v: extent converted to %v, want %v", sr, b, vancouver)
+		}
+	}
+
+	if b, err := extentBound(esriservice.ExtentType{XMax: 1, YMax: 1, SpatialReference: esriservice.SpatialReferenceType{Wkid: 2927}}); err == nil {
+		t.Errorf("an extent in wkid 2927 converted to %v", b)
+	}
+}
+
+// TestServiceExtentProbeSR answers the startup probe with its extent in
+// EPSG:4326, in web mercator, and with no spatial reference, which means
+// the one asked for.
+func TestServiceExtentProbeSR(t *testing.T) {
+	vancouver := orb.Bound{Min: orb.Point{-123.1, 49.0}, Max: orb.Point{-123.08, 49.01}}
+	m := project.Bound(vancouver, project.WGS84.ToMercator)
+	for name, extent := range map[string]map[string]interface{}{
+		"4326": {
+			"xmin": vancouver.Min.X(), "ymin": vancouver.Min.Y(), "xmax": vancouver.Max.X(), "ymax": vancouver.Max.Y(),
+			"spatialReference": map[string]int{"wkid": 4326},
+		},
+		"3857": {
+			"xmin": m.Min.X(), "ymin": m.Min.Y(), "xmax": m.Max.X(), "ymax": m.Max.Y(),
+			"spatialReference": map[string]int{"wkid": 102100, "latestWkid": 3857},
+		},
+		"none": {
+			"xmin": vancouver.Min.X(), "ymin": vancouver.Min.Y(), "xmax": vancouver.Max.X(), "ymax": vancouver.Max.Y(),
+		},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"href": "http://" + r.Host + "/image", "width": 512, "height": 512, "extent": extent,
+			})
+		}))
+		client := esriservice.NewClient(server.URL + "/arcgis/rest/services/Probe/ImageServer")
+		details := &esriservice.ServiceDetails{
+			FullExtent: esriservice.ExtentType{
+				XMin: 1000000, YMin: 500000, XMax: 1100000, YMax: 600000,
+				SpatialReference: esriservice.SpatialReferenceType{Wkid: 2927},
+			},
+		}
+
+		b, err := serviceExtent(context.Background(), client, details, 512, time.Second)
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !boundNear(b, vancouver) {
+			t.Errorf("%s: extent is %v, want %v", name, b, vancouver)
+		}
+	}
+}
+
+// boundNear reports whether a and b are the same to within a millionth of
+// a degree.
+func boundNear(a, b orb.Bound) bool {
+	for _, v := range []float64{a.Min.X() - b.Min.X(), a.Min.Y() - b.Min.Y(), a.Max.X() - b.Max.X(), a.Max.Y() - b.Max.Y()} {
+		if math.Abs(v) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+	"github.com/paulmach/orb/maptile"
+)
+
+// failedTile is a tile that was skipped after it couldn't be fetched.
+type failedTile struct {
+	tile maptile.Tile
+	err  error
+}
+
+// errorStatus returns the HTTP or service status code of err, or an empty
+// string if it didn't come from a response.
+func errorStatus(err error) string {
+	var httpErr *esriservice.HTTPError
+	if errors.As(err, &httpErr) {
+		return strconv.Itoa(httpErr.StatusCode)
+	}
+
+	var serviceErr *esriservice.ServiceError
+	if errors.As(err, &serviceErr) {
+		return strconv.Itoa(serviceErr.Code)
+	}
+
+	var requestErr *esriservice.RequestError
+	if errors.As(err, &requestErr) {
+		return strconv.Itoa(requestErr.StatusCode)
+	}
+
+	return ""
+}
+
+// errorRequest returns the URL of the request that got err and the start of
+// the response's body, quoted, if err came from a response from an esri
+// service.
+func errorRequest(err error) (string, string) {
+	var requestErr *esriservice.RequestError
+	if !errors.As(err, &requestErr) {
+		return "", ""
+	}
+	return requestErr.URL, strconv.Quote(requestErr.Body)
+}
+
+// writeFailedTiles writes one z/x/y per line to filename, and the status,
+// error, request URL and response body of each to a tab-separated
+// filename.errors alongside it, so failures can be reproduced.
+func writeFailedTiles(filename string, failed []failedTile) error {
+	if err := writeLines(filename, failed, func(f failedTile) string {
+		return fmt.Sprintf("%d/%d/%d", f.tile.Z, f.tile.X, f.tile.Y)
+	}); err != nil {
+		return err
+	}
+
+	return writeLines(filename+".errors", failed, func(f failedTile) string {
+		url, body := errorRequest(f.err)
+		return fmt.Sprintf("%d/%d/%d\t%s\t%s\t%s\t%s", f.tile.Z, f.tile.X, f.tile.Y, errorStatus(f.err), f.err, url, body)
+	})
+}
+
+func writeLines(filename string, failed []failedTile, line func(failedTile) string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, t := range failed {
+		fmt.Fprintln(w, line(t))
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("writing %s: %w", filename, err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// fakeESRIPath is where newFakeESRI serves its ImageServer.
+const fakeESRIPath = "/arcgis/rest/services/Fake/ImageServer"
+
+// newFakeESRI starts an ImageServer that renders each web mercator tile
+// with its own coordinates, the row in red, the column in green and the
+// zoom in blue, so tests can tell which tile an image came from.
+func newFakeESRI(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(fakeESRIPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":             "Fake",
+			"spatialReference": map[string]int{"wkid": 102100, "latestWkid": 3857},
+			"maxImageWidth":    4000,
+			"maxImageHeight":   4000,
+		})
+	})
+	mux.HandleFunc(fakeESRIPath+"/exportImage", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		b, err := parseBound(r.Form.Get("bbox"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"href":   fmt.Sprintf("http://%s/image?bbox=%s&size=%s", r.Host, r.Form.Get("bbox"), r.Form.Get("size")),
+			"width":  256,
+			"height": 256,
+			"extent": map[string]interface{}{
+				"xmin": b.Min.X(), "ymin": b.Min.Y(), "xmax": b.Max.X(), "ymax": b.Max.Y(),
+				"spatialReference": map[string]int{"wkid": 4326},
+			},
+		})
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		b, err := parseBound(r.URL.Query().Get("bbox"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		size := 256
+		if parts := strings.Split(r.URL.Query().Get("size"), ","); parts[0] != "" {
+			size, _ = strconv.Atoi(parts[0])
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(fakeTileImage(fakeTileAt(b), size))
+	})
+
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// fakeTileAt returns the web mercator tile whose bounds are b.
+func fakeTileAt(b orb.Bound) maptile.Tile {
+	z := maptile.Zoom(math.Round(math.Log2(360 / (b.Max.X() - b.Min.X()))))
+	return maptile.At(b.Center(), z)
+}
+
+// fakeTileImage encodes a size by size PNG filled with t's coordinates.
+func fakeTileImage(t maptile.Tile, size int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	c := color.NRGBA{R: uint8(t.Y), G: uint8(t.X), B: uint8(t.Z), A: 255}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// fakeTileOf decodes the tile a fakeTileImage was painted with, or fails t.
+func fakeTileOf(t *testing.T, data []byte) maptile.Tile {
+	t.Helper()
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("couldn't decode tile: %v", err)
+	}
+	c := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+	return maptile.Tile{X: uint32(c.G), Y: uint32(c.R), Z: maptile.Zoom(c.B)}
+}
+
+// newFakeESRISource returns a source that renders tiles with server.
+func newFakeESRISource(server *httptest.Server) *tilesource.ESRI {
+	return &tilesource.ESRI{
+		Client:   esriservice.NewClient(server.URL + fakeESRIPath),
+		TileSize: 256,
+		Format:   "png",
+	}
+}
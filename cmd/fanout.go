@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// fanOut meters the children of finished tiles into the request pipe.
+// Otherwise each tile with imagery queues all four of its children at once,
+// and a zoom where every tile has imagery arrives as a burst. Each finished
+// tile lets up to perTile waiting children through, and unused allowance only
+// builds up to burst, so the queue grows about as fast as it's worked off.
+type fanOut struct {
+	perTile int
+	burst   int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	backlog []maptile.Tile
+	credits int
+}
+
+func newFanOut(perTile, burst int) *fanOut {
+	if burst < perTile {
+		burst = perTile
+	}
+	f := &fanOut{perTile: perTile, burst: burst, credits: burst}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// add queues tiles to be let through later.
+func (f *fanOut) add(tiles []maptile.Tile) {
+	f.mu.Lock()
+	f.backlog = append(f.backlog, tiles...)
+	f.mu.Unlock()
+	f.cond.Signal()
+}
+
+// finished lets up to perTile more tiles through.
+func (f *fanOut) finished() {
+	f.mu.Lock()
+	f.credits += f.perTile
+	if f.credits > f.burst {
+		f.credits = f.burst
+	}
+	f.mu.Unlock()
+	f.cond.Signal()
+}
+
+// feed sends queued tiles to pipe as they're let through. It never returns,
+// but once the crawl is done nothing is queued, so it just waits.
+func (f *fanOut) feed(pipe chan<- *imageRequest) {
+	for {
+		f.mu.Lock()
+		for len(f.backlog) == 0 || f.credits == 0 {
+			f.cond.Wait()
+		}
+		t := f.backlog[0]
+		f.backlog = f.backlog[1:]
+		f.credits--
+		f.mu.Unlock()
+
+		pipe <- &imageRequest{tile: t}
+	}
+}
+
+// depthStats tracks the mean and variance of sampled queue depths.
+type depthStats struct {
+	mu         sync.Mutex
+	n          int
+	sum, sumSq float64
+}
+
+func (s *depthStats) observe(depth int) {
+	s.mu.Lock()
+	s.n++
+	s.sum += float64(depth)
+	s.sumSq += float64(depth) * float64(depth)
+	s.mu.Unlock()
+}
+
+// summary returns the mean and standard deviation of the samples.
+func (s *depthStats) summary() (n int, mean, stddev float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n == 0 {
+		return 0, 0, 0
+	}
+	mean = s.sum / float64(s.n)
+	return s.n, mean, math.Sqrt(math.Max(0, s.sumSq/float64(s.n)-mean*mean))
+}
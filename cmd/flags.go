@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// flagSet reports whether the named flag was given on the command line,
+// rather than left at its default.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// stringSliceFlag is a flag.Value that collects every occurrence of a
+// repeatable flag.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// intSliceFlag is a flag.Value for a comma-separated list of integers, which
+// can also be given more than once.
+type intSliceFlag []int
+
+func (s *intSliceFlag) String() string {
+	parts := make([]string, len(*s))
+	for i, v := range *s {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *intSliceFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", part)
+		}
+		*s = append(*s, v)
+	}
+	return nil
+}
+
+// colorSliceFlag is a flag.Value for colors written as r,g,b or #rrggbb,
+// which can be given more than once.
+type colorSliceFlag []color.NRGBA
+
+func (s *colorSliceFlag) String() string {
+	parts := make([]string, len(*s))
+	for i, c := range *s {
+		parts[i] = fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *colorSliceFlag) Set(value string) error {
+	var r, g, b uint8
+	var err error
+	if strings.HasPrefix(value, "#") && len(value) == 7 {
+		_, err = fmt.Sscanf(value, "#%02x%02x%02x", &r, &g, &b)
+	} else {
+		_, err = fmt.Sscanf(value, "%d,%d,%d", &r, &g, &b)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid color %q, expected r,g,b or #rrggbb", value)
+	}
+	*s = append(*s, color.NRGBA{r, g, b, 255})
+	return nil
+}
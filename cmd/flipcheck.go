@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"log"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// flipTolerance is the largest mean pixel difference, from 0 to 1, between
+// a stored tile and the same tile fetched again for --verify-flip, to allow
+// for a service that doesn't render exactly the same bytes twice.
+const flipTolerance = 0.02
+
+// verifyFlip checks that the output's rows are the right way up. Its most
+// detailed tile is read back by its TMS row and compared with the tile
+// fetched from the source again by the XYZ row it should be, and if they
+// don't match, with the tile at the other row, to tell an inverted output
+// from a service whose imagery changed.
+func (c *crawler) verifyFlip(ctx context.Context) error {
+	db, err := openMBTiles(c.output)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var z, x, row uint32
+	var stored []byte
+	err = db.QueryRow("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles ORDER BY zoom_level DESC, length(tile_data) DESC LIMIT 1").Scan(&z, &x, &row, &stored)
+	if err == sql.ErrNoRows {
+		log.Printf("No tiles to verify the rows of")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	t := maptile.New(x, flipY(z, row), maptile.Zoom(z))
+	matches, err := c.matchesSource(ctx, t, stored)
+	if err != nil {
+		return err
+	}
+	if matches {
+		log.Printf("Verified rows: tile %d/%d/%d, stored at TMS row %d, matches the service", t.Z, t.X, t.Y, row)
+		return nil
+	}
+
+	flipped := maptile.New(x, row, maptile.Zoom(z))
+	if flipped != t {
+		if matches, err := c.matchesSource(ctx, flipped, stored); err == nil && matches {
+			return fmt.Errorf("tile %d/%d/%d, stored at TMS row %d, is the service's tile %d/%d/%d, so the output's rows are upside down",
+				t.Z, t.X, t.Y, row, flipped.Z, flipped.X, flipped.Y)
+		}
+	}
+	return fmt.Errorf("tile %d/%d/%d, stored at TMS row %d, doesn't match the service's at either row; its imagery may have changed since it was fetched",
+		t.Z, t.X, t.Y, row)
+}
+
+// matchesSource reports whether stored looks like t fetched from the source
+// and processed like the crawl's tiles.
+func (c *crawler) matchesSource(ctx context.Context, t maptile.Tile, stored []byte) (bool, error) {
+	data, err := fetchTileWithTimeout(ctx, c.source, t, c.timeoutAt(t.Z))
+	if err != nil {
+		return false, fmt.Errorf("couldn't fetch tile %d/%d/%d: %w", t.Z, t.X, t.Y, err)
+	}
+	r := &imageResult{tile: t, imageBytes: data}
+	c.processTile(r)
+	if bytes.Equal(r.imageBytes, stored) {
+		return true, nil
+	}
+
+	a, _, err := image.Decode(bytes.NewReader(stored))
+	if err != nil {
+		return false, nil
+	}
+	b, _, err := image.Decode(bytes.NewReader(r.imageBytes))
+	if err != nil || a.Bounds().Size() != b.Bounds().Size() {
+		return false, nil
+	}
+	return meanDifference(toNRGBA64(a, a.Bounds()), toNRGBA64(b, b.Bounds())) <= flipTolerance, nil
+}
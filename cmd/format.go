@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// esriFormats are the exportImage formats that can be requested.
+var esriFormats = []string{"png", "png8", "png24", "png32", "jpg", "jpgpng", "gif", "bmp", "tiff", "lerc"}
+
+func checkFormat(format string) error {
+	for _, f := range esriFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(esriFormats, ", "))
+}
+
+// mbtilesFormat returns the mbtiles metadata format for tiles requested as
+// format. jpgpng tiles can be either, so they're described as png. lerc
+// isn't a standard mbtiles format, and readers need a LERC decoder.
+func mbtilesFormat(format string) string {
+	switch format {
+	case "jpg":
+		return "jpg"
+	case "gif", "bmp", "tiff", "lerc":
+		return format
+	}
+	return "png"
+}
+
+// contentType returns the MIME type of a format returned by detectFormat.
+func contentType(format string) string {
+	switch format {
+	case "jpg":
+		return "image/jpeg"
+	case "lerc":
+		return "application/x-lerc"
+	case "unknown":
+		return "application/octet-stream"
+	}
+	return "image/" + format
+}
+
+// allowedContentTypes returns the Content-Types tiles from sourceType are
+// allowed to have when format and zoomFormats are requested, plus extra. An
+// esri-cache's format isn't known until its details are read, by a client
+// that already has to check them, so any cache format is allowed, and xyz
+// tiles can also have the type their URL template's extension suggests.
+func allowedContentTypes(sourceType, format string, zoomFormats map[maptile.Zoom]string, urlTemplate string, extra []string) []string {
+	var formats []string
+	switch sourceType {
+	case "esri":
+		formats = append(formats, format)
+		for _, f := range zoomFormats {
+			formats = append(formats, f)
+		}
+	case "esri-cache":
+		formats = append(formats, "mixed", "lerc")
+	case "xyz":
+		formats = append(formats, strings.TrimPrefix(path.Ext(urlTemplate), "."))
+	}
+	return esriservice.ImageContentTypes(append(formats, extra...)...)
+}
+
+// parseZoomFormats parses --format-zoom values like "12-16=jpg" or "17=png"
+// into the format to request at each zoom. The ranges can't overlap or fall
+// outside minZoom through maxZoom, and any zooms they leave out use the
+// default --format.
+func parseZoomFormats(values []string, minZoom, maxZoom maptile.Zoom) (map[maptile.Zoom]string, error) {
+	formats := map[maptile.Zoom]string{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q must be in the form min-max=format", value)
+		}
+		if err := checkFormat(parts[1]); err != nil {
+			return nil, err
+		}
+
+		from, to, err := parseZoomRange(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", value, err)
+		}
+		if from < minZoom || to > maxZoom {
+			return nil, fmt.Errorf("%q is outside of zooms %d-%d", value, minZoom, maxZoom)
+		}
+
+		for z := from; z <= to; z++ {
+			if _, ok := formats[z]; ok {
+				return nil, fmt.Errorf("%q overlaps another range at z%d", value, z)
+			}
+			formats[z] = parts[1]
+		}
+	}
+	return formats, nil
+}
+
+// parseZoomRange parses "12-16" or a single zoom like "12".
+func parseZoomRange(value string) (maptile.Zoom, maptile.Zoom, error) {
+	parts := strings.SplitN(value, "-", 2)
+	from, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid zoom %q", parts[0])
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid zoom %q", parts[1])
+		}
+	}
+	if from < 0 || to < from {
+		return 0, 0, fmt.Errorf("invalid zoom range %q", value)
+	}
+	return maptile.Zoom(from), maptile.Zoom(to), nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/project"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// gpkgTable is the tile pyramid table in GeoPackages the crawler writes.
+const gpkgTable = "tiles"
+
+// mercatorExtent is half the width of the web mercator world in meters.
+const mercatorExtent = 20037508.342789244
+
+const gpkgSchema = `
+	CREATE TABLE IF NOT EXISTS gpkg_spatial_ref_sys (
+		srs_name TEXT NOT NULL,
+		srs_id INTEGER PRIMARY KEY,
+		organization TEXT NOT NULL,
+		organization_coordsys_id INTEGER NOT NULL,
+		definition TEXT NOT NULL,
+		description TEXT
+	);
+	INSERT OR IGNORE INTO gpkg_spatial_ref_sys VALUES
+		('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined', 'undefined cartesian coordinate reference system'),
+		('Undefined geographic SRS', 0, 'NONE', 0, 'undefined', 'undefined geographic coordinate reference system'),
+		('WGS 84 geodetic', 4326, 'EPSG', 4326, 'GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]', 'longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid'),
+		('WGS 84 / Pseudo-Mercator', 3857, 'EPSG', 3857, 'PROJCS["WGS 84 / Pseudo-Mercator",GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]],PROJECTION["Mercator_1SP"],PARAMETER["central_meridian",0],PARAMETER["scale_factor",1],PARAMETER["false_easting",0],PARAMETER["false_northing",0],UNIT["metre",1,AUTHORITY["EPSG","9001"]],AXIS["X",EAST],AXIS["Y",NORTH],EXTENSION["PROJ4","+proj=merc +a=6378137 +b=6378137 +lat_ts=0.0 +lon_0=0.0 +x_0=0.0 +y_0=0 +k=1.0 +units=m +nadgrids=@null +wktext +no_defs"],AUTHORITY["EPSG","3857"]]', 'web mercator');
+	CREATE TABLE IF NOT EXISTS gpkg_contents (
+		table_name TEXT NOT NULL PRIMARY KEY,
+		data_type TEXT NOT NULL,
+		identifier TEXT UNIQUE,
+		description TEXT DEFAULT '',
+		last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+		min_x DOUBLE,
+		min_y DOUBLE,
+		max_x DOUBLE,
+		max_y DOUBLE,
+		srs_id INTEGER,
+		CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id)
+	);
+	CREATE TABLE IF NOT EXISTS gpkg_tile_matrix_set (
+		table_name TEXT NOT NULL PRIMARY KEY,
+		srs_id INTEGER NOT NULL,
+		min_x DOUBLE NOT NULL,
+		min_y DOUBLE NOT NULL,
+		max_x DOUBLE NOT NULL,
+		max_y DOUBLE NOT NULL,
+		CONSTRAINT fk_gtms_table_name FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+		CONSTRAINT fk_gtms_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id)
+	);
+	CREATE TABLE IF NOT EXISTS gpkg_tile_matrix (
+		table_name TEXT NOT NULL,
+		zoom_level INTEGER NOT NULL,
+		matrix_width INTEGER NOT NULL,
+		matrix_height INTEGER NOT NULL,
+		tile_width INTEGER NOT NULL,
+		tile_height INTEGER NOT NULL,
+		pixel_x_size DOUBLE NOT NULL,
+		pixel_y_size DOUBLE NOT NULL,
+		CONSTRAINT pk_ttm PRIMARY KEY (table_name, zoom_level),
+		CONSTRAINT fk_tmm_table_name FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name)
+	);
+	CREATE TABLE IF NOT EXISTS ` + gpkgTable + ` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		zoom_level INTEGER NOT NULL,
+		tile_column INTEGER NOT NULL,
+		tile_row INTEGER NOT NULL,
+		tile_data BLOB NOT NULL,
+		UNIQUE (zoom_level, tile_column, tile_row)
+	);
+	CREATE TABLE IF NOT EXISTS metadata (
+		name TEXT,
+		value TEXT
+	);
+	CREATE TABLE IF NOT EXISTS crawl_progress (
+		zoom_level INT PRIMARY KEY,
+		completed_at TEXT NOT NULL
+	);
+`
+
+// gpkgWriter writes tiles to a GeoPackage tile pyramid, committing in
+// batches like tileWriter. GeoPackage rows count down from the top like XYZ,
+// so tiles are stored without flipping. The pyramid has to be a plain table,
+// so unlike mbtiles, duplicate images can't be shared.
+//
+// The mbtiles metadata is kept in a metadata table alongside the GeoPackage
+// tables, with the name and attribution also describing the tiles in
+// gpkg_contents.
+type gpkgWriter struct {
+	filename string
+	opts     mbtilesOptions
+
+	db   *sql.DB
+	tx   *sql.Tx
+	stmt *sql.Stmt
+
+	uncommitted int
+	committedAt time.Time
+}
+
+// createGeoPackage creates (or opens) a GeoPackage for writing and describes
+// its tile pyramid.
+func createGeoPackage(filename string, opts mbtilesOptions) (*gpkgWriter, error) {
+	dsn := fmt.Sprintf("file:%s?_journal_mode=MEMORY&_synchronous=OFF", filename)
+	if opts.cacheSize > 0 {
+		dsn += fmt.Sprintf("&_cache_size=-%d", opts.cacheSize)
+	}
+	if opts.busyTimeout > 0 {
+		dsn += fmt.Sprintf("&_busy_timeout=%d", opts.busyTimeout.Milliseconds())
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// The page size has to be set before the first table is created, and
+	// the application ID and version mark the file as a GeoPackage 1.2.
+	pragmas := "PRAGMA application_id = 1196444487; PRAGMA user_version = 10200;"
+	if opts.pageSize > 0 {
+		pragmas = fmt.Sprintf("PRAGMA page_size = %d; ", opts.pageSize) + pragmas
+	}
+	if _, err := db.Exec(pragmas); err != nil {
+		return nil, fmt.Errorf("couldn't set up GeoPackage: %w", err)
+	}
+
+	if _, err := db.Exec("BEGIN TRANSACTION;" + gpkgSchema + "COMMIT;"); err != nil {
+		return nil, fmt.Errorf("couldn't create tables: %w", err)
+	}
+
+	if err := ensureMetadataIndex(db); err != nil {
+		return nil, err
+	}
+
+	w := &gpkgWriter{filename: filename, opts: opts, db: db}
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+
+	if err := w.describe(); err != nil {
+		return nil, fmt.Errorf("couldn't describe tiles: %w", err)
+	}
+
+	for _, m := range opts.metadata() {
+		// Rows aren't TMS, whatever mbtiles would say.
+		if m.name == "scheme" {
+			continue
+		}
+		if err := w.setMetadata(m.name, m.value); err != nil {
+			return nil, fmt.Errorf("couldn't write metadata: %w", err)
+		}
+	}
+
+	return w, nil
+}
+
+// describe fills in the GeoPackage tables that describe the tile pyramid's
+// grid and zoom levels.
+func (w *gpkgWriter) describe() error {
+	grid := w.opts.tileGrid()
+	srs, world := 3857, orb.Bound{Min: orb.Point{-mercatorExtent, -mercatorExtent}, Max: orb.Point{mercatorExtent, mercatorExtent}}
+	if _, ok := grid.(tilesource.Geographic); ok {
+		srs, world = 4326, orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}}
+	}
+
+	contentsBound := world
+	if w.opts.bounds != nil {
+		contentsBound = *w.opts.bounds
+		if srs == 3857 {
+			contentsBound = project.Bound(contentsBound, project.WGS84.ToMercator)
+		}
+	}
+
+	if _, err := w.tx.Exec(`INSERT OR REPLACE INTO gpkg_contents (table_name, data_type, identifier, description, last_change, min_x, min_y, max_x, max_y, srs_id)
+		VALUES (?, 'tiles', ?, ?, ?, ?, ?, ?, ?, ?)`,
+		gpkgTable, w.opts.name, w.opts.attribution, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		contentsBound.Min.X(), contentsBound.Min.Y(), contentsBound.Max.X(), contentsBound.Max.Y(), srs); err != nil {
+		return err
+	}
+
+	if _, err := w.tx.Exec("INSERT OR REPLACE INTO gpkg_tile_matrix_set VALUES (?, ?, ?, ?, ?, ?)",
+		gpkgTable, srs, world.Min.X(), world.Min.Y(), world.Max.X(), world.Max.Y()); err != nil {
+		return err
+	}
+
+	for z := w.opts.minZoom; z <= w.opts.maxZoom; z++ {
+		width, height := math.Exp2(float64(z)), math.Exp2(float64(z))
+		if srs == 4326 {
+			width *= 2
+		}
+		pixelX := (world.Max.X() - world.Min.X()) / width / 256
+		pixelY := (world.Max.Y() - world.Min.Y()) / height / 256
+		if _, err := w.tx.Exec("INSERT OR REPLACE INTO gpkg_tile_matrix VALUES (?, ?, ?, ?, 256, 256, ?, ?)",
+			gpkgTable, z, int64(width), int64(height), pixelX, pixelY); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *gpkgWriter) begin() error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't create transaction: %w", err)
+	}
+
+	w.tx = tx
+	w.uncommitted, w.committedAt = 0, time.Now()
+	w.stmt, err = tx.Prepare("INSERT OR REPLACE INTO " + gpkgTable + " (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?);")
+	if err != nil {
+		return fmt.Errorf("couldn't create insert prepared statement: %w", err)
+	}
+
+	return nil
+}
+
+func (w *gpkgWriter) commit() error {
+	if err := w.stmt.Close(); err != nil {
+		return fmt.Errorf("couldn't close insert statement: %w", err)
+	}
+
+	if err := w.tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// put stores the XYZ tile t.
+func (w *gpkgWriter) put(t maptile.Tile, data []byte) error {
+	if !w.opts.tileGrid().Valid(t) {
+		return fmt.Errorf("tile %d/%d/%d is out of range", t.Z, t.X, t.Y)
+	}
+
+	if _, err := w.stmt.Exec(t.Z, t.X, t.Y, data); err != nil {
+		return fmt.Errorf("couldn't exec insert statement: %w", err)
+	}
+
+	w.uncommitted++
+	if w.opts.commitDue(w.uncommitted, w.committedAt) {
+		log.Printf("Committed")
+		if err := w.commit(); err != nil {
+			return err
+		}
+		return w.begin()
+	}
+
+	return nil
+}
+
+// setMetadata replaces the metadata row called name.
+func (w *gpkgWriter) setMetadata(name, value string) error {
+	_, err := w.tx.Exec(upsertMetadataSQL, name, value)
+	return err
+}
+
+// markZoomComplete commits everything written so far and records that zoom
+// has been fully crawled.
+func (w *gpkgWriter) markZoomComplete(zoom maptile.Zoom) error {
+	if _, err := w.tx.Exec("INSERT OR REPLACE INTO crawl_progress (zoom_level, completed_at) VALUES (?, ?)",
+		zoom, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+
+	if err := w.commit(); err != nil {
+		return err
+	}
+
+	return w.begin()
+}
+
+func (w *gpkgWriter) close() error {
+	if err := w.commit(); err != nil {
+		return err
+	}
+
+	if w.opts.vacuum {
+		log.Printf("Vacuuming %s", w.filename)
+		if _, err := w.db.Exec("VACUUM; ANALYZE;"); err != nil {
+			return fmt.Errorf("couldn't vacuum: %w", err)
+		}
+	}
+
+	if err := w.db.Close(); err != nil {
+		return fmt.Errorf("couldn't close database: %w", err)
+	}
+
+	return nil
+}
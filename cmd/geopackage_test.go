@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/project"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// TestGeoPackageTables writes a GeoPackage in each grid and reads back the
+// tables that describe its tiles to readers like QGIS and GDAL.
+func TestGeoPackageTables(t *testing.T) {
+	bounds := orb.Bound{Min: orb.Point{-123.1, 49.0}, Max: orb.Point{-123.08, 49.01}}
+	for _, test := range []struct {
+		grid       tilesource.Grid
+		srs        int
+		contents   orb.Bound
+		matrixSize [2]int64
+	}{
+		{tilesource.WebMercator{}, 3857, project.Bound(bounds, project.WGS84.ToMercator), [2]int64{8, 8}},
+		{tilesource.Geographic{}, 4326, bounds, [2]int64{16, 8}},
+	} {
+		filename := filepath.Join(t.TempDir(), "tiles.gpkg")
+		w, err := createGeoPackage(filename, mbtilesOptions{
+			name: "Fake", attribution: "Fake imagery", format: "png",
+			minZoom: 2, maxZoom: 3, grid: test.grid, bounds: &bounds,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.put(maptile.New(1, 2, 3), []byte("tile")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("sqlite3", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var table, dataType, identifier, description string
+		var b orb.Bound
+		var srs int
+		err = db.QueryRow("SELECT table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id FROM gpkg_contents").
+			Scan(&table, &dataType, &identifier, &description, &b.Min[0], &b.Min[1], &b.Max[0], &b.Max[1], &srs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table != gpkgTable || dataType != "tiles" || identifier != "Fake" || description != "Fake imagery" {
+			t.Errorf("%d: gpkg_contents describes %s as %s %q (%q)", test.srs, table, dataType, identifier, description)
+		}
+		if srs != test.srs {
+			t.Errorf("%d: gpkg_contents has srs_id %d", test.srs, srs)
+		}
+		for i, v := range []float64{b.Min[0] - test.contents.Min[0], b.Min[1] - test.contents.Min[1], b.Max[0] - test.contents.Max[0], b.Max[1] - test.contents.Max[1]} {
+			if math.Abs(v) > 1e-6 {
+				t.Errorf("%d: gpkg_contents bounds are %v, want %v (coordinate %d)", test.srs, b, test.contents, i)
+				break
+			}
+		}
+
+		// Every srs_id the tables use has to be defined.
+		var organization string
+		var coordsys int
+		if err := db.QueryRow("SELECT organization, organization_coordsys_id FROM gpkg_spatial_ref_sys WHERE srs_id = ?", test.srs).Scan(&organization, &coordsys); err != nil {
+			t.Errorf("%d: gpkg_spatial_ref_sys: %v", test.srs, err)
+		} else if organization != "EPSG" || coordsys != test.srs {
+			t.Errorf("%d: gpkg_spatial_ref_sys says it's %s:%d", test.srs, organization, coordsys)
+		}
+		for _, required := range []int{-1, 0, 4326} {
+			var n int
+			db.QueryRow("SELECT count(*) FROM gpkg_spatial_ref_sys WHERE srs_id = ?", required).Scan(&n)
+			if n != 1 {
+				t.Errorf("%d: gpkg_spatial_ref_sys is missing the required srs_id %d", test.srs, required)
+			}
+		}
+
+		var width, height int64
+		if err := db.QueryRow("SELECT matrix_width, matrix_height FROM gpkg_tile_matrix WHERE zoom_level = 3").Scan(&width, &height); err != nil {
+			t.Fatal(err)
+		}
+		if [2]int64{width, height} != test.matrixSize {
+			t.Errorf("%d: zoom 3 is %dx%d tiles, want %v", test.srs, width, height, test.matrixSize)
+		}
+
+		rows, err := db.Query("PRAGMA foreign_key_check")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows.Next() {
+			t.Errorf("%d: foreign keys are broken", test.srs)
+		}
+		rows.Close()
+
+		// GeoPackage rows count from the top, so they aren't flipped.
+		var row int
+		if err := db.QueryRow("SELECT tile_row FROM " + gpkgTable + " WHERE zoom_level = 3 AND tile_column = 1").Scan(&row); err != nil || row != 2 {
+			t.Errorf("%d: tile 3/1/2 is at row %d (%v), want 2", test.srs, row, err)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// zoomStats counts what happened to the tiles at one zoom.
+type zoomStats struct {
+	written int
+	blank   int
+	failed  int
+	bytes   int64
+}
+
+// runZoomHook runs command with sh once a zoom has been written to output,
+// with the zoom and its stats in the environment, and waits for it, so it
+// sees the output as of the end of the zoom. Commands that should run
+// alongside the crawl can background themselves.
+func runZoomHook(command, output string, zoom maptile.Zoom, stats zoomStats) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("ZOOM=%d", zoom),
+		fmt.Sprintf("TILES_WRITTEN=%d", stats.written),
+		fmt.Sprintf("TILES_BLANK=%d", stats.blank),
+		fmt.Sprintf("TILES_FAILED=%d", stats.failed),
+		fmt.Sprintf("BYTES_WRITTEN=%d", stats.bytes),
+		"OUTPUT="+output,
+	)
+	if err := cmd.Run(); err != nil {
+		log.Printf("--on-zoom-complete command failed for z%d: %+v", zoom, err)
+	}
+}
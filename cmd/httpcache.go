@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// httpCache records successful responses to disk, keyed by request, and
+// replays them, so a crawl can be repeated offline while working on how its
+// tiles are processed.
+type httpCache struct {
+	dir    string
+	replay bool
+	next   http.RoundTripper
+
+	// maxBytes, if set, stops recording once the cache holds this many
+	// bytes, and size is how many it holds.
+	maxBytes int64
+	size     int64
+	fullOnce sync.Once
+}
+
+func newHTTPCache(dir, mode string, maxBytes int64, next http.RoundTripper) (*httpCache, error) {
+	c := &httpCache{dir: dir, next: next, maxBytes: maxBytes}
+	switch mode {
+	case "record":
+	case "replay":
+		c.replay = true
+	default:
+		return nil, fmt.Errorf("unknown cache mode %q, expected record or replay", mode)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			c.size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// filename returns where the response to req is cached. Tokens aren't part of
+// the key, since they change between runs.
+func (c *httpCache) filename(req *http.Request) (string, error) {
+	u := *req.URL
+	query := u.Query()
+	query.Del("token")
+	u.RawQuery = query.Encode()
+
+	var body []byte
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		body, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+		if form, err := url.ParseQuery(string(body)); err == nil && form.Get("token") != "" {
+			form.Del("token")
+			body = []byte(form.Encode())
+		}
+	}
+
+	sum := sha256.Sum256([]byte(req.Method + " " + u.String() + "\n" + string(body)))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, key[:2], key+".http"), nil
+}
+
+func (c *httpCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	filename, err := c.filename(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.replay {
+		data, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s %s isn't in the --http-cache", req.Method, req.URL.Redacted())
+		} else if err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	}
+
+	resp, err := c.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	// Dumping the response reads its body, and leaves a copy in its place.
+	data, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if err := c.save(filename, data); err != nil {
+		log.Printf("Couldn't cache response: %+v", err)
+	}
+	return resp, nil
+}
+
+func (c *httpCache) save(filename string, data []byte) error {
+	if c.maxBytes > 0 && atomic.AddInt64(&c.size, int64(len(data))) > c.maxBytes {
+		atomic.AddInt64(&c.size, -int64(len(data)))
+		c.fullOnce.Do(func() {
+			log.Printf("The --http-cache is full, so no more responses will be recorded")
+		})
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// runList implements the list subcommand, which prints the metadata and tiles
+// in an existing mbtiles file.
+func runList(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	zoom := flags.Int("zoom", -1, "Only list tiles at this zoom level")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s list [--zoom z] file.mbtiles\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := openMBTiles(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Couldn't open database: %+v", err)
+	}
+	defer db.Close()
+
+	metadata, err := readMetadata(db)
+	if err != nil {
+		log.Fatalf("Couldn't read metadata: %+v", err)
+	}
+
+	fmt.Println("# metadata")
+	for _, m := range metadata {
+		fmt.Printf("%s\t%s\n", m.name, m.value)
+	}
+
+	query := "SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles"
+	var queryArgs []interface{}
+	if *zoom >= 0 {
+		query += " WHERE zoom_level = ?"
+		queryArgs = append(queryArgs, *zoom)
+	}
+	query += " ORDER BY zoom_level, tile_column, tile_row"
+
+	rows, err := db.Query(query, queryArgs...)
+	if err != nil {
+		log.Fatalf("Couldn't query tiles: %+v", err)
+	}
+	defer rows.Close()
+
+	fmt.Println("# tiles (z/x/y in XYZ order, bytes, format)")
+	for rows.Next() {
+		var z, x, y uint32
+		var data []byte
+		if err := rows.Scan(&z, &x, &y, &data); err != nil {
+			log.Fatalf("Couldn't read tile: %+v", err)
+		}
+
+		fmt.Printf("%d/%d/%d\t%d\t%s\n", z, x, flipY(z, y), len(data), detectFormat(data))
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Couldn't read tiles: %+v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// lossyWriter writes each tile to an output as-is and a JPEG copy of it to a
+// second mbtiles file, so a lossless archive and a smaller copy for the web
+// come from one crawl.
+type lossyWriter struct {
+	tileOutput
+	lossy   *tileWriter
+	quality int
+}
+
+func createLossyWriter(w tileOutput, filename string, opts mbtilesOptions, quality int) (*lossyWriter, error) {
+	opts.format = "jpg"
+	opts.dedup = false
+	lossy, err := createMBTiles(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lossyWriter{tileOutput: w, lossy: lossy, quality: quality}, nil
+}
+
+func (l *lossyWriter) put(t maptile.Tile, data []byte) error {
+	if err := l.tileOutput.put(t, data); err != nil {
+		return err
+	}
+
+	encoded, err := encodeJPEG(data, l.quality)
+	if err != nil {
+		return fmt.Errorf("couldn't make a JPEG of tile %d/%d/%d: %w", t.Z, t.X, t.Y, err)
+	}
+	return l.lossy.put(t, encoded)
+}
+
+func (l *lossyWriter) setMetadata(name, value string) error {
+	if err := l.tileOutput.setMetadata(name, value); err != nil {
+		return err
+	}
+	if name == "format" {
+		return nil
+	}
+	return l.lossy.setMetadata(name, value)
+}
+
+func (l *lossyWriter) markZoomComplete(zoom maptile.Zoom) error {
+	if err := l.tileOutput.markZoomComplete(zoom); err != nil {
+		return err
+	}
+	return l.lossy.markZoomComplete(zoom)
+}
+
+func (l *lossyWriter) close() error {
+	if err := l.tileOutput.close(); err != nil {
+		return err
+	}
+	return l.lossy.close()
+}
+
+// encodeJPEG re-encodes an image as a JPEG, or returns it as-is if it
+// already is one. Transparent pixels become black.
+func encodeJPEG(data []byte, quality int) ([]byte, error) {
+	if detectFormat(data) == "jpg" {
+		return data, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -2,268 +2,1295 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"sync"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3" // Register sqlite3 database driver
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/maptile"
-	"github.com/paulmach/orb/maptile/tilecover"
+	"github.com/paulmach/orb/planar"
+	"github.com/paulmach/orb/project"
 
 	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
 )
 
 const (
-	minZoom     = maptile.Zoom(12)
-	maxZoom     = maptile.Zoom(20)
-	concurrency = 32
+	minZoom = maptile.Zoom(12)
+	maxZoom = maptile.Zoom(20)
 )
 
-type imageResult struct {
-	imageBytes []byte
-	tile       maptile.Tile
-}
-
-type imageRequest struct {
-	tile maptile.Tile
-}
-
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "list":
+			runList(os.Args[2:])
+			return
+		case "merge":
+			runMerge(os.Args[2:])
+			return
+		case "details":
+			runDetails(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "compare":
+			runCompare(os.Args[2:])
+			return
+		}
+	}
+
 	endpoint := flag.String("endpoint", "", "An ESRI REST service endpoint that ends in /MapServer or /ImageServer")
-	outputFilename := flag.String("output", "", "Path to the output mbtiles")
+	portalItem := flag.String("portal-item", "", "An ArcGIS Online or Portal item ID to look up the service --endpoint from")
+	portalURL := flag.String("portal", esriservice.DefaultPortalURL, "The portal that --portal-item is in")
+	outputFilename := flag.String("output", "", "Path to the output mbtiles, which can include {endpoint-name}, {date}, and {bbox} placeholders")
+	format := flag.String("format", "png", "Image format to request from an esri service: png, png8, png24, png32, jpg, jpgpng, gif, bmp, tiff, or lerc (which needs a LERC decoder to read)")
+	lercVersion := flag.Int("lerc-version", 0, "LERC codec version to request with --format lerc (defaults to the service's)")
+	edgeBuffer := flag.Int("edge-buffer", 0, "Render this many extra pixels (at the --supersample size) around each esri tile and crop them off to hide seams at tile edges (PNG and JPEG only, at the cost of the service rendering larger images)")
+	supersample := flag.Int("supersample", 1, "Request esri tiles at this many times the size and shrink them, for sharper tiles at the cost of bandwidth")
+	var noData intSliceFlag
+	flag.Var(&noData, "nodata", "Comma-separated pixel values an esri service should make transparent, like 255 or 0,0,0. Not sent by default, since the wrong value silently drops real pixels from the output")
+	noDataFallback := flag.Bool("nodata-fallback", true, "Retry without noData if an esri service rejects it, relying on blank tile detection instead")
+	nativeBounds := flag.Bool("force-tile-bounds-in-native-sr", false, "Send esri services each tile's bounds in the service's own spatial reference instead of WGS84, still rendering in the grid's, to avoid artifacts from the service reprojecting them. Only services in web mercator or WGS84 are supported")
+	reprojectOutput := flag.Bool("reproject-output", false, "Render esri tiles in EPSG:4326 and warp them to web mercator here, for services that can't render in web mercator (PNG and JPEG only, and CPU intensive)")
+	pixelType := flag.String("pixel-type", "u8", "Pixel type to request from an esri service, like u8 or f32 for elevation with --format lerc")
+	sliceID := flag.Int("slice-id", -1, "The slice of a multidimensional esri image service to render, like one variable at one time. List them with the details subcommand's --slices")
+	outputPixelType := flag.String("output-pixel-type", "", "Pixel type for an esri service to convert rendered images to, like u8 to scale a 16-bit source down for display (not needed if the rendering already stretches to 8 bits)")
+	var formatZooms stringSliceFlag
+	flag.Var(&formatZooms, "format-zoom", "Request a different format at some zooms, like 12-16=jpg (repeatable)")
+	optimizePNGs := flag.Bool("optimize-png", false, "Re-encode stored PNG tiles at maximum compression (CPU intensive)")
+	canonicalizePNG := flag.Bool("canonicalize-png", false, "Re-encode PNG tiles with fixed settings and without timestamps or other metadata chunks, so the same imagery gives the same bytes from run to run, for --dedupe-scope and compare. Costs a decode and encode per tile, a little less CPU than --optimize-png")
+	optimizePalette := flag.Bool("optimize-png-palette", false, "With --optimize-png, store tiles with 256 or fewer colors as paletted PNGs")
+	token := flag.String("token", "", "An ArcGIS token to send with every request (defaults to $ESRI_TOKEN), or several separated by commas to take turns sending, to spread requests across tokens with their own rate limits")
+	username := flag.String("username", "", "ArcGIS username to generate a token with (defaults to $ESRI_USERNAME)")
+	password := flag.String("password", "", "ArcGIS password to generate a token with (defaults to $ESRI_PASSWORD)")
+	validateExtent := flag.Bool("validate-extent", true, "Fetch a few sample tiles across the extent before crawling and abort if they're all blank")
+	latencyStats := flag.Bool("latency-stats", false, "Record per-tile fetch latency and print a p50/p90/p99 summary at the end")
+	cacheFilename := flag.String("cache", "", "Take tiles from this existing mbtiles, like an older crawl of the same service, where it has them, and only fetch the rest. Its tiles are copied as they are, so it can't be used with --edge-buffer, --supersample, or --reproject-output")
+	shardFlag := flag.String("shard", "", "Only crawl this part, i/n, of n disjoint parts of the crawl (like 2/4), to run it in several processes or on several machines, each with its own output, and merge them afterward. A finer --seed-zoom makes the parts more even")
+	serveAddr := flag.String("serve", "", "Serve the output's tiles at /{z}/{x}/{y} on this address (e.g. :8080) as they're written, with 404s for tiles that haven't been, and keep serving once the crawl is done until interrupted. mbtiles output only")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at /metrics on this address (e.g. :9090)")
+	jsonTimeout := flag.Duration("timeout-json", tileTimeout, "Timeout for each esri exportImage request")
+	imageTimeout := flag.Duration("timeout-image", tileTimeout, "Timeout for downloading each tile image, which is the whole request for non-esri sources")
+	timeoutScale := flag.String("tile-timeout-scale", "", "Multiply --timeout-json and --timeout-image by the first of these comma-separated factors at the min zoom and the second at the max zoom, changing by the same ratio at each zoom between, like 4,0.5 to give slow renders of large areas at coarse zooms longer and give up sooner on fine ones. Timeouts are the same at every zoom by default")
+	maxIdleTime := flag.Duration("max-idle-time", 0, "Abort the crawl if no tile has been fetched for this long, so a crawl against a service that stopped responding fails instead of hanging (0 to wait forever)")
+	httpCacheDir := flag.String("http-cache", "", "Record responses from the service to this directory, or replay them from it with --http-cache-mode replay, to repeat a crawl offline")
+	httpCacheMode := flag.String("http-cache-mode", "record", "With --http-cache, record responses or replay them without contacting the service")
+	httpCacheMaxBytes := flag.Int64("http-cache-max-bytes", 1<<30, "Stop recording responses once the --http-cache holds this many bytes (0 for no limit)")
+	detailsCacheTTL := flag.Duration("details-cache-ttl", 0, "Cache esri service descriptions on disk for this long (e.g. 24h), so repeated crawls of an endpoint skip fetching them")
+	refreshDetails := flag.Bool("refresh-details", false, "Fetch the service description even if it's in the --details-cache-ttl cache, and cache the new copy")
+	probeSize := flag.Int("probe-size", 512, "Width and height in pixels of the image an esri service is asked to render of its full extent at startup, to find the extent in EPSG:4326. Kept within the service's max image size. Smaller sizes suit services that struggle to render large images, and larger ones can pin down a reprojected extent more closely. Doesn't affect the size of tiles")
+	requestTimeout := flag.Duration("request-timeout", 30*time.Second, "Timeout for fetching the service description and probing its extent at startup")
+	breadthFirst := flag.Bool("breadth-first", false, "Finish each zoom level before starting the next, so the output is always a complete (if coarse) tileset")
+	onZoomComplete := flag.String("on-zoom-complete", "", "With --breadth-first, run this shell command as each zoom is finished, like to upload or process it while the next is crawled. It gets $ZOOM, $TILES_WRITTEN, $TILES_BLANK, $TILES_FAILED, $BYTES_WRITTEN, and $OUTPUT in its environment, and the crawl waits for it, so end it with & to run it alongside")
+	pageSize := flag.Int("sqlite-page-size", 32768, "SQLite page size in bytes for newly created outputs; larger pages suit large tile blobs")
+	dedupeScope := flag.String("dedupe-scope", "", "Store each distinct image once, shared by every tile in the file (global) or only by tiles at the same zoom (zoom). Global saves the most space, while zoom keeps each level's images separate so a level can be replaced or deleted without touching the others. Only takes effect when the file is created")
+	cacheSize := flag.Int("sqlite-cache-size", 65536, "SQLite page cache size in KiB")
+	busyTimeout := flag.Duration("sqlite-busy-timeout", 5*time.Second, "How long to wait to write to the output while another process, like a viewer previewing it, has it locked")
+	batchSize := flag.Int("batch-size", 1000, "Number of tiles to write per SQLite transaction; larger batches are faster for small tiles")
+	commitInterval := flag.Duration("commit-interval", time.Minute, "Also commit the current transaction once it's been open this long, so slow crawls are saved regularly (0 to only commit full batches)")
+	vacuum := flag.Bool("vacuum", false, "Run VACUUM and ANALYZE on the output when the crawl finishes (slow on large files)")
+	compactOnClose := flag.Bool("compact-on-close", false, "Create the output in SQLite's incremental auto vacuum mode and give the space left by replaced or deleted tiles back to the filesystem when the crawl finishes. Much cheaper than --vacuum, which rewrites the whole file, but the file stays fragmented. Only takes effect on files it creates")
+	var bboxes stringSliceFlag
+	flag.Var(&bboxes, "bbox", "Only crawl within minLon,minLat,maxLon,maxLat, or within the bounds of a .geojson or .shp file (repeatable, to crawl several areas into one output)")
+	bboxSR := flag.Int("bbox-sr", 4326, "The wkid of the spatial reference --bbox is in, like a state plane's, for coordinates in the service's own projection. Web mercator is converted here, and others by the esri service, so they need --source esri")
+	var excludeBBoxes stringSliceFlag
+	flag.Var(&excludeBBoxes, "exclude-bbox", "Skip tiles entirely within minLon,minLat,maxLon,maxLat, or within the bounds of a .geojson or .shp file (repeatable)")
+	var clipFilenames stringSliceFlag
+	flag.Var(&clipFilenames, "clip", "Only crawl tiles that intersect the polygons in this .geojson or .shp file (repeatable, to crawl several areas into one output)")
+	cropToClip := flag.Bool("crop-to-clip", false, "Make the parts of tiles outside the --clip polygons transparent, for a clean cutline along their edges. Needs a --format like png that has transparency")
+	sourceType := flag.String("source", "esri", "The kind of service to crawl: esri, esri-cache (to download an esri service's cached tiles directly), wms, wmts, or xyz")
+	tileOrigin := flag.String("tile-origin", "", "Override the origin of an esri-cache tile grid, as x,y in web mercator meters")
+	useTileMap := flag.Bool("tilemap", true, "With --source esri-cache, ask the service's tilemap which tiles exist and skip the missing ones, if it has one")
+	urlTemplate := flag.String("url-template", "", "With --source xyz, a tile URL like https://{s}.example.com/{z}/{x}/{y}.png")
+	subdomains := flag.String("subdomains", "a,b,c", "With --source xyz, comma-separated values for {s} in --url-template")
+	layer := flag.String("layer", "", "With --source wms or wmts, the layer(s) to request")
+	style := flag.String("style", "", "With --source wms or wmts, the style to request")
+	wmtsMatrixSet := flag.String("wmts-matrix-set", "GoogleMapsCompatible", "With --source wmts, a web mercator quadtree TileMatrixSet identifier")
+	wmtsMatrixPrefix := flag.String("wmts-matrix-prefix", "", "With --source wmts, a prefix for TileMatrix identifiers (e.g. EPSG:3857:)")
+	concurrency := flag.Int("concurrency", 32, "Number of tiles to fetch at once")
+	decodeConcurrency := flag.Int("decode-concurrency", runtime.GOMAXPROCS(0), "Number of fetched tiles to decode and transform at once, for blank detection, --supersample, --optimize-png and the like, separately from fetching since that work is bound by CPU")
+	maxFanOut := flag.Int("max-fan-out", 0, "Queue at most this many children of tiles with imagery for each tile finished, from 1 to 4, instead of all four at once, to smooth out bursts of requests")
+	concurrencyAuto := flag.Bool("concurrency-auto", false, "Before crawling, probe the service with bursts of requests and pick the number of tiles to fetch at once, up to --concurrency")
+	exportConcurrency := flag.Int("export-concurrency", 0, "With --source esri, limit exportImage requests in flight to this many, within --concurrency (0 for no separate limit)")
+	imageConcurrency := flag.Int("image-download-concurrency", 0, "With --source esri, limit rendered image downloads in flight to this many, within --concurrency (0 for no separate limit)")
+	adaptiveConcurrency := flag.Bool("adaptive-concurrency", false, "Start with a few workers and add more while the service stays healthy, backing off on 429/5xx, up to --concurrency")
+	recordScales := flag.Bool("record-scales", false, "Store the map scale the ESRI service reported at each zoom in the output's metadata")
+	outputLayerName := flag.String("output-layer-name", "", "The layer ID in the output's json metadata row (defaults to the tileset's name)")
+	attribution := flag.String("attribution", "", "Attribution text for the output metadata (defaults to the service's copyright text)")
+	requireAttribution := flag.Bool("require-attribution", false, "Abort if there's no attribution to store with the tiles, from --attribution or the service's copyright text, for imagery whose license requires it")
+	name := flag.String("name", "", "The tileset's name in the output metadata (defaults to the service name)")
+	var metadataFlags stringSliceFlag
+	flag.Var(&metadataFlags, "metadata", "Write an extra key=value row to the output's metadata, like a project ID or license URL (repeatable)")
+	force := flag.Bool("force", false, "Let --metadata replace the standard metadata rows, like name or bounds")
+	overwriteMetadataOnly := flag.Bool("overwrite-metadata-only", false, "Rewrite the metadata of an existing --output from the current flags without fetching any tiles")
+	throttleOnError := flag.Bool("throttle-on-error", false, "Slow down requests from all workers when more than 10% of recent requests fail, halving the rate each second until errors subside and then raising it gradually")
+	warmupZoom := flag.Int("warmup-zoom", -1, "Before crawling, fetch and discard every tile at this coarse zoom to prime the caches of a service that renders on demand")
+	warmupConcurrency := flag.Int("warmup-concurrency", 2, "Number of tiles to fetch at once with --warmup-zoom")
+	rampDuration := flag.Duration("ramp-duration", 0, "Stagger the start of the fetch workers over this long (e.g. 30s) to avoid a burst of requests at startup")
+	jitter := flag.Duration("jitter", 0, "Wait a random time up to this long (e.g. 200ms) before each request, to spread out bursts from the workers")
+	resume := flag.Bool("resume", false, "Skip tiles already in --output, using an in-memory bloom filter of about 10 bits per existing tile; about 1% of missing tiles may also be skipped")
+	resumeFromZoom := flag.Int("resume-from-zoom", -1, "Delete the tiles in --output at this zoom and deeper and crawl them again, starting from the tiles it has at the zoom above. With --resume, tiles aren't deleted, and those already there are skipped")
+	resumeExact := flag.Bool("resume-exact", false, "Like --resume, but check the output file for every tile, which is slower but never skips a missing tile")
+	thumbnail := flag.String("thumbnail", "", "With --source esri, save an image of the whole extent to this .png or .jpg file for previews")
+	manifestFilename := flag.String("manifest", "", "After the crawl, write a JSON manifest to this file with the SHA-256, size, and tiles per zoom of each output file, for checking downloads of them. Not supported with --output-format dir")
+	tileJSONFilename := flag.String("tilejson", "", "Also write a TileJSON document describing the tiles to this file")
+	tileJSONURL := flag.String("tilejson-url", "", "The tile URL template for --tilejson, like https://example.com/tiles/{z}/{x}/{y}.png (defaults to a relative {z}/{x}/{y} URL)")
+	coverageFilename := flag.String("coverage-report", "", "Write a GeoJSON file marking which tiles were blank and which had imagery")
+	coverageMaxZoom := flag.Int("coverage-max-zoom", 16, "Only include tiles up to this zoom in --coverage-report")
+	blankTile := flag.String("blank-tile", "", "A sample of the service's blank tile, to skip tiles that look like it (each tile is decoded to compare, which costs CPU)")
+	blankTolerance := flag.Float64("blank-tolerance", 0.01, "Largest mean pixel difference, from 0 to 1, for a tile to match --blank-tile")
+	var fillColors colorSliceFlag
+	flag.Var(&fillColors, "fill-color", "Treat tiles entirely of this color, as r,g,b or #rrggbb, as blank and stop crawling there, for services that fill missing areas with it. Solid tiles of other colors are still crawled (repeatable)")
+	storeEmpty := flag.Bool("store-empty-as-marker", false, "Store a 1x1 transparent PNG in place of each blank tile, so consumers can tell tiles that were crawled and found empty from tiles that weren't crawled")
+	noBlankSkip := flag.Bool("no-blank-skip", false, "Store blank tiles and keep crawling beneath them, so every tile down to the max zoom is stored. The output can be many times larger")
+	retriesPerTile := flag.Int("retries-per-tile", -1, "Fetch a tile up to this many more times after a 429, 5xx, timeout, incomplete image, or --error-signature match before failing it (default 10 with --adaptive-concurrency, otherwise 0). Requests aren't retried below this, so a tile is fetched at most this many times plus one, and blank tiles are refetched separately by --retry-on-blank")
+	retryOnBlank := flag.Int("retry-on-blank", 0, "Fetch blank tiles up to this many more times before accepting them as empty, for overloaded services that sometimes return blank tiles where there's imagery")
+	errorSignature := flag.String("error-signature", "", "An image a service renders in place of tiles it fails to render, like \"Image unavailable\". Tiles that look like it are retried up to --retries-per-tile times and then skipped. These differ between services, so save one from yours")
+	errorTolerance := flag.Float64("error-signature-tolerance", 0.01, "Largest mean pixel difference, from 0 to 1, for a tile to match --error-signature")
+	skipErrors := flag.Bool("skip-errors", false, "Skip tiles that still fail after any retries instead of stopping, along with their children")
+	failedTilesOut := flag.String("failed-tiles-out", "", "Write the z/x/y of each skipped tile to this file, one per line, and each one's status, error, and, for esri services, the URL of the failed request (with any token redacted) and the start of the response, to a tab-separated .errors file next to it, to reproduce failures")
+	var verbose bool
+	flag.BoolVar(&verbose, "verbose", false, "Log each tile's z/x/y, size, and whether it was written, blank, skipped, or failed")
+	flag.BoolVar(&verbose, "v", false, "Shorthand for --verbose")
+	cpuProfile := flag.String("cpuprofile", "", "Write a CPU profile to this file")
+	memProfile := flag.String("memprofile", "", "Write a memory profile to this file when the crawl finishes")
+	traceFile := flag.String("trace", "", "Write an execution trace to this file")
+	planOut := flag.String("plan-out", "", "Write every tile the crawl could fetch, as z/x/y lines, to this file and exit without fetching anything")
+	planFile := flag.String("plan", "", "Fetch exactly the z/x/y tiles listed in this file, like one written by --plan-out, instead of crawling")
+	resolution := flag.Float64("resolution", 0, "Crawl down to the zoom whose ground resolution at the center of the extent is nearest this many meters per pixel, rather than to z20, but no finer than an esri service says its imagery is. Web mercator grid only")
+	seedZoom := flag.Int("seed-zoom", int(minZoom), "Zoom to start crawling at. Coarser zooms are fetched to find where to recurse but not stored, and finer zooms make the seed tiles smaller")
+	gridName := flag.String("grid", "webmercator", "Tiling scheme for esri services: webmercator, or geographic for the EPSG:4326 grid with two tiles at zoom 0")
+	tileMatrixSet := flag.String("tile-matrix-set", "", "Pick --grid by OGC tile matrix set name: GoogleMapsCompatible or WebMercatorQuad for webmercator, WorldCRS84Quad for geographic")
+	maxBlankStreak := flag.Int("max-depth-blank-streak", 0, "Stop recursing into a branch after this many levels in a row where no more than one tile among siblings had imagery. Saves requests on patchy coverage but can miss isolated data in mostly empty areas")
+	minCoverage := flag.Float64("min-coverage", 0, "Abort if less than this fraction (0-1) of the tiles at the first zoom have imagery, which usually means the extent or spatial reference is wrong")
+	verifyFlip := flag.Bool("verify-flip", false, "After the crawl, fetch the output's most detailed tile from the service again and check it matches the tile stored at its row, failing if it's the tile from the other end of the column instead, to catch tiles stored upside down. mbtiles output only, without --split-at-zoom or --cache")
+	strict := flag.Bool("strict", false, "Fail if any tile entirely inside the extent and bbox is blank, for services expected to cover the whole area")
+	gdalMetadata := flag.Bool("gdal-metadata", false, "Write the bounds at full precision and within web mercator's latitudes and a crs metadata row, so GDAL's MBTiles driver reports the exact extent. GDAL only reads web mercator tilesets")
+	mbtilesCompat := flag.Bool("mbtiles-compat", false, "Create the empty grids and grid_data tables and the type, version, description, and json metadata rows from the MBTiles 1.1 spec, for older readers written against it like MBUtil and TileStream")
+	maxOutputBytes := flag.Int64("max-output-bytes", 0, "Stop adding tiles once the output would grow past about this many bytes, estimated from the tiles written. With --breadth-first the output is complete through some zoom")
+	lossyRefine := flag.String("lossy-refine", "", "Also write a JPEG copy of each tile to this mbtiles file, for a web copy of a lossless crawl without fetching twice (--format must be png)")
+	lossyQuality := flag.Int("lossy-quality", 85, "JPEG quality, from 1 to 100, for --lossy-refine")
+	outputFormat := flag.String("output-format", "mbtiles", "Kind of file to write: mbtiles, gpkg for a GeoPackage tile pyramid, or dir for a z/x/y directory tree with a metadata.json, which can be in S3 with --output s3://bucket/prefix and the usual $AWS_ environment variables")
+	var viewers stringSliceFlag
+	flag.Var(&viewers, "viewer", "With --output-format dir, also write a leaflet.html or openlayers.html page that previews the tiles, like gdal2tiles does, so the directory can be put on a static host and opened as it is. Web mercator grid only, and tiles of a mixed format like jpgpng only show in the --format's (repeatable)")
+	var splitAtZoom intSliceFlag
+	flag.Var(&splitAtZoom, "split-at-zoom", "Start a new output file at these comma-separated zooms, e.g. 17 writes out-z12-16.mbtiles and out-z17-20.mbtiles")
+	printCurl := flag.String("print-curl", "", "Print the exportImage request for this z/x/y tile as a curl command and exit, without sending it")
+	showSecrets := flag.Bool("show-secrets", false, "Include tokens and credential headers in --print-curl output")
+	samplePixel := flag.String("sample-pixel", "", "Fetch this z/x/y tile, print its pixel values per band, and exit")
+	check := flag.Bool("check", false, "With --source esri or esri-cache, print a summary of the service, like its spatial reference, extent, formats, and whether it needs a token or has a tile cache, fetch a sample tile at --seed-zoom in the middle of the extent, and exit")
+	printVersion := flag.Bool("version", false, "Print the version and exit")
+	userAgent := flag.String("user-agent", defaultUserAgent(), "User-Agent header to send with every request")
+	maxConnsPerHost := flag.Int("max-conns-per-host", 0, "Limit connections to each host, or 0 for no limit")
+	maxConns := flag.Int("max-connections", 0, "Limit connections to all hosts at once, including the ones rendered images come from, so a long crawl can't run out of file descriptors (default 4 per --concurrency worker)")
+	idleConnTimeout := flag.Duration("idle-conn-timeout", 90*time.Second, "Close connections that have been idle for this long")
+	http1 := flag.Bool("http1", false, "Use HTTP/1.1 even if the server supports HTTP/2, for servers that behave badly with it")
+	post := flag.Bool("post", false, "Send esri exportImage requests as POSTs, for servers that require it (requests too long for a URL are always POSTed)")
+	prettyResponses := flag.Bool("pretty-responses", false, "Ask esri services for indented JSON (f=pjson), to read their responses more easily with --print-curl or a proxy while troubleshooting")
+	var allowContentTypes stringSliceFlag
+	flag.Var(&allowContentTypes, "allow-content-type", "Also accept tiles with this Content-Type, like image/webp or application/octet-stream for a server that labels images that way. Types for the requested format are accepted already, and anything else, like an HTML error page, fails the tile rather than being stored (repeatable)")
+	var headers stringSliceFlag
+	flag.Var(&headers, "header", "An extra 'Name: value' HTTP header to send with every request (repeatable)")
 	flag.Parse()
 
+	if *printVersion {
+		fmt.Printf("imageservice-to-mbtiles %s\n", versionString())
+		return
+	}
+
 	ctx := context.Background()
 
-	if endpoint == nil || *endpoint == "" {
-		log.Fatalf("Must supply --endpoint")
+	if (outputFilename == nil || *outputFilename == "") && *printCurl == "" && *samplePixel == "" && !*check {
+		log.Fatalf("Must supply --output")
 	}
 
-	if outputFilename == nil || *outputFilename == "" {
-		log.Fatalf("Must supply --output")
+	header := http.Header{}
+	for _, h := range headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Header %q must be in the form 'Name: value'", h)
+		}
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if header.Get("User-Agent") == "" {
+		header.Set("User-Agent", *userAgent)
 	}
 
-	esriClient := esriservice.NewClient(*endpoint)
+	if *portalItem != "" {
+		if *endpoint != "" {
+			log.Fatalf("Only one of --endpoint and --portal-item can be used")
+		}
+		itemClient, err := newEsriClient(ctx, esriservice.PortalItemURL(*portalURL, *portalItem), header, nil, false, *prettyResponses, *token, *username, *password)
+		if err != nil {
+			log.Fatalf("Couldn't sign in to portal: %+v", err)
+		}
+		item, err := itemClient.GetPortalItem(ctx)
+		if err != nil {
+			log.Fatalf("Couldn't look up portal item: %+v", err)
+		}
+		log.Printf("Portal item %q (%s) is at %s", item.Title, item.Type, item.URL)
+		*endpoint = item.URL
+	}
 
-	details, err := esriClient.GetDetails(ctx)
-	if err != nil {
-		log.Fatalf("Coudln't get details for endpoint: %+v", err)
+	if *outputFilename != "" {
+		expanded, err := expandOutput(*outputFilename, *endpoint, bboxes, time.Now())
+		if err != nil {
+			log.Fatalf("Couldn't expand --output: %+v", err)
+		}
+		if expanded != *outputFilename {
+			log.Printf("Writing to %s", expanded)
+			*outputFilename = expanded
+		}
+		if strings.HasPrefix(*outputFilename, "s3://") {
+			if *outputFormat != "dir" {
+				log.Fatalf("Writing to S3 needs --output-format dir")
+			}
+		} else if err := checkWritable(*outputFilename); err != nil {
+			log.Fatalf("Can't write output: %+v", err)
+		}
 	}
 
-	input := &esriservice.ExportImageInput{
-		ImageSR:     4326,
-		BoundingBox: details.FullExtent,
-		Size:        esriservice.RectType{Width: 512, Height: 512},
-		Format:      "png",
-		PixelType:   "u8",
+	if *name == "" {
+		*name = defaultName(*endpoint, *outputFilename)
 	}
-	resp, err := esriClient.ExportImage(ctx, input)
-	if err != nil {
-		log.Fatalf("Couldn't export image: %+v", err)
+
+	switch *outputFormat {
+	case "mbtiles":
+	case "gpkg":
+		if *overwriteMetadataOnly || *resume || *resumeExact || len(splitAtZoom) > 0 {
+			log.Fatalf("--output-format gpkg can't be used with --overwrite-metadata-only, --resume, or --split-at-zoom")
+		}
+	case "dir":
+		if *overwriteMetadataOnly || len(splitAtZoom) > 0 || *manifestFilename != "" {
+			log.Fatalf("--output-format dir can't be used with --overwrite-metadata-only, --split-at-zoom, or --manifest")
+		}
+	default:
+		log.Fatalf("Unknown --output-format %q, expected mbtiles, gpkg, or dir", *outputFormat)
+	}
+
+	for _, v := range viewers {
+		if err := checkViewer(v); err != nil {
+			log.Fatalf("Invalid --viewer: %+v", err)
+		}
+		if *outputFormat != "dir" {
+			log.Fatalf("--viewer needs --output-format dir")
+		}
 	}
 
-	log.Printf("Extent of 4326 image: %0.5f,%0.5f,%0.5f,%0.5f", resp.Extent.XMin, resp.Extent.YMin, resp.Extent.XMax, resp.Extent.YMax)
+	if *cropToClip && (len(clipFilenames) == 0 || !strings.HasPrefix(*format, "png") || len(formatZooms) > 0) {
+		log.Fatalf("--crop-to-clip needs --clip and a --format like png that has transparency")
+	}
 
-	resultPipe := make(chan *imageResult, 1000)
-	requestPipe := make(chan *imageRequest, 5000000)
-	requestWG := &sync.WaitGroup{}
-	writerWG := &sync.WaitGroup{}
+	if *verifyFlip && (*outputFormat != "mbtiles" || len(splitAtZoom) > 0 || *cacheFilename != "") {
+		log.Fatalf("--verify-flip is only supported with --output-format mbtiles, without --split-at-zoom or --cache")
+	}
 
-	go func() {
-		completeExtent := orb.Bound{
-			Min: orb.Point{resp.Extent.XMin, resp.Extent.YMin},
-			Max: orb.Point{resp.Extent.XMax, resp.Extent.YMax},
+	if *compactOnClose && (*vacuum || *outputFormat != "mbtiles") {
+		log.Fatalf("--compact-on-close only works with --output-format mbtiles, and isn't needed with --vacuum")
+	}
+
+	if *lossyRefine != "" {
+		if !strings.HasPrefix(*format, "png") || len(formatZooms) > 0 {
+			log.Fatalf("--lossy-refine needs a lossless --format like png")
+		}
+		if *overwriteMetadataOnly || *resume || *resumeExact {
+			log.Fatalf("--lossy-refine can't be used with --overwrite-metadata-only or --resume")
 		}
+	}
+
+	if *noBlankSkip && (*storeEmpty || *maxBlankStreak > 0) {
+		log.Fatalf("--no-blank-skip can't be used with --store-empty-as-marker or --max-depth-blank-streak")
+	}
 
-		coveringTiles := tilecover.Bound(completeExtent, minZoom)
-		log.Printf("Found %d tiles to fetch at z%d", len(coveringTiles), minZoom)
+	if *maxFanOut < 0 || *maxFanOut > 4 {
+		log.Fatalf("--max-fan-out must be from 1 to 4")
+	}
+	if *onZoomComplete != "" && !*breadthFirst {
+		log.Fatalf("--on-zoom-complete needs --breadth-first, since zooms are only finished one at a time then")
+	}
+	if *maxFanOut > 0 && *breadthFirst {
+		log.Fatalf("--max-fan-out can't be used with --breadth-first, which queues a zoom at a time")
+	}
+
+	if *concurrencyAuto && *adaptiveConcurrency {
+		log.Fatalf("--concurrency-auto can't be used with --adaptive-concurrency")
+	}
+
+	customMetadata, err := parseMetadataRows(metadataFlags, *force)
+	if err != nil {
+		log.Fatalf("Invalid --metadata: %+v", err)
+	}
 
-		for t := range coveringTiles {
-			requestPipe <- &imageRequest{
-				tile: t,
+	if *overwriteMetadataOnly {
+		opts := mbtilesOptions{name: *name, attribution: *attribution, compat: *mbtilesCompat, gdal: *gdalMetadata, custom: customMetadata}
+		if flagSet("format") {
+			opts.format = mbtilesFormat(*format)
+		}
+		if len(bboxes) > 0 {
+			bounds, err := parseBoundsInSR(ctx, bboxes, *bboxSR, nil, *requestTimeout)
+			if err != nil {
+				log.Fatalf("Couldn't parse bbox: %+v", err)
 			}
+			b := unionBound(bounds)
+			opts.bounds = &b
 		}
-		log.Printf("Don't inserting first zoom")
-	}()
 
-	go func() {
-		for range time.Tick(1 * time.Second) {
-			log.Printf("Requests: %4d, Results: %4d", len(requestPipe), len(resultPipe))
+		if err := rewriteMetadata(*outputFilename, opts); err != nil {
+			log.Fatalf("Couldn't rewrite metadata: %+v", err)
 		}
-	}()
+		return
+	}
 
-	for i := 0; i < concurrency; i++ {
-		requestWG.Add(1)
-		go func() {
-			defer requestWG.Done()
-			for req := range requestPipe {
-				tileBounds := req.tile.Bound()
-				imageBounds := esriservice.ExtentType{
-					XMin:             tileBounds.Min.X(),
-					YMin:             tileBounds.Min.Y(),
-					XMax:             tileBounds.Max.X(),
-					YMax:             tileBounds.Max.Y(),
-					SpatialReference: esriservice.SpatialReferenceType{Wkid: 4326},
-				}
+	if *sourceType == "xyz" {
+		if *urlTemplate == "" {
+			log.Fatalf("Must supply --url-template with --source xyz")
+		}
+	} else if endpoint == nil || *endpoint == "" {
+		log.Fatalf("Must supply --endpoint")
+	}
 
-				imageFetchContext, cancel := context.WithTimeout(ctx, 15*time.Second)
-				input := &esriservice.ExportImageInput{
-					ImageSR:     3857,
-					BoundingBox: imageBounds,
-					Size:        esriservice.RectType{Width: 256, Height: 256},
-					Format:      "png",
-					PixelType:   "u8",
-					NoData:      []int{255},
-				}
-				resp, err := esriClient.ExportImage(imageFetchContext, input)
-				if err != nil {
-					log.Fatalf("Couldn't export image: %+v", err)
-				}
+	if *timeoutScale != "" {
+		if _, err := parseZoomScale(*timeoutScale, minZoom, maxZoom); err != nil {
+			log.Fatalf("Invalid --tile-timeout-scale: %+v", err)
+		}
+	}
+	if *bboxSR <= 0 {
+		log.Fatalf("--bbox-sr must be a wkid, like 4326 or 2263")
+	}
+	if *probeSize < 1 {
+		log.Fatalf("--probe-size must be at least 1")
+	}
+	if *supersample < 1 {
+		log.Fatalf("--supersample must be at least 1")
+	}
+	if err := checkFormat(*format); err != nil {
+		log.Fatalf("Invalid --format: %+v", err)
+	}
+	if *dedupeScope != "" && *dedupeScope != "global" && *dedupeScope != "zoom" {
+		log.Fatalf("Unknown --dedupe-scope %q, expected global or zoom", *dedupeScope)
+	}
 
-				imageReq, err := http.NewRequestWithContext(imageFetchContext, "GET", resp.Href, nil)
-				if err != nil {
-					log.Fatalf("Couldn't build request to exported image: %+v", err)
-				}
+	zoomFormats, err := parseZoomFormats(formatZooms, minZoom, maxZoom)
+	if err != nil {
+		log.Fatalf("Invalid --format-zoom: %+v", err)
+	}
+	if len(zoomFormats) > 0 && *sourceType != "esri" {
+		log.Fatalf("--format-zoom is only supported with --source esri")
+	}
 
-				response, err := http.DefaultClient.Do(imageReq)
-				if err != nil {
-					log.Fatalf("Couldn't fetch referred image: %+v", err)
-				}
+	if *tileMatrixSet != "" {
+		name, ok := tileMatrixSetGrids[*tileMatrixSet]
+		if !ok {
+			log.Fatalf("Unknown --tile-matrix-set %q, expected GoogleMapsCompatible, WebMercatorQuad, or WorldCRS84Quad", *tileMatrixSet)
+		}
+		*gridName = name
+	}
 
-				imageBytes, err := ioutil.ReadAll(response.Body)
-				if err != nil {
-					log.Fatalf("Couldn't copy image bytes: %+v", err)
-				}
+	if *gdalMetadata && *gridName != "webmercator" {
+		log.Fatalf("--gdal-metadata is only supported with --grid webmercator, since GDAL can't read other grids from mbtiles")
+	}
 
-				response.Body.Close()
-				cancel()
+	if len(viewers) > 0 && *gridName != "webmercator" {
+		log.Fatalf("--viewer is only supported with --grid webmercator")
+	}
 
-				resultPipe <- &imageResult{
-					imageBytes: imageBytes,
-					tile:       req.tile,
-				}
-			}
-			log.Printf("Closing request pipe")
-		}()
+	if *reprojectOutput && (*sourceType != "esri" || *gridName != "webmercator") {
+		log.Fatalf("--reproject-output is only supported with --source esri and --grid webmercator")
 	}
 
-	writerWG.Add(1)
-	go func() {
-		defer writerWG.Done()
-		dsn := fmt.Sprintf("file:%s?_journal_mode=MEMORY&_synchronous=OFF", *outputFilename)
-		db, err := sql.Open("sqlite3", dsn)
+	var grid tilesource.Grid
+	switch *gridName {
+	case "webmercator":
+		grid = tilesource.WebMercator{}
+	case "geographic":
+		if *sourceType != "esri" {
+			log.Fatalf("--grid geographic is only supported with --source esri")
+		}
+		grid = tilesource.Geographic{}
+	default:
+		log.Fatalf("Unknown --grid %q, expected webmercator or geographic", *gridName)
+	}
+
+	if *maxConns == 0 {
+		*maxConns = 4 * *concurrency
+	}
+	transport := esriservice.NewTransport(esriservice.TransportConfig{
+		MaxConnsPerHost:     *maxConnsPerHost,
+		MaxConns:            *maxConns,
+		MaxIdleConnsPerHost: *concurrency,
+		IdleConnTimeout:     *idleConnTimeout,
+		HTTP1:               *http1,
+	})
+	var roundTripper http.RoundTripper = transport
+	if *httpCacheDir != "" {
+		cache, err := newHTTPCache(*httpCacheDir, *httpCacheMode, *httpCacheMaxBytes, transport)
 		if err != nil {
-			log.Fatalf("Couldn't open database: %+v", err)
-		}
-
-		if _, err := db.Exec(`
-		BEGIN TRANSACTION;
-		CREATE TABLE IF NOT EXISTS tiles (
-			zoom_level INT NOT NULL,
-			tile_column INT NOT NULL,
-			tile_row INT NOT NULL,
-			tile_data BLOB NOT NULL
-		);
-		CREATE UNIQUE INDEX IF NOT EXISTS tiles_index ON tiles (zoom_level, tile_column, tile_row);
-        CREATE TABLE IF NOT EXISTS metadata (
-            name TEXT,
-            value TEXT
-        );
-        INSERT INTO metadata (name, value) VALUES
-		  ('name', ?),
-		  ('format', 'png'),
-		  ('minzoom', ?),
-		  ('maxzoom', ?),
-		  ('scheme', 'tms');
-		COMMIT;
-	`, "kamloops", minZoom, maxZoom); err != nil {
-			log.Fatalf("Couldn't create table: %+v", err)
-		}
-
-		tx, err := db.Begin()
+			log.Fatalf("Couldn't open --http-cache: %+v", err)
+		}
+		roundTripper = cache
+	}
+	httpClient := &http.Client{Transport: roundTripper}
+	contentTypes := allowedContentTypes(*sourceType, *format, zoomFormats, *urlTemplate, allowContentTypes)
+
+	var source tilesource.Source
+	var esriSource *tilesource.ESRI
+	var completeExtent orb.Bound
+	var bands *rasterBands
+	var serviceDetails *esriservice.ServiceDetails
+	var serviceBound orb.Bound
+	var esriClient *esriservice.EsriService
+	switch *sourceType {
+	case "esri", "esri-cache":
+		esriClient, err = newEsriClient(ctx, *endpoint, header, roundTripper, *post, *prettyResponses, *token, *username, *password,
+			esriservice.WithImageContentTypes(contentTypes...))
 		if err != nil {
-			log.Fatalf("Couldn't create transaction: %+v", err)
+			log.Fatalf("Couldn't sign in: %+v", err)
 		}
 
-		tileInsertStmt, err := tx.Prepare("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?);")
+		detailsCtx, cancel := context.WithTimeout(ctx, *requestTimeout)
+		credentials := flagOrEnv(*token, "ESRI_TOKEN") + "\n" + flagOrEnv(*username, "ESRI_USERNAME")
+		details, err := getDetails(detailsCtx, esriClient, newDetailsCache(*detailsCacheTTL), *endpoint, credentials, *refreshDetails)
+		cancel()
+		if esriservice.IsTokenRequired(err) {
+			log.Fatalf("Couldn't get details for endpoint, which needs a --token or --username: %+v", err)
+		} else if err != nil {
+			log.Fatalf("Couldn't get details for endpoint: %+v", err)
+		}
+
+		serviceDetails = details
+		if *attribution == "" {
+			*attribution = details.CopyrightText
+		}
+		bands = newRasterBands(details, *outputPixelType)
+
+		completeExtent, err = serviceExtent(ctx, esriClient, details, *probeSize, *requestTimeout)
 		if err != nil {
-			log.Fatalf("Couldn't create insert prepared statement: %+v", err)
+			log.Fatalf("Couldn't determine service extent: %+v", err)
 		}
+		serviceBound = completeExtent
 
-		count := 0
-		for r := range resultPipe {
-			// TODO Is there a better way to find blank tiles?
-			if len(r.imageBytes) == 777 || len(r.imageBytes) == 776 {
-				// Don't write or recurse into the next level because this tile was completely blank
-				continue
+		if *thumbnail != "" {
+			if err := writeThumbnail(ctx, esriClient, details, completeExtent, *thumbnail, *requestTimeout); err != nil {
+				log.Fatalf("Couldn't save thumbnail: %+v", err)
 			}
+			log.Printf("Saved thumbnail to %s", *thumbnail)
+		}
 
-			// "Invert the Y" to get to a TMS tile coordinate for mbtiles
-			flippedY := (1 << r.tile.Z) - 1 - r.tile.Y
+		if *sourceType == "esri-cache" {
+			cache := newCacheSource(esriClient, details.TileInfo, *tileOrigin)
+			cache.UseTileMap = *useTileMap
+			source = cache
+			break
+		}
 
-			_, err = tileInsertStmt.Exec(r.tile.Z, r.tile.X, flippedY, r.imageBytes)
-			if err != nil {
-				log.Fatalf("Couldn't exec insert statement: %+v", err)
+		esriSource = &tilesource.ESRI{
+			Client:      esriClient,
+			Grid:        grid,
+			TileSize:    256 * *supersample,
+			Format:      *format,
+			ZoomFormats: zoomFormats,
+			LercVersion: *lercVersion,
+			EdgeBuffer:  *edgeBuffer,
+			// Each request gets its own budget, within the crawler's
+			// timeout for the whole tile.
+			ExportTimeout:  *jsonTimeout,
+			ImageTimeout:   *imageTimeout,
+			PixelType:      *pixelType,
+			NoData:         noData,
+			NoDataFallback: *noDataFallback,
+			// The expected scales are for web mercator tiles.
+			CheckScale:   *gridName == "webmercator" && !*reprojectOutput,
+			RecordScales: *recordScales,
+			// Rendering and downloading can be served by different
+			// backends, so they're limited separately.
+			ExportConcurrency: *exportConcurrency,
+			ImageConcurrency:  *imageConcurrency,
+			OutputPixelType:   *outputPixelType,
+		}
+		if *reprojectOutput {
+			esriSource.ImageWkid = 4326
+		}
+		if *sliceID >= 0 {
+			esriSource.SliceID = sliceID
+		}
+		if *nativeBounds {
+			sr := details.SpatialReference
+			if !sr.IsWebMercator() && !sr.IsWGS84() {
+				log.Fatalf("--force-tile-bounds-in-native-sr only supports services in web mercator or WGS84, not wkid %d", sr.Wkid)
 			}
+			esriSource.BoundsSR = sr
+		}
+		source = esriSource
+	case "wms":
+		source = &tilesource.WMS{
+			BaseURL:      *endpoint,
+			Layers:       *layer,
+			Styles:       *style,
+			Format:       "image/png",
+			TileSize:     256,
+			Header:       header,
+			Client:       httpClient,
+			ContentTypes: contentTypes,
+		}
+	case "wmts":
+		source = &tilesource.WMTS{
+			BaseURL:      *endpoint,
+			Layer:        *layer,
+			Style:        *style,
+			Format:       "image/png",
+			MatrixSet:    *wmtsMatrixSet,
+			MatrixPrefix: *wmtsMatrixPrefix,
+			Header:       header,
+			Client:       httpClient,
+			ContentTypes: contentTypes,
+		}
+	case "xyz":
+		var subdomainList []string
+		if *subdomains != "" {
+			subdomainList = strings.Split(*subdomains, ",")
+		}
+		source = &tilesource.XYZ{
+			URLTemplate:  *urlTemplate,
+			Subdomains:   subdomainList,
+			Header:       header,
+			Client:       httpClient,
+			ContentTypes: contentTypes,
+		}
+	default:
+		log.Fatalf("Unknown --source %q, expected esri, esri-cache, wms, wmts, or xyz", *sourceType)
+	}
 
-			// log.Printf("Wrote %d bytes to tile %d/%d/%d", len(r.imageBytes), r.tile.Z, r.tile.X, flippedY)
+	if *requireAttribution && strings.TrimSpace(*attribution) == "" {
+		log.Fatalf("--require-attribution is set, but the service has no copyright text to use; supply --attribution to credit the imagery")
+	}
 
-			count++
-			if count%1000 == 0 {
-				log.Printf("Committed")
-				err := tx.Commit()
-				if err != nil {
-					log.Fatalf("Couldn't commit transaction: %+v", err)
-				}
+	if *printCurl != "" {
+		if esriSource == nil {
+			log.Fatalf("--print-curl is only supported with --source esri")
+		}
+		t, err := parseTile(*printCurl)
+		if err != nil {
+			log.Fatalf("Invalid --print-curl: %+v", err)
+		}
+		input, err := esriSource.ExportInput(t)
+		if err != nil {
+			log.Fatalf("Couldn't build request: %+v", err)
+		}
+		req, err := esriSource.Client.ExportImageRequest(input)
+		if err != nil {
+			log.Fatalf("Couldn't build request: %+v", err)
+		}
+		fmt.Println(curlCommand(req, *showSecrets))
+		return
+	}
 
-				tx, err = db.Begin()
-				if err != nil {
-					log.Fatalf("Couldn't create transaction: %+v", err)
-				}
+	source = wrapSource(source)
 
-				tileInsertStmt, err = tx.Prepare("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?);")
-				if err != nil {
-					log.Fatalf("Couldn't create insert prepared statement: %+v", err)
-				}
+	var cache *mbtilesCache
+	if *cacheFilename != "" {
+		if *edgeBuffer > 0 || *supersample > 1 || *reprojectOutput {
+			log.Fatalf("--cache can't be used with --edge-buffer, --supersample, or --reproject-output, which would process its tiles again")
+		}
+		if *cacheFilename == *outputFilename {
+			log.Fatalf("--cache can't be the output; use --resume to continue a crawl")
+		}
+		cache, err = openMBTilesCache(*cacheFilename, mbtilesFormat(*format), source)
+		if err != nil {
+			log.Fatalf("Couldn't open --cache: %+v", err)
+		}
+		source = cache
+	}
+
+	if *samplePixel != "" {
+		t, err := parseTile(*samplePixel)
+		if err != nil {
+			log.Fatalf("Invalid --sample-pixel: %+v", err)
+		}
+		data, err := fetchTileWithTimeout(ctx, source, t, *jsonTimeout+*imageTimeout)
+		if err != nil {
+			log.Fatalf("Couldn't fetch tile: %+v", err)
+		}
+		if err := printPixelStats(os.Stdout, data); err != nil {
+			log.Fatalf("Couldn't read tile: %+v", err)
+		}
+		return
+	}
+
+	if *sourceType != "esri" && *sourceType != "esri-cache" && len(bboxes) == 0 && len(clipFilenames) == 0 {
+		log.Fatalf("Must supply --bbox or --clip with --source %s", *sourceType)
+	}
+
+	// Several clips are crawled as their union, and so are several bboxes.
+	var clip orb.Geometry
+	if len(clipFilenames) > 0 {
+		var clips orb.Collection
+		for _, filename := range clipFilenames {
+			g, err := loadGeometry(filename)
+			if err != nil {
+				log.Fatalf("Couldn't load clip %s: %+v", filename, err)
+			}
+			clips = append(clips, g)
+		}
+		clip = clips
+		if len(clips) == 1 {
+			clip = clips[0]
+		}
+		completeExtent = clip.Bound()
+	}
+
+	var bounds []orb.Bound
+	if len(bboxes) > 0 {
+		bounds, err = parseBoundsInSR(ctx, bboxes, *bboxSR, esriClient, *requestTimeout)
+		if err != nil {
+			log.Fatalf("Couldn't parse bbox: %+v", err)
+		}
+		completeExtent = unionBound(bounds)
+	}
+
+	if *check {
+		if esriClient == nil {
+			log.Fatalf("--check is only supported with --source esri or esri-cache")
+		}
+		credentialed := flagOrEnv(*token, "ESRI_TOKEN") != "" || flagOrEnv(*username, "ESRI_USERNAME") != ""
+		tokenRequired := tokenRequirement(ctx, *endpoint, header, roundTripper, credentialed, *requestTimeout)
+		center := completeExtent.Center()
+		if len(bounds) > 1 {
+			center = bounds[0].Center()
+		}
+		var t maptile.Tile
+		for t = range grid.Cover(orb.Bound{Min: center, Max: center}, maptile.Zoom(*seedZoom)) {
+			break
+		}
+		if err := printCheck(ctx, os.Stdout, esriClient, serviceDetails, serviceBound, tokenRequired, source, t, *jsonTimeout+*imageTimeout); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	crawlMaxZoom := maxZoom
+	if *resolution > 0 {
+		if *gridName != "webmercator" {
+			log.Fatalf("--resolution is only supported with the webmercator grid")
+		}
+		lat := completeExtent.Center().Lat()
+		z := resolutionZoom(*resolution, lat)
+		if native := nativeResolution(serviceDetails, lat); native > 0 {
+			if nz := nativeZoom(native, lat); nz < z {
+				log.Printf("The service's imagery is about %0.2f m/pixel, so crawling to z%d rather than overzooming to z%d", native, nz, z)
+				z = nz
 			}
+		}
+		if z < int(minZoom) || z > int(maxZoom) {
+			log.Fatalf("--resolution %g is nearest z%d at latitude %0.2f, outside of zooms %d-%d", *resolution, z, lat, minZoom, maxZoom)
+		}
+		crawlMaxZoom = maptile.Zoom(z)
+		log.Printf("Crawling to z%d, which is %0.2f m/pixel at latitude %0.2f", crawlMaxZoom, tilesource.ResolutionAt(crawlMaxZoom, lat), lat)
+	}
 
-			if r.tile.Z+1 > maxZoom {
-				// Don't recurse past maxZoom
+	if *validateExtent {
+		populated, sampled, err := sampleExtent(ctx, source, grid, completeExtent, minZoom)
+		if err != nil {
+			log.Fatalf("Couldn't validate extent: %+v", err)
+		}
+
+		log.Printf("Extent preflight: %d of %d sample tiles at z%d had imagery", populated, sampled, minZoom)
+		if populated == 0 {
+			log.Fatalf("Every sample tile was blank, so the extent or spatial reference is probably wrong. Use --validate-extent=false to crawl anyway.")
+		}
+	}
+
+	c := newCrawler(source, *outputFilename)
+	c.concurrency = *concurrency
+	if *decodeConcurrency < 1 {
+		log.Fatalf("--decode-concurrency must be at least 1")
+	}
+	c.decodeConcurrency = *decodeConcurrency
+	c.rampDuration = *rampDuration
+	c.jitter = *jitter
+
+	for _, z := range splitAtZoom {
+		c.splitZooms = append(c.splitZooms, maptile.Zoom(z))
+	}
+
+	if (*resume || *resumeExact) && *outputFormat == "dir" {
+		// Each tile is looked up in the tree, so it's always exact.
+		store, err := newBlobStore(*outputFilename)
+		if err != nil {
+			log.Fatalf("Couldn't open output to resume: %+v", err)
+		}
+		c.existing = &tileTree{store: store, format: mbtilesFormat(*format)}
+	} else if *resume || *resumeExact {
+		var existing multiIndex
+		for _, filename := range c.outputFilenames() {
+			if _, err := os.Stat(filename); err != nil {
 				continue
 			}
+			if cp, err := readCheckpoint(filename); err != nil {
+				log.Fatalf("Couldn't read checkpoint to resume: %+v", err)
+			} else if cp != nil {
+				log.Printf("Resuming %s, whose last saved tile was %s", filename, cp)
+			}
 
-			for _, childTile := range r.tile.Children() {
-				requestPipe <- &imageRequest{
-					tile: childTile,
-				}
+			var index tileIndex
+			if *resumeExact {
+				index, err = openSQLiteIndex(filename)
+			} else {
+				index, err = loadBloomIndex(filename)
 			}
+			if err != nil {
+				log.Fatalf("Couldn't read existing tiles to resume: %+v", err)
+			}
+			existing = append(existing, index)
+		}
+		c.existing = existing
+	}
+	if *adaptiveConcurrency {
+		c.limiter = newAdaptiveLimiter(4, *concurrency)
+	}
+	switch {
+	case *retriesPerTile >= 0:
+		c.retriesPerTile = *retriesPerTile
+	case *adaptiveConcurrency:
+		c.retriesPerTile = maxAdaptiveRetries
+	}
+	if *throttleOnError {
+		c.throttle = newErrorThrottle()
+	}
+	c.minZoom = minZoom
+	c.maxZoom = crawlMaxZoom
+	c.grid = grid
+	c.maxBlankStreak = *maxBlankStreak
+	c.strict = *strict
+	c.skipErrors = *skipErrors
+	c.minCoverage = *minCoverage
+	c.geoPackage = *outputFormat == "gpkg"
+	c.tileTree = *outputFormat == "dir"
+	c.maxOutputBytes = *maxOutputBytes
+	c.lossyOutput = *lossyRefine
+	c.lossyQuality = *lossyQuality
+	c.tileTimeout = *imageTimeout
+	if *sourceType == "esri" {
+		c.tileTimeout += *jsonTimeout
+	}
+	if *timeoutScale != "" {
+		c.timeoutScale, err = parseZoomScale(*timeoutScale, minZoom, crawlMaxZoom)
+		if err != nil {
+			log.Fatalf("Invalid --tile-timeout-scale: %+v", err)
+		}
+		if esriSource != nil {
+			esriSource.TimeoutScale = c.timeoutScale.at
+		}
+	}
+	if *seedZoom < 0 || *seedZoom > int(crawlMaxZoom) {
+		log.Fatalf("--seed-zoom must be between 0 and the max zoom, %d", crawlMaxZoom)
+	}
+	c.seedZoom = maptile.Zoom(*seedZoom)
+	if *resumeFromZoom >= 0 {
+		if *resumeFromZoom < int(minZoom) || *resumeFromZoom > int(crawlMaxZoom) {
+			log.Fatalf("--resume-from-zoom must be between the min zoom, %d, and the max zoom, %d", minZoom, crawlMaxZoom)
+		}
+		if *outputFormat != "mbtiles" || len(splitAtZoom) > 0 {
+			log.Fatalf("--resume-from-zoom is only supported with --output-format mbtiles, without --split-at-zoom")
+		}
+	}
+	if *serveAddr != "" && (*outputFormat != "mbtiles" || len(splitAtZoom) > 0) {
+		log.Fatalf("--serve is only supported with --output-format mbtiles, without --split-at-zoom")
+	}
+	c.mbtiles = mbtilesOptions{
+		name:        *name,
+		format:      mbtilesFormat(*format),
+		generator:   "imageservice-to-mbtiles " + versionString(),
+		attribution: *attribution,
+		grid:        grid,
+		pageSize:    *pageSize,
+		cacheSize:   *cacheSize,
+		busyTimeout: *busyTimeout,
+		vacuum:      *vacuum,
+		compact:     *compactOnClose,
+		bounds:      &completeExtent,
+		custom:      customMetadata,
+		batchSize:   *batchSize,
+		// A slow crawl may take a long time to fill a batch.
+		commitInterval: *commitInterval,
+		// Tiles of different formats are told apart by the images table.
+		dedup:      len(zoomFormats) > 0 || *dedupeScope != "",
+		dedupScope: *dedupeScope,
+		compat:     *mbtilesCompat,
+		gdal:       *gdalMetadata,
+
+		emptyMarker: *storeEmpty,
+		layerName:   *outputLayerName,
+		bands:       bands,
+
+		viewers: viewers,
+	}
+	if *coverageFilename != "" {
+		c.coverage = &coverageReport{maxZoom: maptile.Zoom(*coverageMaxZoom), grid: grid}
+	}
+	if *sourceType == "esri" {
+		c.edgeBuffer = *edgeBuffer
+		c.supersample = *supersample
+		c.reproject = *reprojectOutput
+	}
+	if *blankTile != "" {
+		c.blankSample, err = loadBlankSample(*blankTile, *blankTolerance)
+		if err != nil {
+			log.Fatalf("Couldn't load blank tile sample: %+v", err)
+		}
+	}
+	c.fillColors = fillColors
+	c.verbose = verbose
+	c.retryOnBlank = *retryOnBlank
+	if *errorSignature != "" {
+		c.errorSample, err = loadBlankSample(*errorSignature, *errorTolerance)
+		if err != nil {
+			log.Fatalf("Couldn't load error signature: %+v", err)
 		}
+	}
+	c.breadthFirst = *breadthFirst
+	if *onZoomComplete != "" {
+		c.onZoomComplete = func(zoom maptile.Zoom, stats zoomStats) {
+			runZoomHook(*onZoomComplete, *outputFilename, zoom, stats)
+		}
+	}
+	c.maxFanOut = *maxFanOut
+	if *shardFlag != "" {
+		c.shard, err = parseShard(*shardFlag)
+		if err != nil {
+			log.Fatalf("Invalid --shard: %+v", err)
+		}
+	}
+	c.bboxes = bounds
+	c.clip = clip
+	if *cropToClip {
+		c.clipMask = newClipMask(clip, *gridName == "webmercator")
+	}
+	for _, value := range excludeBBoxes {
+		b, err := parseBound(value)
+		if err != nil {
+			log.Fatalf("Couldn't parse --exclude-bbox: %+v", err)
+		}
+		c.exclude = append(c.exclude, b)
+	}
+	c.optimizePNG = *optimizePNGs
+	c.optimizePalette = *optimizePalette
+	c.canonicalPNG = *canonicalizePNG
+	c.maxIdleTime = *maxIdleTime
+	c.storeEmpty = *storeEmpty
+	c.noBlankSkip = *noBlankSkip
+	c.recordLatency = *latencyStats || *metricsAddr != ""
+
+	if *recordScales && esriSource != nil {
+		c.finalMetadata = func() []metadataRow {
+			var rows []metadataRow
+			for z, scale := range esriSource.Scales() {
+				rows = append(rows, metadataRow{
+					name:  fmt.Sprintf("esri_scale_z%d", z),
+					value: strconv.FormatFloat(scale, 'f', -1, 64),
+				})
+			}
+			return rows
+		}
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", c.metrics.handler(
+			func() int { return len(c.requestPipe) },
+			func() int { return len(c.resultPipe) + len(c.processedPipe) },
+			func() float64 {
+				if c.throttle == nil {
+					return 0
+				}
+				return c.throttle.current()
+			},
+		))
+		go func() {
+			log.Printf("Serving metrics on %s/metrics", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Fatalf("Couldn't serve metrics: %+v", err)
+			}
+		}()
+	}
 
-		err = tileInsertStmt.Close()
+	if *serveAddr != "" {
+		server, err := newTileServer(*outputFilename, *busyTimeout)
 		if err != nil {
-			log.Fatalf("Couldn't close insert statement: %+v", err)
+			log.Fatalf("Couldn't open output to serve: %+v", err)
 		}
+		go func() {
+			log.Printf("Serving tiles on %s/{z}/{x}/{y}", *serveAddr)
+			if err := http.ListenAndServe(*serveAddr, server); err != nil {
+				log.Fatalf("Couldn't serve tiles: %+v", err)
+			}
+		}()
+	}
 
-		err = tx.Commit()
+	c.extent = &completeExtent
+	if *planOut != "" {
+		n, err := c.writePlan(*planOut, completeExtent)
 		if err != nil {
-			log.Fatalf("Couldn't commit transaction: %+v", err)
+			log.Fatalf("Couldn't write plan: %+v", err)
 		}
+		log.Printf("Wrote a plan of %d tiles to %s", n, *planOut)
+		return
+	}
 
-		err = db.Close()
+	var coveringTiles maptile.Set
+	if *planFile != "" {
+		coveringTiles, err = readPlan(*planFile, minZoom, crawlMaxZoom)
 		if err != nil {
-			log.Fatalf("Couldn't close database: %+v", err)
+			log.Fatalf("Couldn't read plan: %+v", err)
+		}
+		c.planned = true
+		log.Printf("Found %d tiles to fetch in %s", len(coveringTiles), *planFile)
+	} else if *resumeFromZoom >= 0 {
+		zoom := maptile.Zoom(*resumeFromZoom)
+		if !*resume && !*resumeExact {
+			opts := c.mbtiles
+			opts.minZoom, opts.maxZoom = minZoom, crawlMaxZoom
+			if err := deleteFromZoom(*outputFilename, opts, zoom); err != nil {
+				log.Fatalf("Couldn't delete tiles to crawl again: %+v", err)
+			}
+		}
+		coveringTiles, err = c.frontierSeeds(zoom, completeExtent)
+		if err != nil {
+			log.Fatalf("Couldn't read tiles to restart from: %+v", err)
+		}
+		log.Printf("Found %d tiles to fetch at z%d", len(coveringTiles), c.seedZoom)
+	} else {
+		coveringTiles = c.seedTiles(completeExtent)
+		log.Printf("Found %d tiles to fetch at z%d", len(coveringTiles), c.seedZoom)
+	}
+	if c.shard != nil {
+		coveringTiles = c.shard.filter(coveringTiles)
+		log.Printf("Fetching the %d of them in shard %s", len(coveringTiles), *shardFlag)
+	}
+
+	if *noBlankSkip {
+		// Each seed has 4^n descendants n zooms below it.
+		total, perZoom := 0, len(coveringTiles)
+		for z := c.seedZoom; z <= crawlMaxZoom; z++ {
+			total += perZoom
+			perZoom *= 4
+		}
+		log.Printf("Warning: --no-blank-skip stores every tile down to z%d, up to %d tiles, however much of the extent is empty", crawlMaxZoom, total)
+	}
+
+	// Planning outside the crawler needs several bboxes as a geometry, since
+	// the extent around them would include the space between them.
+	coverage := clip
+	if clip == nil && len(bounds) > 1 {
+		var areas orb.Collection
+		for _, b := range bounds {
+			areas = append(areas, b.ToPolygon())
+		}
+		coverage = areas
+	}
+
+	if *warmupZoom >= 0 {
+		log.Printf("Warming up the service's cache at z%d", *warmupZoom)
+		start := time.Now()
+		fetched, failed, mean := warmUp(ctx, source, grid, completeExtent, coverage, maptile.Zoom(*warmupZoom), *warmupConcurrency, c.timeoutAt(maptile.Zoom(*warmupZoom)))
+		log.Printf("Warmed up %d tiles (%d failed) in %s, mean %s per tile; compare with the crawl's --latency-stats to see whether it helps",
+			fetched, failed, time.Since(start).Round(time.Millisecond), mean.Round(time.Millisecond))
+	}
+
+	if *concurrencyAuto {
+		log.Printf("Probing the service to pick a concurrency")
+		probeCtx, cancel := context.WithCancel(ctx)
+		probeTiles := tilesource.PlanTiles(probeCtx, grid, completeExtent, minZoom, crawlMaxZoom, coverage)
+		c.concurrency = calibrateConcurrency(ctx, source, probeTiles, *concurrency, c.tileTimeout)
+		cancel()
+		log.Printf("Picked a concurrency of %d", c.concurrency)
+	}
+
+	stopProfiling, err := startProfiling(*cpuProfile, *memProfile, *traceFile)
+	if err != nil {
+		log.Fatalf("Couldn't start profiling: %+v", err)
+	}
+
+	c.run(ctx, coveringTiles)
+
+	if err := stopProfiling(); err != nil {
+		log.Fatalf("Couldn't write profile: %+v", err)
+	}
+
+	if *tileJSONFilename != "" {
+		opts := c.mbtiles
+		opts.minZoom, opts.maxZoom = c.minZoom, c.maxZoom
+		tilesURL := *tileJSONURL
+		if tilesURL == "" {
+			tilesURL = "{z}/{x}/{y}." + opts.format
+		}
+		if err := writeTileJSON(*tileJSONFilename, tilesURL, opts); err != nil {
+			log.Fatalf("Couldn't write TileJSON: %+v", err)
+		}
+		log.Printf("Wrote TileJSON to %s", *tileJSONFilename)
+	}
+
+	if c.coverage != nil {
+		if err := c.coverage.write(*coverageFilename); err != nil {
+			log.Fatalf("Couldn't write coverage report: %+v", err)
+		}
+		log.Printf("Wrote coverage report to %s", *coverageFilename)
+	}
+
+	if *latencyStats {
+		log.Printf("Fetch latency: %s", c.metrics.latency.summary())
+	}
+
+	if c.outputFull != 0 {
+		if c.completeZoom != nil {
+			log.Printf("Stopped at --max-output-bytes with tiles up to z%d, complete through z%d", c.deepestZoom, *c.completeZoom)
+		} else {
+			log.Printf("Stopped at --max-output-bytes with tiles up to z%d", c.deepestZoom)
 		}
-	}()
+	}
+
+	if c.retryOnBlank > 0 {
+		log.Printf("%d blank tiles had imagery when fetched again", c.blankRecovered)
+	}
 
-	requestWG.Wait()
-	close(resultPipe)
-	writerWG.Wait()
+	if cache != nil {
+		log.Printf("Answered %d tile fetches from --cache and passed %d it didn't have on to the service", cache.hits, cache.misses)
+	}
+
+	if esriClient != nil {
+		for _, stats := range esriClient.TokenStats() {
+			log.Printf("Sent %s", stats)
+		}
+	}
+
+	if len(c.failed) > 0 {
+		log.Printf("Skipped %d tiles that couldn't be fetched", len(c.failed))
+	}
+	if *failedTilesOut != "" {
+		if err := writeFailedTiles(*failedTilesOut, c.failed); err != nil {
+			log.Fatalf("Couldn't write failed tiles: %+v", err)
+		}
+		log.Printf("Wrote failed tiles to %s", *failedTilesOut)
+	}
+
+	if len(c.strictFailures) > 0 {
+		log.Fatalf("%d tiles were blank inside the expected coverage", len(c.strictFailures))
+	}
+
+	if *verifyFlip {
+		if err := c.verifyFlip(ctx); err != nil {
+			log.Fatalf("Couldn't verify the output's rows: %+v", err)
+		}
+	}
+
+	if pruned := c.metrics.branchesPruned; pruned > 0 {
+		log.Printf("Pruned %d sparse branches", pruned)
+	}
+
+	if *manifestFilename != "" {
+		var files []string
+		if len(c.splitZooms) > 0 {
+			for _, r := range splitZoomRanges(c.minZoom, c.maxZoom, c.splitZooms) {
+				files = append(files, splitFilename(c.output, r))
+			}
+		} else {
+			files = append(files, c.output)
+		}
+		if *lossyRefine != "" {
+			files = append(files, *lossyRefine)
+		}
+		if err := writeChecksumManifest(*manifestFilename, files); err != nil {
+			log.Fatalf("Couldn't write manifest: %+v", err)
+		}
+		log.Printf("Wrote manifest to %s", *manifestFilename)
+	}
 
 	log.Printf("Done")
+
+	if *serveAddr != "" {
+		log.Printf("Still serving tiles on %s; interrupt to stop", *serveAddr)
+		select {}
+	}
+}
+
+// serviceExtent returns the extent of an ESRI service in EPSG:4326, by
+// exporting an image of its full extent and reading back the extent of the
+// reprojected image. The image is size pixels square, within the service's
+// maximum size, and if it can't be exported, the extent is read from the
+// description instead, which only works for geographic and web mercator
+// extents.
+func serviceExtent(ctx context.Context, esriClient *esriservice.EsriService, details *esriservice.ServiceDetails, size int, timeout time.Duration) (orb.Bound, error) {
+	requested := size
+	if details.MaxImageWidth > 0 && details.MaxImageWidth < size {
+		size = details.MaxImageWidth
+	}
+	if details.MaxImageHeight > 0 && details.MaxImageHeight < size {
+		size = details.MaxImageHeight
+	}
+	if size != requested {
+		log.Printf("Probing the extent with a %dx%d image, the service's max image size", size, size)
+	}
+
+	input := &esriservice.ExportImageInput{
+		ImageSR:     esriservice.SpatialReferenceType{Wkid: 4326},
+		BoundingBox: details.FullExtent,
+		Size:        esriservice.RectType{Width: size, Height: size},
+		Format:      "png",
+		PixelType:   "u8",
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	resp, err := esriClient.ExportImage(probeCtx, input)
+	cancel()
+	if err != nil {
+		extent, detailsErr := extentBound(details.FullExtent)
+		if detailsErr != nil {
+			return orb.Bound{}, fmt.Errorf("couldn't export image: %w", err)
+		}
+		log.Printf("Couldn't export an image of the full extent, using the service's description instead: %+v", err)
+		return extent, nil
+	}
+
+	// The extent is in the image's spatial reference, which some servers
+	// leave out of the response.
+	extent := resp.Extent
+	if extent.SpatialReference.IsZero() {
+		extent.SpatialReference = input.ImageSR
+	}
+	b, err := extentBound(extent)
+	if err != nil {
+		return orb.Bound{}, fmt.Errorf("couldn't read exported image's extent: %w", err)
+	}
+
+	log.Printf("Extent of image: %0.5f,%0.5f,%0.5f,%0.5f", b.Min.X(), b.Min.Y(), b.Max.X(), b.Max.Y())
+	return b, nil
+}
+
+// extentBound converts a geographic or web mercator extent to EPSG:4326.
+func extentBound(e esriservice.ExtentType) (orb.Bound, error) {
+	b := orb.Bound{
+		Min: orb.Point{e.XMin, e.YMin},
+		Max: orb.Point{e.XMax, e.YMax},
+	}
+
+	switch {
+	case e.SpatialReference.IsWebMercator():
+		return project.Bound(b, project.Mercator.ToWGS84), nil
+	case e.SpatialReference.Wkid == 4326 || e.SpatialReference.LatestWkid == 4326:
+		return b, nil
+	}
+	return orb.Bound{}, fmt.Errorf("can't convert an extent in wkid %d", e.SpatialReference.Wkid)
+}
+
+// newCacheSource creates a source for a service's tile cache, using origin
+// as the grid's origin if it's set.
+func newCacheSource(client *esriservice.EsriService, tileInfo *esriservice.TileInfo, origin string) *tilesource.ESRICache {
+	var o orb.Point
+	if origin != "" {
+		parts := strings.Split(origin, ",")
+		if len(parts) != 2 {
+			log.Fatalf("--tile-origin must be x,y")
+		}
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				log.Fatalf("Invalid --tile-origin: %+v", err)
+			}
+			o[i] = v
+		}
+	} else if tileInfo != nil {
+		o = orb.Point{tileInfo.Origin.X, tileInfo.Origin.Y}
+		if planar.Distance(o, tilesource.StandardOrigin) > 1 {
+			log.Printf("Service's tile origin %0.3f,%0.3f isn't the standard web mercator origin, pass --tile-origin to override it", o.X(), o.Y())
+		}
+	}
+
+	cache, err := tilesource.NewESRICache(client, tileInfo, o)
+	if err != nil {
+		log.Fatalf("Can't read the tile cache: %+v", err)
+	}
+	if !cache.OriginAligned() {
+		log.Printf("Tile origin %0.3f,%0.3f isn't aligned with web mercator tiles, so tiles will be shifted", o.X(), o.Y())
+	}
+	return cache
+}
+
+// tileMatrixSetGrids maps OGC tile matrix set identifiers to the --grid
+// with the same tile geometry.
+var tileMatrixSetGrids = map[string]string{
+	"GoogleMapsCompatible": "webmercator",
+	"WebMercatorQuad":      "webmercator",
+	"WorldCRS84Quad":       "geographic",
+}
+
+// newEsriClient creates a client for endpoint that sends header with every
+// request through transport, or the default transport if it's nil, POSTing
+// exportImage requests if post is set, and applies any other opts.
+// Credentials that are empty are read from the ESRI_TOKEN, ESRI_USERNAME and
+// ESRI_PASSWORD environment variables instead, which keeps
+// them out of process listings, and a token is generated from a username and
+// password if there isn't one.
+func newEsriClient(ctx context.Context, endpoint string, header http.Header, transport http.RoundTripper, post, pretty bool, token, username, password string, opts ...esriservice.Option) (*esriservice.EsriService, error) {
+	token = flagOrEnv(token, "ESRI_TOKEN")
+	username = flagOrEnv(username, "ESRI_USERNAME")
+	password = flagOrEnv(password, "ESRI_PASSWORD")
+
+	clientOptions := []esriservice.Option{}
+	if transport != nil {
+		clientOptions = append(clientOptions, esriservice.WithTransport(transport))
+	}
+	if post {
+		clientOptions = append(clientOptions, esriservice.WithPOST())
+	}
+	if pretty {
+		clientOptions = append(clientOptions, esriservice.WithPrettyResponses())
+	}
+	if tokens := strings.Split(token, ","); len(tokens) > 1 {
+		clientOptions = append(clientOptions, esriservice.WithTokens(tokens...))
+	} else if token != "" {
+		clientOptions = append(clientOptions, esriservice.WithToken(token))
+	}
+	for name, values := range header {
+		if name == "User-Agent" {
+			clientOptions = append(clientOptions, esriservice.WithUserAgent(header.Get(name)))
+			continue
+		}
+		for _, value := range values {
+			clientOptions = append(clientOptions, esriservice.WithHeader(name, value))
+		}
+	}
+
+	client := esriservice.NewClient(endpoint, append(clientOptions, opts...)...)
+
+	if token == "" && username != "" {
+		if err := client.GenerateToken(ctx, username, password); err != nil {
+			return nil, fmt.Errorf("couldn't sign in as %s: %w", username, err)
+		}
+	}
+
+	return client, nil
+}
+
+// flagOrEnv returns value, or the environment variable env if value is
+// empty.
+func flagOrEnv(value, env string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
+
+// isBlankTile reports whether data is the fully transparent tile the service
+// returns where it has no imagery, or is empty because a tile cache didn't
+// have the tile.
+func isBlankTile(data []byte) bool {
+	// TODO Is there a better way to find blank tiles?
+	return len(data) == 0 || len(data) == 777 || len(data) == 776
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// The manifest records how many tiles a file has and a hash of all of them,
+// updated in the same transaction as the tiles. Since each commit leaves the
+// manifest matching the tiles, verify can tell whether a file from an
+// interrupted crawl is intact up to its last commit.
+const manifestSchema = `
+	CREATE TABLE IF NOT EXISTS crawl_manifest (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		tile_count INT NOT NULL,
+		tile_hash TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	);
+`
+
+// tileManifest is a running count and hash of a file's tiles. The hash is
+// the sum of a hash of each tile, so it doesn't depend on the order tiles
+// were written in, and a replaced tile's hash can be taken back out.
+type tileManifest struct {
+	count int64
+	hash  uint64
+}
+
+// tileHash hashes a tile's TMS coordinates and image.
+func tileHash(z maptile.Zoom, x, row uint32, data []byte) uint64 {
+	h := md5.New()
+	fmt.Fprintf(h, "%d/%d/%d\n", z, x, row)
+	h.Write(data)
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (m *tileManifest) add(z maptile.Zoom, x, row uint32, data []byte) {
+	m.count++
+	m.hash += tileHash(z, x, row, data)
+}
+
+func (m *tileManifest) remove(z maptile.Zoom, x, row uint32, data []byte) {
+	m.count--
+	m.hash -= tileHash(z, x, row, data)
+}
+
+func (m *tileManifest) hashString() string {
+	return fmt.Sprintf("%016x", m.hash)
+}
+
+// loadManifest returns the manifest of a file opened for writing. Files
+// that have tiles but no manifest were written before manifests were kept,
+// so they don't get one, rather than reading every tile to make one.
+func loadManifest(db *sql.DB) (*tileManifest, error) {
+	if _, err := db.Exec(manifestSchema); err != nil {
+		return nil, err
+	}
+
+	m := &tileManifest{}
+	var hash string
+	err := db.QueryRow("SELECT tile_count, tile_hash FROM crawl_manifest WHERE id = 1").Scan(&m.count, &hash)
+	switch {
+	case err == sql.ErrNoRows:
+		var hasTiles bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM tiles)").Scan(&hasTiles); err != nil {
+			return nil, err
+		}
+		if hasTiles {
+			return nil, nil
+		}
+		return m, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if _, err := fmt.Sscanf(hash, "%x", &m.hash); err != nil {
+		return nil, fmt.Errorf("invalid manifest hash %q: %w", hash, err)
+	}
+	return m, nil
+}
+
+// save records the manifest in tx.
+func (m *tileManifest) save(tx *sqliteTx) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO crawl_manifest (id, tile_count, tile_hash, updated_at) VALUES (1, ?, ?, ?)",
+		m.count, m.hashString(), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// readManifest returns a finished file's manifest, or nil if it doesn't
+// have one.
+func readManifest(db *sql.DB) (*tileManifest, error) {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'crawl_manifest')").Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+
+	m := &tileManifest{}
+	var hash string
+	err := db.QueryRow("SELECT tile_count, tile_hash FROM crawl_manifest WHERE id = 1").Scan(&m.count, &hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(hash, "%x", &m.hash); err != nil {
+		return nil, fmt.Errorf("invalid manifest hash %q: %w", hash, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// openMBTiles opens an existing mbtiles file for reading.
+func openMBTiles(filename string) (*sql.DB, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+
+	return sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", filename))
+}
+
+type metadataRow struct {
+	name  string
+	value string
+}
+
+// readMetadata returns the rows of an mbtiles metadata table.
+func readMetadata(db *sql.DB) ([]metadataRow, error) {
+	rows, err := db.Query("SELECT name, value FROM metadata ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metadata []metadataRow
+	for rows.Next() {
+		var m metadataRow
+		if err := rows.Scan(&m.name, &m.value); err != nil {
+			return nil, err
+		}
+		metadata = append(metadata, m)
+	}
+
+	return metadata, rows.Err()
+}
+
+// flipY converts between XYZ and TMS tile rows, which is its own inverse.
+func flipY(z, y uint32) uint32 {
+	return (1 << z) - 1 - y
+}
+
+// detectFormat identifies an image's format from its leading bytes.
+func detectFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpg"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return "gif"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "webp"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return "tiff"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return "bmp"
+	case bytes.HasPrefix(data, []byte("Lerc2 ")), bytes.HasPrefix(data, []byte("CntZImage ")):
+		return "lerc"
+	}
+	return "unknown"
+}
+
+const (
+	insertTileSQL  = "INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?);"
+	insertImageSQL = "INSERT OR IGNORE INTO images (tile_id, tile_data, content_type) VALUES (?, ?, ?);"
+	insertMapSQL   = "INSERT OR REPLACE INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (?, ?, ?, ?);"
+)
+
+// tileWriter writes tiles to an mbtiles file, committing in batches.
+type tileWriter struct {
+	filename string
+	opts     mbtilesOptions
+
+	// dedup is set when the file stores images separately from the tile map,
+	// whether it was asked for or the file was already laid out that way.
+	dedup bool
+
+	db   *sql.DB
+	tx   *sqliteTx
+	stmt *sql.Stmt
+	// imageStmt inserts into the images table of a deduplicated file, while
+	// stmt inserts into its map.
+	imageStmt *sql.Stmt
+
+	// manifest tracks the tiles in the file, if it has a manifest.
+	manifest *tileManifest
+
+	// uncommitted counts the tiles written since committedAt.
+	uncommitted int
+	committedAt time.Time
+
+	// last is the last tile written, which is saved as the checkpoint with
+	// the next commit, and committed is the checkpoint saved last.
+	last      *maptile.Tile
+	committed *checkpoint
+}
+
+// mbtilesOptions describes the mbtiles file a crawl writes to.
+type mbtilesOptions struct {
+	name string
+	// format is the mbtiles format of the tiles, png if empty.
+	format  string
+	minZoom maptile.Zoom
+	maxZoom maptile.Zoom
+
+	// grid is the tiling scheme, web mercator if nil.
+	grid tilesource.Grid
+
+	// attribution, if set, is credit to show with the tiles.
+	attribution string
+	// generator, if set, records the program and version that wrote the
+	// tiles.
+	generator string
+
+	// pageSize is the sqlite page size in bytes, which only takes effect
+	// when the file is created.
+	pageSize int
+	// cacheSize is the sqlite page cache size in KiB.
+	cacheSize int
+	// busyTimeout, if set, is how long to wait for another process that has
+	// the file locked, like a reader previewing it, before failing.
+	busyTimeout time.Duration
+
+	// vacuum runs VACUUM and ANALYZE when the writer is closed.
+	vacuum bool
+	// compact creates files in incremental auto vacuum mode and frees their
+	// unused pages when the writer is closed, which is cheaper than vacuum
+	// but leaves the file fragmented.
+	compact bool
+
+	// dedup stores each distinct image once, with a tiles view joining the
+	// images to the map of tiles that use them. It only takes effect when
+	// the file is created.
+	dedup bool
+	// dedupScope is "zoom" to only share images between tiles at the same
+	// zoom, which costs a copy of a common image, like a blank ocean tile,
+	// per zoom but keeps each zoom's images apart. Otherwise images are
+	// shared by the whole file.
+	dedupScope string
+
+	// compat creates the empty UTFGrid tables and writes the optional
+	// metadata rows from the MBTiles 1.1 spec, for older readers that expect
+	// them.
+	compat bool
+	// gdal writes the bounds at full precision and within web mercator's
+	// latitudes, which GDAL's MBTiles driver takes the extent from, along
+	// with the CRS.
+	gdal bool
+
+	// emptyMarker records in the metadata that blank tiles are stored as
+	// emptyMarker.
+	emptyMarker bool
+
+	// layerName, if set, is the ID of the tileset's layer in the json
+	// metadata row, rather than its name, and bands describes the data it
+	// was rendered from, if known.
+	layerName string
+	bands     *rasterBands
+
+	// bounds, if set, is the area covered by the tileset.
+	bounds *orb.Bound
+
+	// custom are extra rows from --metadata, written after the others so
+	// they replace any with the same name.
+	custom []metadataRow
+
+	// viewers names the HTML previews, leaflet or openlayers, to write
+	// alongside a tile tree.
+	viewers []string
+
+	// batchSize is how many tiles are written per transaction, 1000 if 0.
+	batchSize int
+	// commitInterval, if set, also commits a transaction that's been open
+	// this long when the next tile is written, so slow crawls are saved
+	// regularly.
+	commitInterval time.Duration
+}
+
+// commitDue reports whether a writer should commit after writing uncommitted
+// tiles since committedAt.
+func (o mbtilesOptions) commitDue(uncommitted int, committedAt time.Time) bool {
+	batchSize := o.batchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	return uncommitted >= batchSize || (o.commitInterval > 0 && time.Since(committedAt) >= o.commitInterval)
+}
+
+const tilesSchema = `
+	CREATE TABLE IF NOT EXISTS tiles (
+		zoom_level INT NOT NULL,
+		tile_column INT NOT NULL,
+		tile_row INT NOT NULL,
+		tile_data BLOB NOT NULL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS tiles_index ON tiles (zoom_level, tile_column, tile_row);
+`
+
+// dedupTilesSchema stores each image once, keyed by its hash, along with its
+// content type since a tileset may mix formats.
+const dedupTilesSchema = `
+	CREATE TABLE IF NOT EXISTS map (
+		zoom_level INT NOT NULL,
+		tile_column INT NOT NULL,
+		tile_row INT NOT NULL,
+		tile_id TEXT NOT NULL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS map_index ON map (zoom_level, tile_column, tile_row);
+	CREATE TABLE IF NOT EXISTS images (
+		tile_id TEXT PRIMARY KEY,
+		tile_data BLOB NOT NULL,
+		content_type TEXT
+	);
+	CREATE VIEW IF NOT EXISTS tiles AS
+		SELECT map.zoom_level AS zoom_level, map.tile_column AS tile_column, map.tile_row AS tile_row, images.tile_data AS tile_data
+		FROM map JOIN images ON images.tile_id = map.tile_id;
+`
+
+// compatSchema is the UTFGrid tables from the MBTiles 1.1 spec, which stay
+// empty.
+const compatSchema = `
+	CREATE TABLE IF NOT EXISTS grids (
+		zoom_level INT NOT NULL,
+		tile_column INT NOT NULL,
+		tile_row INT NOT NULL,
+		grid BLOB NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS grid_data (
+		zoom_level INT NOT NULL,
+		tile_column INT NOT NULL,
+		tile_row INT NOT NULL,
+		key_name TEXT,
+		key_json TEXT
+	);
+`
+
+// createMBTiles creates (or opens) an mbtiles file for writing and fills in
+// its metadata.
+func createMBTiles(filename string, opts mbtilesOptions) (*tileWriter, error) {
+	dsn := fmt.Sprintf("file:%s?_journal_mode=MEMORY&_synchronous=OFF", filename)
+	if opts.cacheSize > 0 {
+		dsn += fmt.Sprintf("&_cache_size=-%d", opts.cacheSize)
+	}
+	if opts.busyTimeout > 0 {
+		dsn += fmt.Sprintf("&_busy_timeout=%d", opts.busyTimeout.Milliseconds())
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// The page size and auto vacuum mode have to be set on the same
+	// connection, before the first table is created.
+	var pragmas string
+	if opts.pageSize > 0 {
+		pragmas += fmt.Sprintf("PRAGMA page_size = %d; ", opts.pageSize)
+	}
+	if opts.compact {
+		pragmas += "PRAGMA auto_vacuum = INCREMENTAL; "
+	}
+	if pragmas != "" {
+		if _, err := db.Exec(pragmas + "CREATE TABLE IF NOT EXISTS metadata (name TEXT, value TEXT);"); err != nil {
+			return nil, fmt.Errorf("couldn't set page size and auto vacuum mode: %w", err)
+		}
+	}
+
+	// Files that already exist keep whichever layout they were created with.
+	var tilesType string
+	if err := db.QueryRow("SELECT type FROM sqlite_master WHERE name = 'tiles'").Scan(&tilesType); err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("couldn't read schema: %w", err)
+	}
+	dedup := tilesType == "view" || (tilesType == "" && opts.dedup)
+
+	// New files are marked as MBTiles with the spec's application ID. The
+	// spec doesn't define a user_version, so that's left at 0.
+	if tilesType == "" {
+		if _, err := db.Exec("PRAGMA application_id = 0x4d504258;"); err != nil {
+			return nil, fmt.Errorf("couldn't mark file as MBTiles: %w", err)
+		}
+	}
+
+	schema := tilesSchema
+	if dedup {
+		schema = dedupTilesSchema
+	}
+	if opts.compat {
+		schema += compatSchema
+	}
+
+	if _, err := db.Exec("BEGIN TRANSACTION;" + schema + `
+		CREATE TABLE IF NOT EXISTS metadata (
+			name TEXT,
+			value TEXT
+		);
+		CREATE TABLE IF NOT EXISTS crawl_progress (
+			zoom_level INT PRIMARY KEY,
+			completed_at TEXT NOT NULL
+		);
+		COMMIT;
+	`); err != nil {
+		return nil, fmt.Errorf("couldn't create tables: %w", err)
+	}
+
+	if err := ensureMetadataIndex(db); err != nil {
+		return nil, err
+	}
+
+	manifest, err := loadManifest(db)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read manifest: %w", err)
+	}
+
+	committed, err := loadCheckpoint(db)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read checkpoint: %w", err)
+	}
+
+	w := &tileWriter{filename: filename, opts: opts, dedup: dedup, db: db, manifest: manifest, committed: committed}
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+
+	for _, m := range opts.metadata() {
+		if err := w.setMetadata(m.name, m.value); err != nil {
+			return nil, fmt.Errorf("couldn't write metadata: %w", err)
+		}
+	}
+
+	return w, nil
+}
+
+func (w *tileWriter) begin() error {
+	tx, err := beginImmediate(w.db)
+	if err != nil {
+		return fmt.Errorf("couldn't create transaction: %w", err)
+	}
+
+	w.tx = tx
+	w.uncommitted, w.committedAt = 0, time.Now()
+
+	if w.dedup {
+		if w.imageStmt, err = tx.Prepare(insertImageSQL); err != nil {
+			return fmt.Errorf("couldn't create insert prepared statement: %w", err)
+		}
+		w.stmt, err = tx.Prepare(insertMapSQL)
+	} else {
+		w.stmt, err = tx.Prepare(insertTileSQL)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't create insert prepared statement: %w", err)
+	}
+
+	return nil
+}
+
+func (w *tileWriter) commit() error {
+	var committed *checkpoint
+	if w.last != nil {
+		var err error
+		if committed, err = saveCheckpoint(w.tx, *w.last); err != nil {
+			return fmt.Errorf("couldn't save checkpoint: %w", err)
+		}
+	}
+
+	if w.manifest != nil {
+		if err := w.manifest.save(w.tx); err != nil {
+			return fmt.Errorf("couldn't save manifest: %w", err)
+		}
+	}
+
+	if err := w.stmt.Close(); err != nil {
+		return fmt.Errorf("couldn't close insert statement: %w", err)
+	}
+	if w.imageStmt != nil {
+		if err := w.imageStmt.Close(); err != nil {
+			return fmt.Errorf("couldn't close insert statement: %w", err)
+		}
+		w.imageStmt = nil
+	}
+
+	if err := w.tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+	if committed != nil {
+		w.committed, w.last = committed, nil
+	}
+
+	return nil
+}
+
+// failed wraps an error writing to the file with the last committed tile.
+func (w *tileWriter) failed(err error) error {
+	return &writeError{filename: w.filename, committed: w.committed, err: err}
+}
+
+// put stores the XYZ tile t.
+func (w *tileWriter) put(t maptile.Tile, data []byte) error {
+	if !w.opts.tileGrid().Valid(t) {
+		return fmt.Errorf("tile %d/%d/%d is out of range", t.Z, t.X, t.Y)
+	}
+
+	// "Invert the Y" to get to a TMS tile coordinate for mbtiles
+	w.last = &t
+	if err := w.putRow(t.Z, t.X, flipY(uint32(t.Z), t.Y), data); err != nil {
+		return w.failed(err)
+	}
+	return nil
+}
+
+// putRow stores a tile at a TMS row, replacing any tile already there.
+func (w *tileWriter) putRow(z maptile.Zoom, x, row uint32, data []byte) error {
+	if w.manifest != nil {
+		existing, err := w.getRow(z, x, row)
+		if err != nil {
+			return fmt.Errorf("couldn't check for an existing tile: %w", err)
+		}
+		if existing != nil {
+			w.manifest.remove(z, x, row, existing)
+		}
+		w.manifest.add(z, x, row, data)
+	}
+
+	if w.dedup {
+		id := fmt.Sprintf("%x", md5.Sum(data))
+		if w.opts.dedupScope == "zoom" {
+			id = fmt.Sprintf("%d/%s", z, id)
+		}
+		if err := execBusy(w.imageStmt, id, data, contentType(detectFormat(data))); err != nil {
+			return fmt.Errorf("couldn't exec insert statement: %w", err)
+		}
+		if err := execBusy(w.stmt, z, x, row, id); err != nil {
+			return fmt.Errorf("couldn't exec insert statement: %w", err)
+		}
+	} else if err := execBusy(w.stmt, z, x, row, data); err != nil {
+		return fmt.Errorf("couldn't exec insert statement: %w", err)
+	}
+
+	w.uncommitted++
+	if w.opts.commitDue(w.uncommitted, w.committedAt) {
+		log.Printf("Committed")
+		if err := w.commit(); err != nil {
+			return err
+		}
+		return w.begin()
+	}
+
+	return nil
+}
+
+// deleteFromZoom deletes the tiles at zoom and deeper, and the record of
+// those zooms being complete, returning how many tiles were deleted.
+func (w *tileWriter) deleteFromZoom(zoom maptile.Zoom) (int64, error) {
+	if w.manifest != nil {
+		rows, err := w.tx.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles WHERE zoom_level >= ?", zoom)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var z maptile.Zoom
+			var x, row uint32
+			var data []byte
+			if err := rows.Scan(&z, &x, &row, &data); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			w.manifest.remove(z, x, row, data)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	table := "tiles"
+	if w.dedup {
+		table = "map"
+	}
+	result, err := w.tx.Exec("DELETE FROM "+table+" WHERE zoom_level >= ?", zoom)
+	if err != nil {
+		return 0, err
+	}
+	if w.dedup {
+		if _, err := w.tx.Exec("DELETE FROM images WHERE tile_id NOT IN (SELECT tile_id FROM map)"); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.tx.Exec("DELETE FROM crawl_progress WHERE zoom_level >= ?", zoom); err != nil {
+		return 0, err
+	}
+	if _, err := w.tx.Exec("DELETE FROM crawl_checkpoint WHERE zoom_level >= ?", zoom); err != nil {
+		return 0, err
+	}
+	if w.committed != nil && w.committed.tile.Z >= zoom {
+		w.committed = nil
+	}
+
+	return result.RowsAffected()
+}
+
+// getRow returns the tile stored at a TMS row, or nil if there isn't one.
+func (w *tileWriter) getRow(z maptile.Zoom, x, row uint32) ([]byte, error) {
+	var data []byte
+	err := w.tx.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", z, x, row).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+// setMetadata replaces the metadata row called name.
+func (w *tileWriter) setMetadata(name, value string) error {
+	_, err := w.tx.Exec(upsertMetadataSQL, name, value)
+	return err
+}
+
+// markZoomComplete commits everything written so far and records that zoom
+// has been fully crawled.
+func (w *tileWriter) markZoomComplete(zoom maptile.Zoom) error {
+	if _, err := w.tx.Exec("INSERT OR REPLACE INTO crawl_progress (zoom_level, completed_at) VALUES (?, ?)",
+		zoom, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return w.failed(err)
+	}
+
+	if err := w.commit(); err != nil {
+		return w.failed(err)
+	}
+
+	return w.begin()
+}
+
+func (w *tileWriter) close() error {
+	if err := w.commit(); err != nil {
+		return w.failed(err)
+	}
+
+	if w.opts.vacuum {
+		if err := w.vacuum(); err != nil {
+			return err
+		}
+	}
+	if w.opts.compact {
+		if err := w.compact(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.db.Close(); err != nil {
+		return fmt.Errorf("couldn't close database: %w", err)
+	}
+
+	return nil
+}
+
+// vacuum defragments the file and gathers query planner statistics.
+func (w *tileWriter) vacuum() error {
+	before, err := os.Stat(w.filename)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Vacuuming %s", w.filename)
+	if _, err := w.db.Exec("VACUUM; ANALYZE;"); err != nil {
+		return fmt.Errorf("couldn't vacuum: %w", err)
+	}
+
+	after, err := os.Stat(w.filename)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Vacuumed from %d to %d bytes", before.Size(), after.Size())
+	return nil
+}
+
+// compact frees the pages left unused by replaced and deleted tiles, which
+// only works in files created in incremental auto vacuum mode.
+func (w *tileWriter) compact() error {
+	var mode, free int
+	if err := w.db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return fmt.Errorf("couldn't read auto vacuum mode: %w", err)
+	}
+	if err := w.db.QueryRow("PRAGMA freelist_count").Scan(&free); err != nil {
+		return fmt.Errorf("couldn't count free pages: %w", err)
+	}
+	if free == 0 {
+		return nil
+	}
+	if mode != 2 {
+		log.Printf("%s wasn't created with --compact-on-close, so its %d free pages can only be reclaimed with --vacuum", w.filename, free)
+		return nil
+	}
+
+	before, err := os.Stat(w.filename)
+	if err != nil {
+		return err
+	}
+
+	// Each row is a page freed, and they're only freed as they're read.
+	rows, err := w.db.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return fmt.Errorf("couldn't compact: %w", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("couldn't compact: %w", err)
+	}
+
+	after, err := os.Stat(w.filename)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Compacted %d free pages, from %d to %d bytes", free, before.Size(), after.Size())
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// TestMBTilesHeader checks the application_id in the SQLite header of a new
+// file, where tools like file(1) look for it, and that user_version, which
+// the spec doesn't define, is left alone.
+func TestMBTilesHeader(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "new.mbtiles")
+	w, err := createMBTiles(filename, mbtilesOptions{name: "New", format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := readHeader(t, filename)
+	if id := binary.BigEndian.Uint32(header[68:]); id != 0x4d504258 {
+		t.Errorf("application_id is %#x, want 0x4d504258", id)
+	}
+	if string(header[68:72]) != "MPBX" {
+		t.Errorf("application_id reads %q, want MPBX", header[68:72])
+	}
+	if version := binary.BigEndian.Uint32(header[60:]); version != 0 {
+		t.Errorf("user_version is %d, want 0", version)
+	}
+}
+
+// TestMBTilesHeaderExisting checks that an existing file isn't marked, since
+// it may not be an MBTiles file the writer created.
+func TestMBTilesHeaderExisting(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "old.mbtiles")
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(tilesSchema); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	w, err := createMBTiles(filename, mbtilesOptions{name: "Old", format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := readHeader(t, filename)
+	if id := binary.BigEndian.Uint32(header[68:]); id != 0 {
+		t.Errorf("application_id of an existing file was set to %#x", id)
+	}
+}
+
+// readHeader returns the 100 byte SQLite header of filename.
+func readHeader(t *testing.T, filename string) []byte {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header := make([]byte, 100)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+// TestPutOutOfRange checks that tiles past the edge of their zoom are
+// rejected rather than stored at a wrapped or negative row.
+func TestPutOutOfRange(t *testing.T) {
+	for _, test := range []struct {
+		grid tilesource.Grid
+		tile maptile.Tile
+		ok   bool
+	}{
+		{tilesource.WebMercator{}, maptile.New(3, 3, 2), true},
+		{tilesource.WebMercator{}, maptile.New(4, 0, 2), false},
+		{tilesource.WebMercator{}, maptile.New(0, 4, 2), false},
+		{tilesource.WebMercator{}, maptile.New(1, 0, 0), false},
+		{tilesource.Geographic{}, maptile.New(7, 3, 2), true},
+		{tilesource.Geographic{}, maptile.New(8, 0, 2), false},
+		{tilesource.Geographic{}, maptile.New(0, 4, 2), false},
+	} {
+		filename := filepath.Join(t.TempDir(), "range.mbtiles")
+		w, err := createMBTiles(filename, mbtilesOptions{name: "Range", format: "png", grid: test.grid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.put(test.tile, []byte("tile"))
+		if test.ok && err != nil {
+			t.Errorf("%T: %v was rejected: %v", test.grid, test.tile, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%T: %v was stored", test.grid, test.tile)
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := openMBTiles(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM tiles").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		if !test.ok && n != 0 {
+			t.Errorf("%T: %d rows were written for %v", test.grid, n, test.tile)
+		}
+	}
+}
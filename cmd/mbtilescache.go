@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// mbtilesCache fetches tiles from an existing mbtiles file, like an older
+// crawl of the same service, and only asks next for the tiles it lacks.
+// Blank tiles were never stored, so they're always fetched again.
+type mbtilesCache struct {
+	stmt *sql.Stmt
+	next tilesource.Source
+
+	hits, misses uint64
+}
+
+// openMBTilesCache opens filename as a cache in front of next. Its tiles
+// must be in format, since they're copied into the output as they are.
+func openMBTilesCache(filename, format string, next tilesource.Source) (*mbtilesCache, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=5000", filename))
+	if err != nil {
+		return nil, err
+	}
+
+	var cacheFormat string
+	err = db.QueryRow("SELECT value FROM metadata WHERE name = 'format'").Scan(&cacheFormat)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if cacheFormat != "" && cacheFormat != format {
+		return nil, fmt.Errorf("%s has %s tiles, but the output is %s", filename, cacheFormat, format)
+	}
+
+	stmt, err := db.Prepare("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	return &mbtilesCache{stmt: stmt, next: next}, nil
+}
+
+func (m *mbtilesCache) FetchTile(ctx context.Context, t maptile.Tile) ([]byte, error) {
+	var data []byte
+	err := m.stmt.QueryRowContext(ctx, t.Z, t.X, flipY(uint32(t.Z), t.Y)).Scan(&data)
+	if err == nil {
+		atomic.AddUint64(&m.hits, 1)
+		return data, nil
+	} else if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("reading tile %d/%d/%d from cache: %w", t.Z, t.X, t.Y, err)
+	}
+
+	atomic.AddUint64(&m.misses, 1)
+	return m.next.FetchTile(ctx, t)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// Merge conflict policies, deciding which copy of a tile found in more than
+// one input is kept.
+const (
+	firstWins    = "first-wins"
+	lastWins     = "last-wins"
+	nonBlankWins = "non-blank-wins"
+)
+
+// runMerge implements the merge subcommand, which combines several mbtiles
+// files, like the pieces of a --split-at-zoom crawl, into one.
+func runMerge(args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := flags.String("o", "", "Path to the merged mbtiles")
+	policy := flags.String("policy", firstWins, "Which tile to keep when inputs overlap: first-wins, last-wins, or non-blank-wins")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s merge -o out.mbtiles a.mbtiles b.mbtiles...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *output == "" || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	switch *policy {
+	case firstWins, lastWins, nonBlankWins:
+	default:
+		log.Fatalf("Unknown merge policy %q", *policy)
+	}
+
+	for _, input := range flags.Args() {
+		if input == *output {
+			log.Fatalf("Can't merge %s into itself", input)
+		}
+	}
+
+	if err := mergeMBTiles(*output, flags.Args(), *policy); err != nil {
+		log.Fatalf("Couldn't merge: %+v", err)
+	}
+}
+
+// mergeMBTiles copies the tiles in inputs into output, resolving tiles that
+// appear in more than one input with policy. Identical images are only
+// stored once. Metadata is taken from the first input, with the zoom range
+// and bounds widened to cover all of them.
+func mergeMBTiles(output string, inputs []string, policy string) error {
+	w, err := createMBTiles(output, mbtilesOptions{dedup: true})
+	if err != nil {
+		return err
+	}
+
+	var opts mbtilesOptions
+	for i, input := range inputs {
+		metadata, err := mergeInput(w, input, policy)
+		if err != nil {
+			return fmt.Errorf("couldn't merge %s: %w", input, err)
+		}
+
+		bounds := metadataBounds(metadata)
+		for _, m := range metadata {
+			if i == 0 {
+				if err := w.setMetadata(m.name, m.value); err != nil {
+					return err
+				}
+			}
+			if m.name == "name" && opts.name == "" {
+				opts.name = m.value
+			}
+			if m.name == "format" && opts.format == "" {
+				opts.format = m.value
+			}
+		}
+
+		// Bounds are only kept if every input has them, and otherwise are
+		// computed from the merged tiles.
+		switch {
+		case bounds == nil:
+			opts.bounds = nil
+		case i == 0:
+			opts.bounds = bounds
+		case opts.bounds != nil:
+			union := opts.bounds.Union(*bounds)
+			opts.bounds = &union
+		}
+	}
+
+	if w.dedup {
+		if _, err := w.tx.Exec("DELETE FROM images WHERE tile_id NOT IN (SELECT tile_id FROM map)"); err != nil {
+			return fmt.Errorf("couldn't remove unused images: %w", err)
+		}
+	}
+
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	return rewriteMetadata(output, opts)
+}
+
+// mergeInput copies the tiles from input into w and returns input's
+// metadata.
+func mergeInput(w *tileWriter, input, policy string) ([]metadataRow, error) {
+	db, err := openMBTiles(input)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var copied, skipped int
+	for rows.Next() {
+		var z maptile.Zoom
+		var x, row uint32
+		var data []byte
+		if err := rows.Scan(&z, &x, &row, &data); err != nil {
+			return nil, err
+		}
+
+		existing, err := w.getRow(z, x, row)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing != nil && !replaceTile(policy, existing, data) {
+			skipped++
+			continue
+		}
+
+		if err := w.putRow(z, x, row, data); err != nil {
+			return nil, err
+		}
+		copied++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Copied %d tiles from %s, keeping %d existing tiles instead", copied, input, skipped)
+	return metadata, nil
+}
+
+// replaceTile reports whether a tile that's already been merged should be
+// replaced by another copy of it under policy.
+func replaceTile(policy string, existing, data []byte) bool {
+	if bytes.Equal(existing, data) {
+		return false
+	}
+
+	switch policy {
+	case lastWins:
+		return true
+	case nonBlankWins:
+		return isBlankTile(existing) && !isBlankTile(data)
+	}
+	return false
+}
+
+// metadataBounds returns the bounds in mbtiles metadata, or nil if it
+// doesn't have any.
+func metadataBounds(metadata []metadataRow) *orb.Bound {
+	for _, m := range metadata {
+		if m.name == "bounds" {
+			if b, err := parseBound(m.value); err == nil {
+				return &b
+			}
+		}
+	}
+	return nil
+}
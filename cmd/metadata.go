@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+const upsertMetadataSQL = "INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)"
+
+// metadata returns the metadata rows describing a tileset written with opts.
+func (o mbtilesOptions) metadata() []metadataRow {
+	format := o.format
+	if format == "" {
+		format = "png"
+	}
+
+	rows := []metadataRow{
+		{"name", o.name},
+		{"format", format},
+		{"minzoom", fmt.Sprintf("%d", o.minZoom)},
+		{"maxzoom", fmt.Sprintf("%d", o.maxZoom)},
+		{"scheme", "tms"},
+	}
+
+	// There's no standard way to describe other grids in mbtiles, but the
+	// CRS is what other tools that support them look for.
+	if _, ok := o.tileGrid().(tilesource.Geographic); ok {
+		rows = append(rows, metadataRow{"crs", "EPSG:4326"})
+	} else if o.gdal {
+		rows = append(rows, metadataRow{"crs", "EPSG:3857"})
+	}
+
+	if o.attribution != "" {
+		rows = append(rows, metadataRow{"attribution", o.attribution})
+	}
+
+	if o.generator != "" {
+		rows = append(rows, metadataRow{"generator", o.generator})
+	}
+
+	if o.bounds != nil {
+		b := *o.bounds
+		center := b.Center()
+		// Bounds that cross the antimeridian are written with the west
+		// edge greater than the east, like TileJSON.
+		if b.Max[0] > 180 {
+			b.Max[0] -= 360
+		}
+		if center[0] > 180 {
+			center[0] -= 360
+		}
+		bounds := fmt.Sprintf("%f,%f,%f,%f", b.Min.X(), b.Min.Y(), b.Max.X(), b.Max.Y())
+		if o.gdal {
+			// Rounding to six places can move an edge by up to 5cm, and
+			// GDAL rejects latitudes that web mercator can't reach.
+			clamp := func(lat float64) float64 {
+				return math.Max(-tilesource.MaxMercatorLatitude, math.Min(tilesource.MaxMercatorLatitude, lat))
+			}
+			bounds = strings.Join([]string{
+				strconv.FormatFloat(b.Min.X(), 'f', -1, 64),
+				strconv.FormatFloat(clamp(b.Min.Y()), 'f', -1, 64),
+				strconv.FormatFloat(b.Max.X(), 'f', -1, 64),
+				strconv.FormatFloat(clamp(b.Max.Y()), 'f', -1, 64),
+			}, ",")
+		}
+		rows = append(rows,
+			metadataRow{"bounds", bounds},
+			metadataRow{"center", fmt.Sprintf("%f,%f,%d", center.X(), center.Y(), o.minZoom)},
+		)
+	}
+
+	if o.emptyMarker {
+		rows = append(rows, metadataRow{"empty_tile_marker", "1x1 transparent png"})
+	}
+
+	layerName := o.layerName
+	if layerName == "" {
+		layerName = o.name
+	}
+	layer := rasterLayer{ID: layerName, Type: "raster", Format: format, rasterBands: o.bands}
+	if data, err := json.Marshal(struct {
+		Layers []rasterLayer `json:"layers"`
+	}{[]rasterLayer{layer}}); err == nil {
+		rows = append(rows, metadataRow{"json", string(data)})
+	}
+
+	if o.compat {
+		rows = append(rows,
+			metadataRow{"type", "baselayer"},
+			metadataRow{"version", "1.1"},
+			metadataRow{"description", o.name},
+		)
+	}
+
+	return append(rows, o.custom...)
+}
+
+// reservedMetadata are the metadata names the MBTiles spec defines, along
+// with the ones this program writes itself, which --metadata only replaces
+// with --force.
+var reservedMetadata = map[string]bool{
+	"name": true, "format": true, "bounds": true, "center": true,
+	"minzoom": true, "maxzoom": true, "attribution": true, "description": true,
+	"type": true, "version": true, "json": true,
+	"scheme": true, "crs": true, "generator": true, "empty_tile_marker": true,
+}
+
+// parseMetadataRows parses --metadata key=value values into rows.
+func parseMetadataRows(values []string, force bool) ([]metadataRow, error) {
+	var rows []metadataRow
+	seen := map[string]bool{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("%q must be key=value", value)
+		}
+		key := strings.TrimSpace(parts[0])
+		if reservedMetadata[strings.ToLower(key)] && !force {
+			return nil, fmt.Errorf("%s is a standard metadata row, so it needs --force to replace", key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%s is given more than once", key)
+		}
+		seen[key] = true
+		rows = append(rows, metadataRow{key, parts[1]})
+	}
+	return rows, nil
+}
+
+// rasterLayer describes the tiles in the json metadata row, which raster
+// tilesets don't need but some readers expect, in place of the
+// vector_layers of a vector tileset.
+type rasterLayer struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Format string `json:"format"`
+	*rasterBands
+}
+
+// rasterBands describes the data an image service's tiles were rendered
+// from, for scientific data whose pixel values mean something.
+type rasterBands struct {
+	BandCount int       `json:"band_count,omitempty"`
+	PixelType string    `json:"pixel_type,omitempty"`
+	DataType  string    `json:"data_type,omitempty"`
+	MinValues []float64 `json:"min_values,omitempty"`
+	MaxValues []float64 `json:"max_values,omitempty"`
+}
+
+// newRasterBands describes the bands of an image service, or returns nil for
+// a service that doesn't say, like a MapServer. outputPixelType, if set, is
+// the pixel type the service was asked to convert to.
+func newRasterBands(details *esriservice.ServiceDetails, outputPixelType string) *rasterBands {
+	if details.BandCount == 0 {
+		return nil
+	}
+
+	b := &rasterBands{
+		BandCount: details.BandCount,
+		PixelType: details.PixelType,
+		DataType:  strings.ToLower(strings.TrimPrefix(details.ServiceDataType, "esriImageServiceDataType")),
+		MinValues: details.MinValues,
+		MaxValues: details.MaxValues,
+	}
+	if outputPixelType != "" {
+		b.PixelType = strings.ToUpper(outputPixelType)
+		// The range is of the original pixel type.
+		b.MinValues, b.MaxValues = nil, nil
+	}
+	return b
+}
+
+func (o mbtilesOptions) tileGrid() tilesource.Grid {
+	if o.grid == nil {
+		return tilesource.WebMercator{}
+	}
+	return o.grid
+}
+
+// metadataGrid returns the grid a file's tiles are on, judging by the crs
+// row metadata writes for grids other than web mercator.
+func metadataGrid(metadata []metadataRow) tilesource.Grid {
+	for _, m := range metadata {
+		if m.name == "crs" && m.value == "EPSG:4326" {
+			return tilesource.Geographic{}
+		}
+	}
+	return tilesource.WebMercator{}
+}
+
+// ensureMetadataIndex makes metadata names unique so rows can be replaced in
+// place. Files written by older versions could have duplicate rows, so all
+// but the newest of each are dropped first.
+func ensureMetadataIndex(db *sql.DB) error {
+	err := retryBusy(func() error {
+		_, err := db.Exec(`
+			DELETE FROM metadata WHERE rowid NOT IN (SELECT MAX(rowid) FROM metadata GROUP BY name);
+			CREATE UNIQUE INDEX IF NOT EXISTS metadata_index ON metadata (name);
+		`)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't index metadata: %w", err)
+	}
+	return nil
+}
+
+// defaultName picks a tileset name from the service's endpoint, like "Roads"
+// for .../services/Roads/MapServer, falling back to the output's file name.
+func defaultName(endpoint, output string) string {
+	if u, err := url.Parse(endpoint); err == nil && endpoint != "" {
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		for i := len(parts) - 1; i > 0; i-- {
+			if strings.HasSuffix(parts[i], "Server") {
+				return parts[i-1]
+			}
+		}
+	}
+
+	return strings.TrimSuffix(filepath.Base(output), filepath.Ext(output))
+}
+
+// rewriteMetadata replaces the standard metadata rows in an existing mbtiles
+// file without touching its tiles or any other metadata. Zoom levels, and
+// bounds if opts doesn't have them, are computed from the tiles in the file.
+// Its grid, and its format and json rows unless opts has a format, are kept.
+func rewriteMetadata(filename string, opts mbtilesOptions) error {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rw", filename))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var minZoom, maxZoom sql.NullInt64
+	if err := db.QueryRow("SELECT MIN(zoom_level), MAX(zoom_level) FROM tiles").Scan(&minZoom, &maxZoom); err != nil {
+		return fmt.Errorf("couldn't read zoom levels: %w", err)
+	}
+	if !minZoom.Valid {
+		return fmt.Errorf("%s has no tiles", filename)
+	}
+	opts.minZoom, opts.maxZoom = maptile.Zoom(minZoom.Int64), maptile.Zoom(maxZoom.Int64)
+
+	existing, err := readMetadata(db)
+	if err != nil {
+		return fmt.Errorf("couldn't read metadata: %w", err)
+	}
+	if opts.grid == nil {
+		opts.grid = metadataGrid(existing)
+	}
+
+	// The json row can have band information that can't be recomputed
+	// from the file, so it's only replaced along with the format.
+	keepJSON := false
+	if opts.format == "" {
+		for _, m := range existing {
+			switch m.name {
+			case "format":
+				opts.format = m.value
+			case "json":
+				keepJSON = true
+			}
+		}
+	}
+
+	if opts.bounds == nil {
+		b, err := tileBounds(db, opts.grid, opts.maxZoom)
+		if err != nil {
+			return err
+		}
+		opts.bounds = &b
+	}
+
+	if err := ensureMetadataIndex(db); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range opts.metadata() {
+		if m.name == "json" && keepJSON {
+			continue
+		}
+		if _, err := tx.Exec(upsertMetadataSQL, m.name, m.value); err != nil {
+			tx.Rollback()
+			return err
+		}
+		log.Printf("Set %s to %s", m.name, m.value)
+	}
+
+	return tx.Commit()
+}
+
+// tileBounds returns the area covered by the tiles at zoom on grid.
+func tileBounds(db *sql.DB, grid tilesource.Grid, zoom maptile.Zoom) (orb.Bound, error) {
+	var minX, maxX, minRow, maxRow uint32
+	if err := db.QueryRow("SELECT MIN(tile_column), MAX(tile_column), MIN(tile_row), MAX(tile_row) FROM tiles WHERE zoom_level = ?", zoom).
+		Scan(&minX, &maxX, &minRow, &maxRow); err != nil {
+		return orb.Bound{}, fmt.Errorf("couldn't compute bounds: %w", err)
+	}
+
+	// Rows are TMS, so the maximum row is the northernmost tile.
+	topLeft := maptile.New(minX, flipY(uint32(zoom), maxRow), zoom)
+	bottomRight := maptile.New(maxX, flipY(uint32(zoom), minRow), zoom)
+	return grid.Bound(topLeft).Union(grid.Bound(bottomRight)), nil
+}
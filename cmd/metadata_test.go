@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// TestRewriteMetadataGeographic rewrites the metadata of a file on the
+// geographic grid, whose bounds have to be computed on that grid rather
+// than web mercator's.
+func TestRewriteMetadataGeographic(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "geographic.mbtiles")
+	grid := tilesource.Geographic{}
+	w, err := createMBTiles(filename, mbtilesOptions{name: "Old", format: "png", grid: grid, minZoom: 2, maxZoom: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tile := range []maptile.Tile{maptile.New(5, 1, 2), maptile.New(6, 2, 2)} {
+		if err := w.put(tile, []byte("tile")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rewriteMetadata(filename, mbtilesOptions{name: "New", format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := openMBTiles(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, m := range metadata {
+		values[m.name] = m.value
+	}
+
+	// Geographic tiles at zoom 2 are 45° square, counting down from 90°N.
+	if want := fmt.Sprintf("%f,%f,%f,%f", 45.0, -45.0, 135.0, 45.0); values["bounds"] != want {
+		t.Errorf("bounds are %q, want %q", values["bounds"], want)
+	}
+	if values["crs"] != "EPSG:4326" {
+		t.Errorf("crs is %q, want EPSG:4326 to be kept", values["crs"])
+	}
+	if values["name"] != "New" {
+		t.Errorf("name is %q, want New", values["name"])
+	}
+}
+
+// TestRewriteMetadataJPEG rewrites the metadata of a JPEG file without a
+// format, which keeps its format and its json row's band information, and
+// then with one, which replaces them.
+func TestRewriteMetadataJPEG(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jpeg.mbtiles")
+	bands := &rasterBands{BandCount: 3, PixelType: "U8"}
+	w, err := createMBTiles(filename, mbtilesOptions{name: "Old", format: "jpg", bands: bands, minZoom: 1, maxZoom: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.put(maptile.New(0, 0, 1), []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	values := func() map[string]string {
+		t.Helper()
+		db, err := openMBTiles(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		metadata, err := readMetadata(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[string]string{}
+		for _, m := range metadata {
+			values[m.name] = m.value
+		}
+		return values
+	}
+	before := values()
+	if !strings.Contains(before["json"], `"band_count":3`) {
+		t.Fatalf("json is %s, without band information to keep", before["json"])
+	}
+
+	if err := rewriteMetadata(filename, mbtilesOptions{name: "New"}); err != nil {
+		t.Fatal(err)
+	}
+	after := values()
+	if after["format"] != "jpg" {
+		t.Errorf("format is %q, want jpg to be kept", after["format"])
+	}
+	if after["json"] != before["json"] {
+		t.Errorf("json is %s, want %s to be kept", after["json"], before["json"])
+	}
+	if after["name"] != "New" {
+		t.Errorf("name is %q, want New", after["name"])
+	}
+
+	if err := rewriteMetadata(filename, mbtilesOptions{name: "New", format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	after = values()
+	if after["format"] != "png" {
+		t.Errorf("format is %q, want png when it's given", after["format"])
+	}
+	if want := `{"layers":[{"id":"New","type":"raster","format":"png"}]}`; after["json"] != want {
+		t.Errorf("json is %s, want %s when a format is given", after["json"], want)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram buckets.
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	15 * time.Second,
+	30 * time.Second,
+}
+
+// latencyHistogram counts per-tile fetch durations into fixed buckets so its
+// memory use doesn't grow with the size of the crawl.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{
+		counts: make([]uint64, len(latencyBuckets)+1),
+	}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	h.mu.Unlock()
+}
+
+// percentile returns the upper bound of the bucket containing the p-th
+// percentile (0-1) of observations, or -1 if it's past the last bucket.
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	target := uint64(p * float64(h.count))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen > target || seen == h.count {
+			if i == len(latencyBuckets) {
+				return -1
+			}
+			return latencyBuckets[i]
+		}
+	}
+	return -1
+}
+
+func (h *latencyHistogram) summary() string {
+	h.mu.Lock()
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	if count == 0 {
+		return "no tiles fetched"
+	}
+
+	format := func(d time.Duration) string {
+		if d < 0 {
+			return fmt.Sprintf(">%s", latencyBuckets[len(latencyBuckets)-1])
+		}
+		return fmt.Sprintf("<=%s", d)
+	}
+
+	return fmt.Sprintf("%d tiles, mean %s, p50 %s, p90 %s, p99 %s",
+		count, (sum / time.Duration(count)).Round(time.Millisecond),
+		format(h.percentile(0.5)), format(h.percentile(0.9)), format(h.percentile(0.99)))
+}
+
+// crawlMetrics holds the counters exposed on the --metrics-addr endpoint.
+type crawlMetrics struct {
+	tilesFetched uint64
+	tilesWritten uint64
+	tilesSkipped uint64
+	tilesErrored uint64
+	bytesWritten uint64
+	// branchesPruned counts tiles whose children weren't crawled because of
+	// --max-depth-blank-streak.
+	branchesPruned uint64
+	inFlight       int64
+
+	latency *latencyHistogram
+}
+
+func newCrawlMetrics() *crawlMetrics {
+	return &crawlMetrics{
+		latency: newLatencyHistogram(),
+	}
+}
+
+// handler serves the metrics in the Prometheus text exposition format. The
+// queue depths and request rate limit are read at scrape time from the given
+// functions.
+func (m *crawlMetrics) handler(requestQueue, resultQueue func() int, requestRate func() float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		counter := func(name, help string, v uint64) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+		}
+		gauge := func(name, help string, v int64) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+		}
+
+		counter("imageservice_tiles_fetched_total", "Tiles fetched from the service.", atomic.LoadUint64(&m.tilesFetched))
+		counter("imageservice_tiles_written_total", "Tiles written to the output.", atomic.LoadUint64(&m.tilesWritten))
+		counter("imageservice_tiles_skipped_total", "Tiles skipped because they were blank.", atomic.LoadUint64(&m.tilesSkipped))
+		counter("imageservice_tiles_errored_total", "Tiles that failed to fetch.", atomic.LoadUint64(&m.tilesErrored))
+		counter("imageservice_branches_pruned_total", "Tiles whose children were skipped by the blank streak heuristic.", atomic.LoadUint64(&m.branchesPruned))
+		counter("imageservice_bytes_written_total", "Tile bytes written to the output.", atomic.LoadUint64(&m.bytesWritten))
+		gauge("imageservice_request_queue_depth", "Tiles waiting to be fetched.", int64(requestQueue()))
+		gauge("imageservice_result_queue_depth", "Fetched tiles waiting to be written.", int64(resultQueue()))
+		gauge("imageservice_requests_in_flight", "Tile fetches currently in progress.", atomic.LoadInt64(&m.inFlight))
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", "imageservice_request_rate_limit", "Requests per second allowed by --throttle-on-error, or 0 for no limit.",
+			"imageservice_request_rate_limit", "imageservice_request_rate_limit", requestRate())
+
+		m.latency.writePrometheus(w, "imageservice_tile_fetch_seconds", "Per-tile fetch latency.")
+	})
+}
+
+func (h *latencyHistogram) writePrometheus(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound.Seconds(), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum.Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
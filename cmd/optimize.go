@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+)
+
+// optimizePNG re-encodes PNG bytes at maximum compression, optionally
+// converting images with few enough colors to a paletted PNG. The original
+// bytes are returned if re-encoding doesn't make them smaller.
+func optimizePNG(data []byte, palette bool) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if palette {
+		if p, ok := toPaletted(img); ok {
+			img = p
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	enc := &png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(buf, img); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+
+	return buf.Bytes(), nil
+}
+
+// canonicalPNG re-encodes PNG bytes with fixed settings and only the chunks
+// needed to draw the image, so the same pixels give the same bytes whatever
+// encoder, timestamps or text chunks the service used. Paletted images keep
+// their palette's order, so it isn't canonical for those whose colors are
+// listed in a different order each time.
+func canonicalPNG(data []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	enc := &png.Encoder{CompressionLevel: png.DefaultCompression}
+	if err := enc.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// toPaletted losslessly converts img to a paletted image if it uses 256 or
+// fewer distinct colors. 16-bit images are left alone since a PNG palette
+// only holds 8-bit entries.
+func toPaletted(img image.Image) (*image.Paletted, bool) {
+	if p, ok := img.(*image.Paletted); ok {
+		return p, true
+	}
+	if is16Bit(img) {
+		return nil, false
+	}
+
+	b := img.Bounds()
+	seen := map[color.NRGBA]struct{}{}
+	var pal color.Palette
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if _, ok := seen[c]; ok {
+				continue
+			}
+			if len(pal) == 256 {
+				return nil, false
+			}
+			seen[c] = struct{}{}
+			pal = append(pal, c)
+		}
+	}
+
+	p := image.NewPaletted(b, pal)
+	draw.Draw(p, b, img, b.Min, draw.Src)
+	return p, true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var outputPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// expandOutput replaces the placeholders in an --output path: {endpoint-name}
+// with the service's name, {date} with today's date, and {bbox} with the
+// --bbox coordinates, or the base name of the file it was read from.
+func expandOutput(output, endpoint string, bboxes []string, now time.Time) (string, error) {
+	var err error
+	expanded := outputPlaceholder.ReplaceAllStringFunc(output, func(placeholder string) string {
+		switch placeholder {
+		case "{endpoint-name}":
+			if name := defaultName(endpoint, ""); name != "" && name != "." {
+				return name
+			}
+			err = fmt.Errorf("couldn't find a service name in endpoint %q for {endpoint-name}", endpoint)
+		case "{date}":
+			return now.Format("2006-01-02")
+		case "{bbox}":
+			if len(bboxes) != 1 {
+				err = fmt.Errorf("{bbox} needs a single --bbox")
+				break
+			}
+			bbox := bboxes[0]
+			if parts := strings.Split(bbox, ","); len(parts) == 4 {
+				for i := range parts {
+					parts[i] = strings.TrimSpace(parts[i])
+				}
+				return strings.Join(parts, "_")
+			}
+			return strings.TrimSuffix(filepath.Base(bbox), filepath.Ext(bbox))
+		default:
+			err = fmt.Errorf("unknown placeholder %s, expected {endpoint-name}, {date}, or {bbox}", placeholder)
+		}
+		return placeholder
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return expanded, nil
+}
+
+// checkWritable returns an error if files can't be created next to filename.
+func checkWritable(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".write-test-")
+	if err != nil {
+		return fmt.Errorf("can't write to the directory of %s: %w", filename, err)
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
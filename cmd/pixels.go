@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// printPixelStats decodes a tile and prints the minimum, maximum and mean of
+// each band, followed by the values at the corners and center, to check that
+// a service's rendering and noData settings produce meaningful data. Values
+// are 0-255, or 0-65535 for 16-bit images.
+func printPixelStats(w io.Writer, data []byte) error {
+	format := detectFormat(data)
+	fmt.Fprintf(w, "%d bytes, %s\n", len(data), format)
+	if isBlankTile(data) {
+		fmt.Fprintln(w, "Blank tile")
+		return nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("couldn't decode %s image: %w", format, err)
+	}
+
+	bands, values, shift := pixelBands(img)
+	b := img.Bounds()
+	fmt.Fprintf(w, "%dx%d, %T\n", b.Dx(), b.Dy(), img)
+
+	n := float64(b.Dx() * b.Dy())
+	for i, band := range bands {
+		min, max, sum := uint32(math.MaxUint32), uint32(0), 0.0
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				v := values(img.At(x, y))[i] >> shift
+				if v < min {
+					min = v
+				}
+				if v > max {
+					max = v
+				}
+				sum += float64(v)
+			}
+		}
+		fmt.Fprintf(w, "%s\tmin %d\tmax %d\tmean %0.2f\n", band, min, max, sum/n)
+	}
+
+	samples := []image.Point{
+		b.Min,
+		{b.Max.X - 1, b.Min.Y},
+		{b.Min.X + b.Dx()/2, b.Min.Y + b.Dy()/2},
+		{b.Min.X, b.Max.Y - 1},
+		{b.Max.X - 1, b.Max.Y - 1},
+	}
+	for _, p := range samples {
+		fmt.Fprintf(w, "(%d,%d)", p.X, p.Y)
+		v := values(img.At(p.X, p.Y))
+		for i, band := range bands {
+			fmt.Fprintf(w, "\t%s %d", band, v[i]>>shift)
+		}
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
+
+// pixelBands returns the names of img's bands, a function that returns the
+// 16-bit value of each band of a pixel, and the shift that scales those
+// values back to the image's bit depth. Colors are unpremultiplied so they
+// match what the service rendered.
+func pixelBands(img image.Image) ([]string, func(color.Color) []uint32, uint) {
+	switch img.ColorModel() {
+	case color.GrayModel:
+		return []string{"gray"}, grayValues, 8
+	case color.Gray16Model:
+		return []string{"gray"}, grayValues, 0
+	case color.RGBA64Model, color.NRGBA64Model:
+		return []string{"red", "green", "blue", "alpha"}, nrgbaValues, 0
+	}
+	return []string{"red", "green", "blue", "alpha"}, nrgbaValues, 8
+}
+
+func grayValues(c color.Color) []uint32 {
+	return []uint32{uint32(color.Gray16Model.Convert(c).(color.Gray16).Y)}
+}
+
+func nrgbaValues(c color.Color) []uint32 {
+	n := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	return []uint32{uint32(n.R), uint32(n.G), uint32(n.B), uint32(n.A)}
+}
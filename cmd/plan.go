@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// writePlan writes every tile the crawl could fetch inside extent to
+// filename as z/x/y lines, in order with parents before their children, and
+// returns how many there were. Unlike the crawl, it can't know which
+// branches are blank, so it lists every tile down to maxZoom.
+func (c *crawler) writePlan(filename string, extent orb.Bound) (int, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return 0, fmt.Errorf("creating %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	var seeds []maptile.Tile
+	for t := range c.seedTiles(extent) {
+		if c.shard == nil || c.shard.has(t) {
+			seeds = append(seeds, t)
+		}
+	}
+	sort.Slice(seeds, func(i, j int) bool {
+		a, b := seeds[i], seeds[j]
+		if a.Z != b.Z {
+			return a.Z < b.Z
+		}
+		if a.X != b.X {
+			return a.X < b.X
+		}
+		return a.Y < b.Y
+	})
+
+	w := bufio.NewWriter(f)
+	n := 0
+	var plan func(t maptile.Tile)
+	plan = func(t maptile.Tile) {
+		if !c.grid.Valid(t) {
+			return
+		}
+		fmt.Fprintf(w, "%d/%d/%d\n", t.Z, t.X, t.Y)
+		n++
+
+		if c.recurses(t) {
+			for _, child := range c.grid.Children(t) {
+				if c.inCoverage(child) {
+					plan(child)
+				}
+			}
+		}
+	}
+	for _, t := range seeds {
+		plan(t)
+	}
+	if err := w.Flush(); err != nil {
+		return 0, fmt.Errorf("writing %s: %w", filename, err)
+	}
+
+	return n, f.Close()
+}
+
+// readPlan reads the z/x/y lines of a plan written by writePlan, or by hand,
+// skipping blank lines and # comments. Every tile must be between minZoom and
+// maxZoom.
+func readPlan(filename string, minZoom, maxZoom maptile.Zoom) (maptile.Set, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tiles := maptile.Set{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		t, err := parseTile(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", filename, line, err)
+		}
+		if t.Z < minZoom || t.Z > maxZoom {
+			return nil, fmt.Errorf("%s line %d: tile %s is outside z%d to z%d", filename, line, text, minZoom, maxZoom)
+		}
+		tiles[t] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filename, err)
+	}
+
+	return tiles, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// sampleExtent fetches the tiles at the corners and center of extent at the
+// given zoom and returns how many of them had imagery.
+func sampleExtent(ctx context.Context, source tilesource.Source, grid tilesource.Grid, extent orb.Bound, zoom maptile.Zoom) (populated, sampled int, err error) {
+	points := []orb.Point{
+		extent.Min,
+		extent.Max,
+		{extent.Min.X(), extent.Max.Y()},
+		{extent.Max.X(), extent.Min.Y()},
+		extent.Center(),
+	}
+
+	seen := map[maptile.Tile]bool{}
+	for _, p := range points {
+		for t := range grid.Cover(orb.Bound{Min: p, Max: p}, zoom) {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+
+			data, err := fetchTileWithTimeout(ctx, source, t, tileTimeout)
+			if err != nil {
+				return 0, 0, err
+			}
+
+			sampled++
+			if !isBlankTile(data) {
+				populated++
+			}
+		}
+	}
+
+	return populated, sampled, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// startProfiling starts a CPU profile and an execution trace for whichever
+// of the filenames are set. The returned function stops them and writes a
+// heap profile to memProfile, if it's set.
+func startProfiling(cpuProfile, memProfile, traceFile string) (func() error, error) {
+	var cpuFile, tf *os.File
+	var err error
+
+	if cpuProfile != "" {
+		if cpuFile, err = os.Create(cpuProfile); err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			return nil, fmt.Errorf("couldn't start CPU profile: %w", err)
+		}
+	}
+
+	if traceFile != "" {
+		if tf, err = os.Create(traceFile); err != nil {
+			return nil, err
+		}
+		if err := trace.Start(tf); err != nil {
+			return nil, fmt.Errorf("couldn't start trace: %w", err)
+		}
+	}
+
+	return func() error {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuFile.Close(); err != nil {
+				return err
+			}
+		}
+
+		if tf != nil {
+			trace.Stop()
+			if err := tf.Close(); err != nil {
+				return err
+			}
+		}
+
+		if memProfile != "" {
+			f, err := os.Create(memProfile)
+			if err != nil {
+				return err
+			}
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				f.Close()
+				return fmt.Errorf("couldn't write memory profile: %w", err)
+			}
+			return f.Close()
+		}
+
+		return nil
+	}, nil
+}
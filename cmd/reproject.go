@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/paulmach/orb"
+)
+
+// reprojectTile warps a PNG or JPEG image that covers bound in EPSG:4326 to
+// web mercator, re-encoding it in the same format and bit depth. Longitude is
+// linear in both, so only rows move: each output row is interpolated between
+// the two source rows nearest its latitude. Like reshapeTile, it reports
+// whether the image is completely transparent.
+func reprojectTile(data []byte, bound orb.Bound) ([]byte, bool, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't decode image: %w", err)
+	}
+
+	if isTransparent(img) {
+		return nil, true, nil
+	}
+
+	src := toNRGBA64(img, img.Bounds())
+	out := image.NewNRGBA64(src.Rect)
+	height := float64(src.Rect.Dy())
+	minY, maxY := mercatorY(bound.Min.Y()), mercatorY(bound.Max.Y())
+	latHeight := bound.Max.Y() - bound.Min.Y()
+
+	for y := 0; y < src.Rect.Dy(); y++ {
+		// Find the latitude at the center of the output row, then the
+		// matching position among the source rows' centers.
+		lat := mercatorLatitude(maxY - (float64(y)+0.5)/height*(maxY-minY))
+		pos := (bound.Max.Y()-lat)/latHeight*height - 0.5
+		pos = math.Max(0, math.Min(height-1, pos))
+
+		above := int(pos)
+		below := above + 1
+		if below >= src.Rect.Dy() {
+			below = above
+		}
+		weight := pos - float64(above)
+
+		for x := 0; x < src.Rect.Dx(); x++ {
+			out.SetNRGBA64(x, y, lerpNRGBA64(src.NRGBA64At(x, above), src.NRGBA64At(x, below), weight))
+		}
+	}
+
+	encoded, err := encodeLike(out, img, format)
+	if err != nil {
+		return nil, false, err
+	}
+	return encoded, false, nil
+}
+
+// lerpNRGBA64 blends a toward b by weight, weighting colors by alpha like
+// downsample.
+func lerpNRGBA64(a, b color.NRGBA64, weight float64) color.NRGBA64 {
+	wa := (1 - weight) * float64(a.A)
+	wb := weight * float64(b.A)
+	alpha := wa + wb
+	if alpha == 0 {
+		return color.NRGBA64{}
+	}
+	mix := func(x, y uint16) uint16 {
+		return uint16(math.Round((float64(x)*wa + float64(y)*wb) / alpha))
+	}
+	return color.NRGBA64{
+		R: mix(a.R, b.R),
+		G: mix(a.G, b.G),
+		B: mix(a.B, b.B),
+		A: uint16(math.Round(alpha)),
+	}
+}
+
+// mercatorY returns the spherical mercator y of lat, in radians.
+func mercatorY(lat float64) float64 {
+	return math.Log(math.Tan(math.Pi/4 + lat*math.Pi/360))
+}
+
+// mercatorLatitude is the inverse of mercatorY.
+func mercatorLatitude(y float64) float64 {
+	return (2*math.Atan(math.Exp(y)) - math.Pi/2) * 180 / math.Pi
+}
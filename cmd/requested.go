@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// requestedTiles guards against requesting a tile twice in a run, like a
+// seed that's also the child of another seed. Seeds are kept for the whole
+// run, but other tiles only until they're finished, so its size is bounded
+// by the seeds and the tiles in flight.
+type requestedTiles struct {
+	mu    sync.Mutex
+	tiles map[maptile.Tile]bool
+	// duplicates counts the requests that were skipped.
+	duplicates int
+}
+
+func newRequestedTiles(seeds maptile.Set) *requestedTiles {
+	r := &requestedTiles{tiles: make(map[maptile.Tile]bool, len(seeds))}
+	for t := range seeds {
+		r.tiles[t] = true
+	}
+	return r
+}
+
+// add records a request for t, or returns false if it's already requested.
+func (r *requestedTiles) add(t maptile.Tile) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.tiles[t]; ok {
+		r.duplicates++
+		return false
+	}
+	r.tiles[t] = false
+	return true
+}
+
+// finish forgets t once it's been handled, unless it's a seed.
+func (r *requestedTiles) finish(t maptile.Tile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if seed, ok := r.tiles[t]; ok && !seed {
+		delete(r.tiles, t)
+	}
+}
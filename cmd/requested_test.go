@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// countingSource counts how many times each tile is fetched.
+type countingSource struct {
+	tilesource.Source
+	mu      sync.Mutex
+	fetches map[maptile.Tile]int
+}
+
+func (s *countingSource) FetchTile(ctx context.Context, t maptile.Tile) ([]byte, error) {
+	s.mu.Lock()
+	s.fetches[t]++
+	s.mu.Unlock()
+	return s.Source.FetchTile(ctx, t)
+}
+
+// TestSeedAndAncestorFetchedOnce crawls from a seed and one of its
+// descendants, which the seed's branch also reaches, and checks that no
+// tile is fetched twice.
+func TestSeedAndAncestorFetchedOnce(t *testing.T) {
+	for _, breadthFirst := range []bool{false, true} {
+		server := newFakeESRI(t)
+		source := &countingSource{Source: newFakeESRISource(server), fetches: map[maptile.Tile]int{}}
+
+		extent := orb.Bound{Min: orb.Point{-123.1, 49.0}, Max: orb.Point{-123.08, 49.01}}
+		ancestor := maptile.At(extent.Center(), 12)
+		descendant := maptile.At(extent.Center(), 14)
+		c := newCrawler(source, filepath.Join(t.TempDir(), "out.mbtiles"))
+		c.concurrency = 4
+		c.breadthFirst = breadthFirst
+		c.minZoom, c.maxZoom, c.seedZoom = 12, 14, 12
+		c.extent = &extent
+		c.bboxes = []orb.Bound{extent}
+		c.mbtiles = mbtilesOptions{name: "Fake", format: "png"}
+		c.run(context.Background(), maptile.Set{ancestor: true, descendant: true})
+
+		if source.fetches[ancestor] != 1 || source.fetches[descendant] != 1 {
+			t.Errorf("breadthFirst=%v: the seeds were fetched %d and %d times, want once each", breadthFirst, source.fetches[ancestor], source.fetches[descendant])
+		}
+		for tile, n := range source.fetches {
+			if n != 1 {
+				t.Errorf("breadthFirst=%v: %d/%d/%d was fetched %d times", breadthFirst, tile.Z, tile.X, tile.Y, n)
+			}
+		}
+		if c.requested.duplicates == 0 {
+			t.Errorf("breadthFirst=%v: the descendant seed was never reached from its ancestor", breadthFirst)
+		}
+	}
+}
+
+func TestRequestedTiles(t *testing.T) {
+	seed := maptile.New(1, 1, 2)
+	child := maptile.New(2, 2, 3)
+	r := newRequestedTiles(maptile.Set{seed: true})
+
+	if r.add(seed) {
+		t.Error("a seed was requested again")
+	}
+	if !r.add(child) {
+		t.Error("a new tile wasn't requested")
+	}
+	if r.add(child) {
+		t.Error("a tile in flight was requested again")
+	}
+
+	// Finished tiles are forgotten, but seeds aren't.
+	r.finish(child)
+	r.finish(seed)
+	if !r.add(child) {
+		t.Error("a finished tile wasn't forgotten")
+	}
+	if r.add(seed) {
+		t.Error("a finished seed was forgotten")
+	}
+	if r.duplicates != 3 {
+		t.Errorf("counted %d duplicates, want 3", r.duplicates)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// reshapeTile trims border pixels from each edge of a PNG or JPEG tile and
+// then shrinks it by factor, re-encoding it in the same format and bit
+// depth. Since a reshaped blank tile won't look like the blank tiles
+// isBlankTile knows about, it also reports whether the image is completely
+// transparent.
+func reshapeTile(data []byte, border, factor int) ([]byte, bool, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't decode image: %w", err)
+	}
+
+	if isTransparent(img) {
+		return nil, true, nil
+	}
+
+	b := img.Bounds()
+	r := image.Rect(b.Min.X+border, b.Min.Y+border, b.Max.X-border, b.Max.Y-border)
+	if r.Empty() {
+		return nil, false, fmt.Errorf("a %dx%d image is too small to crop %d pixels", b.Dx(), b.Dy(), border)
+	}
+
+	reshaped := toNRGBA64(img, r)
+	if factor > 1 {
+		reshaped = downsample(reshaped, factor)
+	}
+
+	encoded, err := encodeLike(reshaped, img, format)
+	if err != nil {
+		return nil, false, err
+	}
+	return encoded, false, nil
+}
+
+// downsample shrinks img by an integer factor, averaging each factor by
+// factor block of pixels. Colors are weighted by alpha so transparent
+// pixels don't darken the edges of the imagery.
+func downsample(img *image.NRGBA64, factor int) *image.NRGBA64 {
+	b := img.Bounds()
+	out := image.NewNRGBA64(image.Rect(0, 0, b.Dx()/factor, b.Dy()/factor))
+	n := uint64(factor * factor)
+
+	for y := 0; y < out.Rect.Dy(); y++ {
+		for x := 0; x < out.Rect.Dx(); x++ {
+			var r, g, bl, a uint64
+			for dy := 0; dy < factor; dy++ {
+				for dx := 0; dx < factor; dx++ {
+					c := img.NRGBA64At(b.Min.X+x*factor+dx, b.Min.Y+y*factor+dy)
+					r += uint64(c.R) * uint64(c.A)
+					g += uint64(c.G) * uint64(c.A)
+					bl += uint64(c.B) * uint64(c.A)
+					a += uint64(c.A)
+				}
+			}
+
+			if a == 0 {
+				continue
+			}
+			out.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(r / a),
+				G: uint16(g / a),
+				B: uint16(bl / a),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return out
+}
+
+// isTransparent reports whether every pixel of img is fully transparent.
+func isTransparent(img image.Image) bool {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// metersPerDegree is the length of a degree of longitude at the equator.
+const metersPerDegree = 2 * math.Pi * 6378137 / 360
+
+// resolutionZoom returns the web mercator zoom whose ground resolution at
+// lat is nearest metersPerPixel. It can be outside the zooms that are
+// crawled.
+func resolutionZoom(metersPerPixel, lat float64) int {
+	z := math.Round(math.Log2(tilesource.ResolutionAt(0, lat) / metersPerPixel))
+	return int(math.Max(z, 0))
+}
+
+// nativeZoom returns the coarsest web mercator zoom whose ground resolution
+// at lat is at least as fine as metersPerPixel, past which zooming in only
+// enlarges the service's pixels.
+func nativeZoom(metersPerPixel, lat float64) int {
+	z := math.Ceil(math.Log2(tilesource.ResolutionAt(0, lat) / metersPerPixel))
+	return int(math.Max(z, 0))
+}
+
+// nativeResolution returns the ground resolution at lat of a service's
+// imagery, in meters per pixel, from an ImageServer's pixel size or the
+// finest level of a tile cache, or 0 if the service doesn't say or its
+// units aren't meters or degrees.
+func nativeResolution(details *esriservice.ServiceDetails, lat float64) float64 {
+	if details == nil {
+		return 0
+	}
+
+	size, sr := details.PixelSizeX, details.SpatialReference
+	if size <= 0 && details.TileInfo != nil && len(details.TileInfo.LODs) > 0 {
+		lods := details.TileInfo.LODs
+		size, sr = lods[len(lods)-1].Resolution, details.TileInfo.SpatialReference
+	}
+	if size <= 0 {
+		return 0
+	}
+
+	// Web mercator meters are stretched by 1/cos(lat), while degrees of
+	// longitude shrink by cos(lat), so both end up scaled the same way.
+	scale := math.Cos(lat * math.Pi / 180)
+	switch {
+	case sr.IsWebMercator():
+		return size * scale
+	case sr.IsWGS84():
+		return size * metersPerDegree * scale
+	}
+	return 0
+}
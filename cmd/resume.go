@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"os"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// tileIndex answers whether a tile is already stored in the output, so a
+// resumed crawl can skip fetching it.
+type tileIndex interface {
+	has(t maptile.Tile) bool
+}
+
+// bloomFilter is a probabilistic set of tiles. It never misses a tile that
+// was added, but reports roughly 1% of other tiles as present too.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+// bloomBitsPerTile and bloomHashes give a false positive rate of about 1%.
+const (
+	bloomBitsPerTile = 10
+	bloomHashes      = 7
+)
+
+func newBloomFilter(n int) *bloomFilter {
+	words := (n*bloomBitsPerTile)/64 + 1
+	return &bloomFilter{
+		bits:   make([]uint64, words),
+		hashes: bloomHashes,
+	}
+}
+
+// locations returns the two halves of t's hash, which are combined to pick
+// each of the filter's bits.
+func (b *bloomFilter) locations(t maptile.Tile) (uint64, uint64) {
+	var buf [12]byte
+	binary.LittleEndian.PutUint32(buf[0:], uint32(t.Z))
+	binary.LittleEndian.PutUint32(buf[4:], t.X)
+	binary.LittleEndian.PutUint32(buf[8:], t.Y)
+
+	h := fnv.New64a()
+	h.Write(buf[:])
+	sum := h.Sum64()
+	return sum & math.MaxUint32, sum >> 32
+}
+
+func (b *bloomFilter) add(t maptile.Tile) {
+	h1, h2 := b.locations(t)
+	size := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % size
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) has(t maptile.Tile) bool {
+	h1, h2 := b.locations(t)
+	size := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % size
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// loadBloomIndex scans the tiles already in an mbtiles file into a bloom
+// filter, which takes about 10 bits of memory per tile.
+func loadBloomIndex(filename string) (tileIndex, error) {
+	db, err := openMBTiles(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tiles").Scan(&count); err != nil {
+		return nil, fmt.Errorf("couldn't count existing tiles: %w", err)
+	}
+
+	filter := newBloomFilter(count)
+	rows, err := db.Query("SELECT zoom_level, tile_column, tile_row FROM tiles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var z, x, y uint32
+		if err := rows.Scan(&z, &x, &y); err != nil {
+			return nil, err
+		}
+		filter.add(maptile.New(x, flipY(z, y), maptile.Zoom(z)))
+	}
+
+	log.Printf("Indexed %d existing tiles (%d KiB)", count, len(filter.bits)*8/1024)
+	return filter, rows.Err()
+}
+
+// sqliteIndex checks the output file itself for each tile, which is exact but
+// much slower than a bloomFilter.
+type sqliteIndex struct {
+	stmt *sql.Stmt
+}
+
+func openSQLiteIndex(filename string) (*sqliteIndex, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=5000", filename))
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := db.Prepare("SELECT 1 FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteIndex{stmt: stmt}, nil
+}
+
+func (s *sqliteIndex) has(t maptile.Tile) bool {
+	var found int
+	err := s.stmt.QueryRow(t.Z, t.X, flipY(uint32(t.Z), t.Y)).Scan(&found)
+	if err != nil && err != sql.ErrNoRows {
+		log.Fatalf("Couldn't check for existing tile: %+v", err)
+	}
+	return err == nil
+}
+
+// multiIndex checks several indexes, like those of each file of a split
+// output.
+type multiIndex []tileIndex
+
+func (m multiIndex) has(t maptile.Tile) bool {
+	for _, index := range m {
+		if index.has(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// readZoomTiles returns the XYZ tiles stored at zoom in an mbtiles file.
+func readZoomTiles(filename string, zoom maptile.Zoom) (maptile.Set, error) {
+	db, err := openMBTiles(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT tile_column, tile_row FROM tiles WHERE zoom_level = ?", zoom)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tiles := maptile.Set{}
+	for rows.Next() {
+		var x, y uint32
+		if err := rows.Scan(&x, &y); err != nil {
+			return nil, err
+		}
+		tiles[maptile.New(x, flipY(uint32(zoom), y), zoom)] = true
+	}
+	return tiles, rows.Err()
+}
+
+// frontierSeeds returns the tiles to restart a crawl from at zoom: the
+// children of the tiles the output already has at the zoom above, which
+// are the ones the crawl would have recursed into. If zoom is the first
+// stored zoom, or the output has nothing above it, it's seeded from the
+// extent instead.
+func (c *crawler) frontierSeeds(zoom maptile.Zoom, extent orb.Bound) (maptile.Set, error) {
+	if zoom <= c.minZoom {
+		return c.seedTiles(extent), nil
+	}
+
+	parents, err := readZoomTiles(c.output, zoom-1)
+	if err != nil {
+		return nil, err
+	}
+	if len(parents) == 0 {
+		log.Printf("No tiles at z%d to restart from, so seeding from the extent", zoom-1)
+		return c.seedTiles(extent), nil
+	}
+
+	seeds := maptile.Set{}
+	for parent := range parents {
+		for _, t := range c.grid.Children(parent) {
+			if c.inCoverage(t) {
+				seeds[t] = true
+			}
+		}
+	}
+	c.seedZoom = zoom
+	return seeds, nil
+}
+
+// deleteFromZoom deletes the tiles at zoom and deeper from an mbtiles file,
+// to crawl them again.
+func deleteFromZoom(filename string, opts mbtilesOptions, zoom maptile.Zoom) error {
+	w, err := createMBTiles(filename, opts)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := w.deleteFromZoom(zoom)
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleted %d tiles at z%d and deeper", deleted, zoom)
+
+	return w.close()
+}
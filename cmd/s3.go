@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3Store keeps files in an S3 bucket, or an S3-compatible one at
+// $AWS_ENDPOINT_URL, signing requests with the credentials in
+// $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY, and $AWS_SESSION_TOKEN.
+type s3Store struct {
+	// baseURL is the bucket's URL, and prefix the start of every key.
+	baseURL string
+	prefix  string
+	region  string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+func newS3Store(output string) (*s3Store, error) {
+	u, err := url.Parse(output)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s must be s3://bucket/prefix", output)
+	}
+
+	s := &s3Store{
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: time.Minute},
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("writing to S3 needs $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	// Other S3-compatible services are addressed by path.
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		s.baseURL = strings.TrimRight(endpoint, "/") + "/" + u.Host
+	} else {
+		s.baseURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", u.Host, s.region)
+	}
+
+	return s, nil
+}
+
+func (s *s3Store) url(key string) string {
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	return s.baseURL + "/" + key
+}
+
+func (s *s3Store) put(key string, data []byte, contentType string) error {
+	req, err := http.NewRequest("PUT", s.url(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.do(req, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("uploading %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (s *s3Store) has(key string) (bool, error) {
+	req, err := http.NewRequest("HEAD", s.url(key), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("checking for %s: %s", key, resp.Status)
+}
+
+// do signs req with AWS Signature Version 4 and sends it.
+func (s *s3Store) do(req *http.Request, body []byte) (*http.Response, error) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.sessionToken != "" {
+		signed = append(signed, "x-amz-security-token")
+	}
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", req.Header.Get("X-Amz-Date"), scope, sha256Hex([]byte(canonical))}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+
+	return s.client.Do(req)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
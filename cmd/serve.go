@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// tileServer serves z/x/y tiles from an mbtiles file while the crawl writes
+// it. Tiles show up once the batch they were written in is committed, and
+// ones that haven't been are 404s, as are all tiles until the file exists.
+type tileServer struct {
+	filename string
+	db       *sql.DB
+}
+
+func newTileServer(filename string, busyTimeout time.Duration) (*tileServer, error) {
+	// Opening is lazy, so this works before the crawl creates the file.
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=%d", filename, busyTimeout.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+	return &tileServer{filename: filename, db: db}, nil
+}
+
+func (s *tileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Accept an extension, like 12/654/1583.png, since clients expect one.
+	value := strings.TrimPrefix(r.URL.Path, "/")
+	value = strings.TrimSuffix(value, path.Ext(value))
+	t, err := parseTile(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := os.Stat(s.filename); os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var data []byte
+	err = s.db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		t.Z, t.X, flipY(uint32(t.Z), t.Y)).Scan(&data)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Couldn't read tile %s to serve: %+v", value, err)
+		http.Error(w, "couldn't read tile", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType(detectFormat(data)))
+	w.Write(data)
+}
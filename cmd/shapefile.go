@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
+)
+
+const (
+	shapeNull     = 0
+	shapePolygon  = 5
+	shapePolygonZ = 15
+	shapePolygonM = 25
+)
+
+// readShapefile reads the polygons in an ESRI shapefile, reprojecting them to
+// EPSG:4326 based on the .prj file next to it. Only geographic and web
+// mercator projections are understood.
+func readShapefile(filename string) (orb.MultiPolygon, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 100 || binary.BigEndian.Uint32(data[0:4]) != 9994 {
+		return nil, fmt.Errorf("%s is not a shapefile", filename)
+	}
+
+	proj, err := shapefileProjection(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var polygons orb.MultiPolygon
+	r := bytes.NewReader(data[100:])
+	for r.Len() > 0 {
+		var header struct {
+			Number int32
+			Length int32
+		}
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+			return nil, fmt.Errorf("couldn't read record header: %w", err)
+		}
+
+		content := make([]byte, 2*int(header.Length))
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, fmt.Errorf("couldn't read record %d: %w", header.Number, err)
+		}
+
+		shapeType := binary.LittleEndian.Uint32(content[0:4])
+		switch shapeType {
+		case shapeNull:
+			continue
+		case shapePolygon, shapePolygonZ, shapePolygonM:
+		default:
+			return nil, fmt.Errorf("record %d has unsupported shape type %d, only polygons can be used", header.Number, shapeType)
+		}
+
+		p, err := readShapefilePolygon(content, proj)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read record %d: %w", header.Number, err)
+		}
+		polygons = append(polygons, p...)
+	}
+
+	return polygons, nil
+}
+
+// readShapefilePolygon reads a polygon record's rings. Shapefiles store outer
+// rings clockwise and holes counterclockwise, each hole following its outer
+// ring.
+func readShapefilePolygon(content []byte, proj orb.Projection) (orb.MultiPolygon, error) {
+	if len(content) < 44 {
+		return nil, fmt.Errorf("polygon record too short")
+	}
+
+	numParts := int(binary.LittleEndian.Uint32(content[36:40]))
+	numPoints := int(binary.LittleEndian.Uint32(content[40:44]))
+	partsStart := 44
+	pointsStart := partsStart + 4*numParts
+	if len(content) < pointsStart+16*numPoints {
+		return nil, fmt.Errorf("polygon record too short for %d points", numPoints)
+	}
+
+	var polygons orb.MultiPolygon
+	for i := 0; i < numParts; i++ {
+		start := int(binary.LittleEndian.Uint32(content[partsStart+4*i:]))
+		end := numPoints
+		if i+1 < numParts {
+			end = int(binary.LittleEndian.Uint32(content[partsStart+4*(i+1):]))
+		}
+
+		ring := make(orb.Ring, 0, end-start)
+		for j := start; j < end; j++ {
+			offset := pointsStart + 16*j
+			p := orb.Point{
+				math.Float64frombits(binary.LittleEndian.Uint64(content[offset:])),
+				math.Float64frombits(binary.LittleEndian.Uint64(content[offset+8:])),
+			}
+			if proj != nil {
+				p = proj(p)
+			}
+			ring = append(ring, p)
+		}
+
+		if ring.Orientation() == orb.CW || len(polygons) == 0 {
+			polygons = append(polygons, orb.Polygon{ring})
+		} else {
+			polygons[len(polygons)-1] = append(polygons[len(polygons)-1], ring)
+		}
+	}
+
+	return polygons, nil
+}
+
+// shapefileProjection returns the projection from a shapefile's coordinates
+// to EPSG:4326, or nil if they're already geographic.
+func shapefileProjection(filename string) (orb.Projection, error) {
+	prj, err := ioutil.ReadFile(strings.TrimSuffix(filename, ".shp") + ".prj")
+	if os.IsNotExist(err) {
+		// Without a .prj there's nothing to go on, so assume lon/lat.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	wkt := string(prj)
+	switch {
+	case strings.HasPrefix(wkt, "GEOGCS"):
+		return nil, nil
+	case strings.Contains(wkt, "Mercator_Auxiliary_Sphere"), strings.Contains(wkt, "Web_Mercator"), strings.Contains(wkt, "Pseudo-Mercator"), strings.Contains(wkt, "Pseudo_Mercator"):
+		return project.Mercator.ToWGS84, nil
+	}
+
+	return nil, fmt.Errorf("unsupported shapefile projection, reproject it to EPSG:4326 first: %s", wkt)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// shard is one of count disjoint parts of a crawl, for running it in
+// several processes or on several machines and merging their outputs.
+// Seeds are divided between shards, and each crawls everything beneath its
+// own, so a finer --seed-zoom divides the work more evenly.
+type shard struct {
+	index, count uint32
+}
+
+// parseShard parses a shard like 2/4, numbered from 1.
+func parseShard(value string) (*shard, error) {
+	var i, n uint32
+	if _, err := fmt.Sscanf(value, "%d/%d", &i, &n); err != nil {
+		return nil, fmt.Errorf("shard %q must be i/n: %w", value, err)
+	}
+	if n == 0 || i == 0 || i > n {
+		return nil, fmt.Errorf("shard %q must be between 1/n and n/n", value)
+	}
+	return &shard{index: i - 1, count: n}, nil
+}
+
+// has reports whether t is in the shard. Tiles are assigned by a hash of
+// their coordinates, so every process agrees without coordinating.
+func (s *shard) has(t maptile.Tile) bool {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d/%d/%d", t.Z, t.X, t.Y)
+	return h.Sum32()%s.count == s.index
+}
+
+// filter returns the tiles in the shard.
+func (s *shard) filter(tiles maptile.Set) maptile.Set {
+	mine := maptile.Set{}
+	for t := range tiles {
+		if s.has(t) {
+			mine[t] = true
+		}
+	}
+	return mine
+}
@@ -0,0 +1,44 @@
+//go:build simulate
+// +build simulate
+
+package main
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"net/http"
+
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// The error simulation flag only exists in builds with the simulate tag, so
+// it can't affect real crawls:
+//
+//	go build -tags simulate ./cmd
+var simulateErrorRate = flag.Float64("simulate-error-rate", 0, "Fail this fraction of tile fetches with a 503, for testing retries")
+
+// wrapSource makes source flaky if --simulate-error-rate is set.
+func wrapSource(source tilesource.Source) tilesource.Source {
+	if *simulateErrorRate <= 0 {
+		return source
+	}
+	return &flakySource{source: source, rate: *simulateErrorRate}
+}
+
+// flakySource fails a random fraction of fetches with the same error a
+// service that's overloaded would return.
+type flakySource struct {
+	source tilesource.Source
+	rate   float64
+}
+
+func (f *flakySource) FetchTile(ctx context.Context, t maptile.Tile) ([]byte, error) {
+	if rand.Float64() < f.rate {
+		return nil, &esriservice.HTTPError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable (simulated)"}
+	}
+	return f.source.FetchTile(ctx, t)
+}
@@ -0,0 +1,11 @@
+//go:build !simulate
+// +build !simulate
+
+package main
+
+import "github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+
+// wrapSource returns source as-is outside of simulate builds.
+func wrapSource(source tilesource.Source) tilesource.Source {
+	return source
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// zoomRange is an inclusive range of zoom levels.
+type zoomRange struct {
+	min maptile.Zoom
+	max maptile.Zoom
+}
+
+// splitZoomRanges divides minZoom through maxZoom into ranges that each start
+// at minZoom or one of splits.
+func splitZoomRanges(minZoom, maxZoom maptile.Zoom, splits []maptile.Zoom) []zoomRange {
+	sorted := append([]maptile.Zoom{}, splits...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var ranges []zoomRange
+	start := minZoom
+	for _, split := range sorted {
+		if split <= start || split > maxZoom {
+			continue
+		}
+		ranges = append(ranges, zoomRange{start, split - 1})
+		start = split
+	}
+	return append(ranges, zoomRange{start, maxZoom})
+}
+
+// splitFilename returns the file for the zooms in r, like out-z12-16.mbtiles
+// for out.mbtiles.
+func splitFilename(output string, r zoomRange) string {
+	ext := filepath.Ext(output)
+	return fmt.Sprintf("%s-z%d-%d%s", strings.TrimSuffix(output, ext), r.min, r.max, ext)
+}
+
+// tileOutput is where the crawler writes tiles.
+type tileOutput interface {
+	put(t maptile.Tile, data []byte) error
+	setMetadata(name, value string) error
+	markZoomComplete(zoom maptile.Zoom) error
+	close() error
+}
+
+// splitWriter writes tiles to one of several mbtiles files depending on their
+// zoom level.
+type splitWriter struct {
+	ranges  []zoomRange
+	writers []*tileWriter
+}
+
+func createSplitMBTiles(output string, opts mbtilesOptions, ranges []zoomRange) (*splitWriter, error) {
+	s := &splitWriter{ranges: ranges}
+	for _, r := range ranges {
+		rangeOpts := opts
+		rangeOpts.minZoom, rangeOpts.maxZoom = r.min, r.max
+
+		w, err := createMBTiles(splitFilename(output, r), rangeOpts)
+		if err != nil {
+			return nil, err
+		}
+		s.writers = append(s.writers, w)
+	}
+	return s, nil
+}
+
+func (s *splitWriter) writerFor(zoom maptile.Zoom) (*tileWriter, error) {
+	for i, r := range s.ranges {
+		if zoom >= r.min && zoom <= r.max {
+			return s.writers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no output for z%d", zoom)
+}
+
+func (s *splitWriter) put(t maptile.Tile, data []byte) error {
+	w, err := s.writerFor(t.Z)
+	if err != nil {
+		return err
+	}
+	return w.put(t, data)
+}
+
+func (s *splitWriter) setMetadata(name, value string) error {
+	for _, w := range s.writers {
+		if err := w.setMetadata(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *splitWriter) markZoomComplete(zoom maptile.Zoom) error {
+	w, err := s.writerFor(zoom)
+	if err != nil {
+		return err
+	}
+	return w.markZoomComplete(zoom)
+}
+
+func (s *splitWriter) close() error {
+	for _, w := range s.writers {
+		if err := w.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
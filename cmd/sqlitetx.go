@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// busyRetries is how many more times a statement that failed because
+// another process had the database locked is tried, after SQLite's own busy
+// timeout.
+const busyRetries = 3
+
+// sqliteTx is a write transaction on a single connection. Unlike sql.Tx, a
+// COMMIT that fails because a reader has the file locked can be retried,
+// since SQLite keeps the transaction open when that happens. It's begun
+// IMMEDIATE, so the write lock is taken up front rather than partway
+// through a batch.
+type sqliteTx struct {
+	conn *sql.Conn
+}
+
+func beginImmediate(db *sql.DB) (*sqliteTx, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &sqliteTx{conn: conn}
+	if _, err := tx.Exec("BEGIN IMMEDIATE"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (tx *sqliteTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := retryBusy(func() (err error) {
+		result, err = tx.conn.ExecContext(context.Background(), query, args...)
+		return err
+	})
+	return result, err
+}
+
+func (tx *sqliteTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *sqliteTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+func (tx *sqliteTx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.conn.PrepareContext(context.Background(), query)
+}
+
+// Commit commits the transaction and releases its connection.
+func (tx *sqliteTx) Commit() error {
+	if _, err := tx.Exec("COMMIT"); err != nil {
+		return err
+	}
+	return tx.conn.Close()
+}
+
+// retryBusy calls f until it doesn't fail because the database is locked,
+// up to busyRetries more times.
+func retryBusy(f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if !isBusy(err) || attempt == busyRetries {
+			return err
+		}
+		log.Printf("Database is busy, retrying: %v", err)
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+// execBusy executes stmt, retrying if the database is locked.
+func execBusy(stmt *sql.Stmt, args ...interface{}) error {
+	return retryBusy(func() error {
+		_, err := stmt.Exec(args...)
+		return err
+	})
+}
+
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// isDiskFull reports whether err is from running out of disk space, either
+// in SQLite or writing a file.
+func isDiskFull(err error) bool {
+	var sqliteErr sqlite3.Error
+	return (errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrFull) || errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// throttleErrorRate is the smoothed fraction of failing requests above
+	// which a failure halves the request rate, and below which it's raised
+	// again.
+	throttleErrorRate = 0.1
+	// throttleMinRate is the slowest the throttle will go, in requests per
+	// second.
+	throttleMinRate = 0.5
+)
+
+// errorThrottle spaces out requests across all workers once the service
+// starts failing. It doesn't limit anything until the smoothed error rate
+// climbs, then starts at half the rate requests were completing at, halves
+// it at most once a second while requests keep failing, and adds a request
+// per second each second the error rate stays low, until it's back to where
+// it started.
+type errorThrottle struct {
+	mu sync.Mutex
+	// rate is the allowed requests per second, or 0 for no limit, and
+	// ceiling the rate requests were completing at when it started.
+	rate    float64
+	ceiling float64
+	// next is when the next request may start.
+	next time.Time
+
+	// errorRate is the smoothed fraction of requests that failed.
+	errorRate float64
+	// completed counts requests since windowStart, to measure throughput.
+	completed   int
+	windowStart time.Time
+	throughput  float64
+	adjusted    time.Time
+}
+
+func newErrorThrottle() *errorThrottle {
+	return &errorThrottle{windowStart: time.Now()}
+}
+
+// wait blocks until another request may start.
+func (t *errorThrottle) wait() {
+	t.mu.Lock()
+	if t.rate == 0 {
+		t.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	start := t.next
+	t.next = t.next.Add(time.Duration(float64(time.Second) / t.rate))
+	t.mu.Unlock()
+
+	time.Sleep(time.Until(start))
+}
+
+// record records whether a request failed.
+func (t *errorThrottle) record(failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sample := 0.0
+	if failed {
+		sample = 1
+	}
+	// Smooth over about the last ten requests, so that recovering doesn't
+	// take long once the rate is low.
+	t.errorRate = t.errorRate*0.9 + sample*0.1
+
+	now := time.Now()
+	t.completed++
+	if elapsed := now.Sub(t.windowStart); elapsed >= time.Second {
+		t.throughput = float64(t.completed) / elapsed.Seconds()
+		t.completed = 0
+		t.windowStart = now
+	}
+
+	if now.Sub(t.adjusted) < time.Second {
+		return
+	}
+
+	switch {
+	case failed && t.errorRate > throttleErrorRate:
+		if t.rate == 0 {
+			t.ceiling = t.throughput
+			t.rate = t.throughput
+		}
+		t.rate /= 2
+		if t.rate < throttleMinRate {
+			t.rate = throttleMinRate
+		}
+		t.adjusted = now
+		log.Printf("Throttling to %.1f requests/s after %.0f%% of recent requests failed", t.rate, t.errorRate*100)
+	case t.rate > 0 && t.errorRate < throttleErrorRate:
+		t.rate++
+		t.adjusted = now
+		if t.rate >= t.ceiling {
+			t.rate = 0
+			log.Printf("Stopped throttling requests")
+		}
+	}
+}
+
+// current returns the allowed requests per second, or 0 if requests aren't
+// being throttled.
+func (t *errorThrottle) current() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rate
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// thumbnailSize is the longest side of a --thumbnail image.
+const thumbnailSize = 512
+
+// writeThumbnail saves a web mercator image of the whole extent, at most
+// thumbnailSize pixels on a side and within the service's maximum image
+// size, as a PNG, or a JPEG if filename ends in .jpg or .jpeg.
+func writeThumbnail(ctx context.Context, client *esriservice.EsriService, details *esriservice.ServiceDetails, extent orb.Bound, filename string, timeout time.Duration) error {
+	m := project.Bound(extent, project.WGS84.ToMercator)
+	width, height := thumbnailSize, thumbnailSize
+	if aspect := (m.Max.X() - m.Min.X()) / (m.Max.Y() - m.Min.Y()); aspect > 1 {
+		height = int(float64(width) / aspect)
+	} else {
+		width = int(float64(height) * aspect)
+	}
+	if details.MaxImageWidth > 0 && width > details.MaxImageWidth {
+		height = height * details.MaxImageWidth / width
+		width = details.MaxImageWidth
+	}
+	if details.MaxImageHeight > 0 && height > details.MaxImageHeight {
+		width = width * details.MaxImageHeight / height
+		height = details.MaxImageHeight
+	}
+
+	format := "png"
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg":
+		format = "jpg"
+	}
+
+	input := &esriservice.ExportImageInput{
+		ImageSR: esriservice.SpatialReferenceType{Wkid: 3857},
+		BoundingBox: esriservice.ExtentType{
+			XMin:             extent.Min.X(),
+			YMin:             extent.Min.Y(),
+			XMax:             extent.Max.X(),
+			YMax:             extent.Max.Y(),
+			SpatialReference: esriservice.SpatialReferenceType{Wkid: 4326},
+		},
+		Size:      esriservice.RectType{Width: width, Height: height},
+		Format:    format,
+		PixelType: "u8",
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := client.ExportImage(ctx, input)
+	if err != nil {
+		return err
+	}
+	data, err := client.GetImage(ctx, resp.Href)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// tileJSON is a TileJSON 3.0.0 document describing a raster tileset.
+type tileJSON struct {
+	TileJSON    string    `json:"tilejson"`
+	Name        string    `json:"name,omitempty"`
+	Attribution string    `json:"attribution,omitempty"`
+	Scheme      string    `json:"scheme"`
+	Tiles       []string  `json:"tiles"`
+	MinZoom     int       `json:"minzoom"`
+	MaxZoom     int       `json:"maxzoom"`
+	Bounds      []float64 `json:"bounds,omitempty"`
+	Center      []float64 `json:"center,omitempty"`
+	Format      string    `json:"format,omitempty"`
+}
+
+// writeTileJSON writes a TileJSON document for the tiles at tilesURL, with
+// the same name, bounds, and so on as the metadata opts writes.
+func writeTileJSON(filename, tilesURL string, opts mbtilesOptions) error {
+	doc := tileJSON{
+		TileJSON: "3.0.0",
+		Scheme:   "xyz",
+		Tiles:    []string{tilesURL},
+	}
+
+	for _, m := range opts.metadata() {
+		switch m.name {
+		case "name":
+			doc.Name = m.value
+		case "attribution":
+			doc.Attribution = m.value
+		case "format":
+			doc.Format = m.value
+		case "minzoom":
+			doc.MinZoom, _ = strconv.Atoi(m.value)
+		case "maxzoom":
+			doc.MaxZoom, _ = strconv.Atoi(m.value)
+		case "bounds":
+			doc.Bounds = parseFloats(m.value)
+		case "center":
+			doc.Center = parseFloats(m.value)
+		}
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// parseFloats parses a comma-separated list of numbers from a metadata row.
+func parseFloats(value string) []float64 {
+	var floats []float64
+	for _, part := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil
+		}
+		floats = append(floats, f)
+	}
+	return floats
+}
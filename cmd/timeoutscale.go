@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// zoomScale is a factor that goes from atMin at minZoom to atMax at maxZoom,
+// changing by the same ratio at each zoom in between, so a scale from 4 to
+// 0.25 is 1 halfway. Zooms outside the range get the factor at its nearest
+// end.
+type zoomScale struct {
+	minZoom, maxZoom maptile.Zoom
+	atMin, atMax     float64
+}
+
+// parseZoomScale parses a --tile-timeout-scale value, the factors at minZoom
+// and maxZoom separated by a comma, like 4,0.5.
+func parseZoomScale(value string, minZoom, maxZoom maptile.Zoom) (*zoomScale, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%q must be two factors, like 4,0.5", value)
+	}
+
+	s := &zoomScale{minZoom: minZoom, maxZoom: maxZoom}
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || f <= 0 {
+			return nil, fmt.Errorf("invalid factor %q, which must be a positive number", part)
+		}
+		if i == 0 {
+			s.atMin = f
+		} else {
+			s.atMax = f
+		}
+	}
+	return s, nil
+}
+
+func (s *zoomScale) at(z maptile.Zoom) float64 {
+	switch {
+	case z <= s.minZoom || s.minZoom == s.maxZoom:
+		return s.atMin
+	case z >= s.maxZoom:
+		return s.atMax
+	}
+	t := float64(z-s.minZoom) / float64(s.maxZoom-s.minZoom)
+	return s.atMin * math.Pow(s.atMax/s.atMin, t)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// blobStore is somewhere a tileTree can keep files by key, like a local
+// directory or an S3 bucket.
+type blobStore interface {
+	put(key string, data []byte, contentType string) error
+	has(key string) (bool, error)
+}
+
+// newBlobStore returns an S3 store for s3://bucket/prefix outputs, and a
+// directory store for anything else.
+func newBlobStore(output string) (blobStore, error) {
+	if strings.HasPrefix(output, "s3://") {
+		return newS3Store(output)
+	}
+	return dirStore(output), nil
+}
+
+// dirStore keeps files under a local directory.
+type dirStore string
+
+func (d dirStore) put(key string, data []byte, contentType string) error {
+	filename := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+func (d dirStore) has(key string) (bool, error) {
+	_, err := os.Stat(filepath.Join(string(d), filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// tileTree writes each tile to its own z/x/y file, with XYZ rows and an
+// extension for its format, and the metadata to metadata.json.
+type tileTree struct {
+	store blobStore
+	// format is the extension has looks for.
+	format string
+	// viewers are each written to their name.html when the tree is closed.
+	viewers []string
+
+	mu       sync.Mutex
+	metadata map[string]string
+}
+
+func createTileTree(output string, opts mbtilesOptions) (*tileTree, error) {
+	store, err := newBlobStore(output)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tileTree{store: store, viewers: opts.viewers, metadata: map[string]string{}}
+	for _, m := range opts.metadata() {
+		// Rows are stored as XYZ, not TMS.
+		if m.name != "scheme" {
+			t.metadata[m.name] = m.value
+		}
+	}
+	t.format = t.metadata["format"]
+	return t, t.writeMetadata()
+}
+
+func tileKey(t maptile.Tile, format string) string {
+	return fmt.Sprintf("%d/%d/%d.%s", t.Z, t.X, t.Y, format)
+}
+
+func (t *tileTree) put(tile maptile.Tile, data []byte) error {
+	format := detectFormat(data)
+	return t.store.put(tileKey(tile, format), data, contentType(format))
+}
+
+// has reports whether a tile of the tree's format is stored, so the tree can
+// be used to resume.
+func (t *tileTree) has(tile maptile.Tile) bool {
+	ok, err := t.store.has(tileKey(tile, t.format))
+	return ok && err == nil
+}
+
+func (t *tileTree) setMetadata(name, value string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.metadata[name] = value
+	return nil
+}
+
+// markZoomComplete saves the metadata so far, since the tiles are already
+// saved as they're written.
+func (t *tileTree) markZoomComplete(zoom maptile.Zoom) error {
+	return t.writeMetadata()
+}
+
+func (t *tileTree) close() error {
+	if err := t.writeMetadata(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, name := range t.viewers {
+		data, err := renderViewer(name, t.metadata)
+		if err != nil {
+			return fmt.Errorf("couldn't render %s viewer: %w", name, err)
+		}
+		if err := t.store.put(name+".html", data, "text/html"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tileTree) writeMetadata() error {
+	t.mu.Lock()
+	data, err := json.MarshalIndent(t.metadata, "", "  ")
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return t.store.put("metadata.json", data, "application/json")
+}
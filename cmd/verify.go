@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// maxReported limits how many problems or tiles of each kind verify and
+// compare print.
+const maxReported = 10
+
+// runVerify implements the verify subcommand, which checks that an mbtiles
+// file is complete and readable: the required metadata is there and agrees
+// with the tiles, every tile is on the grid and inside the bounds (which
+// catches rows that weren't flipped to TMS), every tile decodes, and the
+// tiles match the manifest the crawler kept as it committed them.
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	expectTiles := flags.Int("tiles", -1, "Fail unless the file has exactly this many tiles")
+	decode := flags.Bool("decode", true, "Decode every PNG, JPEG and GIF tile")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify [--tiles n] file.mbtiles\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := openMBTiles(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Couldn't open database: %+v", err)
+	}
+	defer db.Close()
+
+	metadata, err := readMetadata(db)
+	if err != nil {
+		log.Fatalf("Couldn't read metadata: %+v", err)
+	}
+
+	problems := 0
+	problem := func(format string, args ...interface{}) {
+		problems++
+		if problems <= maxReported {
+			fmt.Printf(format+"\n", args...)
+		} else if problems == maxReported+1 {
+			fmt.Println("...")
+		}
+	}
+
+	values := map[string]string{}
+	for _, m := range metadata {
+		values[m.name] = m.value
+	}
+	for _, name := range []string{"name", "format", "minzoom", "maxzoom"} {
+		if values[name] == "" {
+			problem("Metadata is missing %s", name)
+		}
+	}
+
+	grid := metadataGrid(metadata)
+	bounds := metadataBounds(metadata)
+
+	var count, minZoom, maxZoom int
+	if err := db.QueryRow("SELECT COUNT(*), IFNULL(MIN(zoom_level), -1), IFNULL(MAX(zoom_level), -1) FROM tiles").
+		Scan(&count, &minZoom, &maxZoom); err != nil {
+		log.Fatalf("Couldn't count tiles: %+v", err)
+	}
+	if *expectTiles >= 0 && count != *expectTiles {
+		problem("Found %d tiles, expected %d", count, *expectTiles)
+	}
+	for name, z := range map[string]int{"minzoom": minZoom, "maxzoom": maxZoom} {
+		if v, ok := values[name]; ok && count > 0 && v != strconv.Itoa(z) {
+			problem("Metadata has %s %s but the tiles go to %d", name, v, z)
+		}
+	}
+
+	manifest, err := readManifest(db)
+	if err != nil {
+		log.Fatalf("Couldn't read manifest: %+v", err)
+	}
+	found := &tileManifest{}
+
+	rows, err := db.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles")
+	if err != nil {
+		log.Fatalf("Couldn't query tiles: %+v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var z, x, row uint32
+		var data []byte
+		if err := rows.Scan(&z, &x, &row, &data); err != nil {
+			log.Fatalf("Couldn't read tile: %+v", err)
+		}
+		found.add(maptile.Zoom(z), x, row, data)
+
+		if row >= 1<<z {
+			problem("Tile %d/%d (TMS row %d) is out of range for its zoom", z, x, row)
+			continue
+		}
+		t := maptile.New(x, flipY(z, row), maptile.Zoom(z))
+		if !grid.Valid(t) {
+			problem("Tile %d/%d/%d is out of range for its zoom", t.Z, t.X, t.Y)
+			continue
+		}
+		// Tiles are only required to be inside the bounds at the
+		// minimum zoom, since children of an edge tile can fall outside.
+		if bounds != nil && !tilesource.BoundsOverlap(*bounds, grid.Bound(ancestor(t, maptile.Zoom(minZoom)))) {
+			problem("Tile %d/%d/%d is outside the bounds, so its row may not be flipped to TMS", t.Z, t.X, t.Y)
+		}
+
+		switch format := detectFormat(data); format {
+		case "png", "jpg", "gif":
+			if !*decode {
+				break
+			}
+			if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+				problem("Tile %d/%d/%d doesn't decode as %s: %v", t.Z, t.X, t.Y, format, err)
+			}
+		case "unknown":
+			problem("Tile %d/%d/%d isn't in a recognized format", t.Z, t.X, t.Y)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Couldn't read tiles: %+v", err)
+	}
+
+	if manifest != nil && *manifest != *found {
+		problem("The tiles don't match the manifest of %d tiles with hash %s, since the file has %d tiles with hash %s",
+			manifest.count, manifest.hashString(), found.count, found.hashString())
+	}
+
+	fmt.Printf("%d tiles from z%d to z%d, %d problems\n", count, minZoom, maxZoom, problems)
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
+
+// ancestor returns the tile at zoom z that contains t, or t if it's already
+// at or above z.
+func ancestor(t maptile.Tile, z maptile.Zoom) maptile.Tile {
+	if t.Z <= z {
+		return t
+	}
+	shift := t.Z - z
+	return maptile.New(t.X>>shift, t.Y>>shift, z)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=...
+// -X main.date=...", which is what goreleaser sets by default.
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// versionString describes the build, like "1.2.0 (abc1234, built 2021-11-02)".
+func versionString() string {
+	return fmt.Sprintf("%s (%s, built %s)", version, commit, date)
+}
+
+// defaultUserAgent is the User-Agent sent without --user-agent, which names
+// the program and its version.
+func defaultUserAgent() string {
+	return "imageservice-to-mbtiles/" + version
+}
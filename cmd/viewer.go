@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strconv"
+)
+
+// viewerTemplates are single page previews of a tile tree, like the ones
+// gdal2tiles writes, that load the tiles relative to the page, so the tree
+// can be opened from a static host as it is.
+var viewerTemplates = map[string]*template.Template{
+	"leaflet": template.Must(template.New("leaflet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="stylesheet" href="https://unpkg.com/leaflet@1.9.4/dist/leaflet.css">
+<script src="https://unpkg.com/leaflet@1.9.4/dist/leaflet.js"></script>
+<style>html, body, #map { height: 100%; margin: 0; }</style>
+</head>
+<body>
+<div id="map"></div>
+<script>
+var map = L.map('map', {minZoom: {{.MinZoom}}});
+L.tileLayer({{.URL}}, {
+  maxNativeZoom: {{.MaxZoom}},
+  maxZoom: {{.ViewMaxZoom}},
+  attribution: {{.Attribution}}
+}).addTo(map);
+map.fitBounds([[{{.South}}, {{.West}}], [{{.North}}, {{.East}}]]);
+</script>
+</body>
+</html>
+`)),
+	"openlayers": template.Must(template.New("openlayers").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/ol@v9.2.4/ol.css">
+<script src="https://cdn.jsdelivr.net/npm/ol@v9.2.4/dist/ol.js"></script>
+<style>html, body, #map { height: 100%; margin: 0; }</style>
+</head>
+<body>
+<div id="map"></div>
+<script>
+var map = new ol.Map({
+  target: 'map',
+  layers: [new ol.layer.Tile({
+    source: new ol.source.XYZ({
+      url: {{.URL}},
+      maxZoom: {{.MaxZoom}},
+      attributions: {{.Attribution}}
+    })
+  })],
+  view: new ol.View({minZoom: {{.MinZoom}}, maxZoom: {{.ViewMaxZoom}}})
+});
+map.getView().fit(ol.proj.transformExtent([{{.West}}, {{.South}}, {{.East}}, {{.North}}], 'EPSG:4326', 'EPSG:3857'));
+</script>
+</body>
+</html>
+`)),
+}
+
+// checkViewer returns an error if there's no viewer named name.
+func checkViewer(name string) error {
+	if _, ok := viewerTemplates[name]; !ok {
+		return fmt.Errorf("unknown viewer %q, expected leaflet or openlayers", name)
+	}
+	return nil
+}
+
+// renderViewer renders the named viewer for a tile tree with metadata, as
+// written to its metadata.json.
+func renderViewer(name string, metadata map[string]string) ([]byte, error) {
+	b, err := parseBound(metadata["bounds"])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read bounds: %w", err)
+	}
+	minZoom, err := strconv.Atoi(metadata["minzoom"])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read minzoom: %w", err)
+	}
+	maxZoom, err := strconv.Atoi(metadata["maxzoom"])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read maxzoom: %w", err)
+	}
+
+	data := struct {
+		Name, URL, Attribution string
+		// ViewMaxZoom lets the map zoom in a little past the tiles.
+		MinZoom, MaxZoom, ViewMaxZoom int
+		West, South, East, North      float64
+	}{
+		Name:        metadata["name"],
+		URL:         "{z}/{x}/{y}." + metadata["format"],
+		Attribution: metadata["attribution"],
+		MinZoom:     minZoom,
+		MaxZoom:     maxZoom,
+		ViewMaxZoom: maxZoom + 2,
+		West:        b.Min.X(),
+		South:       b.Min.Y(),
+		East:        b.Max.X(),
+		North:       b.Max.Y(),
+	}
+
+	var buf bytes.Buffer
+	if err := viewerTemplates[name].Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
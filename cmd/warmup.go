@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/tilesource"
+)
+
+// warmUp fetches and discards every tile at zoom that covers extent and
+// clip, a few at a time, so a service that renders on demand has its caches
+// primed before the crawl. It returns how many tiles were fetched, how many
+// failed, and their mean latency.
+func warmUp(ctx context.Context, source tilesource.Source, grid tilesource.Grid, extent orb.Bound, clip orb.Geometry, zoom maptile.Zoom, concurrency int, timeout time.Duration) (fetched, failed int, mean time.Duration) {
+	tiles := tilesource.PlanTiles(ctx, grid, extent, zoom, zoom, clip)
+
+	var mu sync.Mutex
+	var total time.Duration
+	wg := &sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tiles {
+				start := time.Now()
+				_, err := fetchTileWithTimeout(ctx, source, t, timeout)
+				elapsed := time.Since(start)
+
+				mu.Lock()
+				fetched++
+				total += elapsed
+				if err != nil {
+					failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fetched > 0 {
+		mean = total / time.Duration(fetched)
+	}
+	return fetched, failed, mean
+}
@@ -3,32 +3,301 @@ package esriservice
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
 )
 
+const maxRedirects = 10
+
+// maxGETParamsLength is the longest exportImage query string sent with GET.
+// Longer ones are POSTed, since servers and proxies often limit URLs to
+// around 2-8 KB.
+const maxGETParamsLength = 2000
+
+// modulePath is the module this package is in, whose version goes in
+// DefaultUserAgent.
+const modulePath = "github.com/iandees/imageservice-to-mbtiles"
+
+// DefaultUserAgent identifies requests from clients that don't set their own
+// User-Agent, rather than Go's default, which some servers block.
+var DefaultUserAgent = "imageservice-to-mbtiles/" + moduleVersion()
+
+// moduleVersion returns the version of this module in the build, like
+// v1.2.0, or "dev" for a build from a checkout.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, m := range info.Deps {
+		if m.Path == modulePath {
+			return m.Version
+		}
+	}
+	return "dev"
+}
+
 type EsriService struct {
-	baseURL string
+	baseURL    string
+	token      string
+	headers    http.Header
+	httpClient *http.Client
+	transport  http.RoundTripper
+	post       bool
+	// pretty asks for indented JSON responses, for reading while
+	// troubleshooting.
+	pretty bool
+
+	// baseQuery is any query string the endpoint was given with, like a
+	// token, which is kept on every request.
+	baseQuery url.Values
+
+	// tokens, if set, are rotated through instead of sending token.
+	tokens *tokenPool
+
+	// imageContentTypes, if set, are the Content-Types image downloads are
+	// allowed to have.
+	imageContentTypes []string
+
+	// mercatorWkid is the web mercator code the service was found to accept,
+	// or 0 if it hasn't been resolved yet.
+	mercatorWkid int32
 }
 
-func (s *EsriService) GetDetails(ctx context.Context) (*ServiceDetails, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s?f=json", s.baseURL), nil)
+// Option configures optional behavior of an EsriService.
+type Option func(*EsriService)
+
+// WithToken sets an ArcGIS token that is sent with every request.
+func WithToken(token string) Option {
+	return func(s *EsriService) {
+		s.token = token
+	}
+}
+
+// WithTokens rotates through several ArcGIS tokens, one per request, instead
+// of sending the same token with every request. Tokens that are rate limited
+// or rejected are rested for a while.
+func WithTokens(tokens ...string) Option {
+	return func(s *EsriService) {
+		p := &tokenPool{}
+		for _, t := range tokens {
+			p.tokens = append(p.tokens, &pooledToken{value: t})
+		}
+		s.tokens = p
+	}
+}
+
+// WithHeader adds a header that is sent with every request.
+func WithHeader(key, value string) Option {
+	return func(s *EsriService) {
+		s.headers.Add(key, value)
+	}
+}
+
+// WithUserAgent replaces DefaultUserAgent in the client's requests.
+func WithUserAgent(userAgent string) Option {
+	return func(s *EsriService) {
+		s.headers.Set("User-Agent", userAgent)
+	}
+}
+
+// WithPOST sends exportImage requests as form POSTs, for servers that
+// require it. Requests whose parameters are too long for a URL are POSTed
+// either way.
+func WithPOST() Option {
+	return func(s *EsriService) {
+		s.post = true
+	}
+}
+
+// WithPrettyResponses asks the service for indented JSON (f=pjson) instead of
+// compact JSON, so its responses are easier to read while troubleshooting.
+func WithPrettyResponses() Option {
+	return func(s *EsriService) {
+		s.pretty = true
+	}
+}
+
+// WithImageContentTypes rejects image downloads and cached tiles whose
+// Content-Type isn't one of types, which ImageContentTypes can make for the
+// requested format, rather than returning whatever the server sent.
+func WithImageContentTypes(types ...string) Option {
+	return func(s *EsriService) {
+		s.imageContentTypes = types
+	}
+}
+
+// responseFormat is the f parameter for JSON responses.
+func (s *EsriService) responseFormat() string {
+	if s.pretty {
+		return "pjson"
+	}
+	return "json"
+}
+
+// authorize applies the configured token and headers to req if it's for the
+// service's host. Requests to other hosts, like a CDN an image href points
+// at, only get the User-Agent, so the credentials don't leak to them.
+func (s *EsriService) authorize(req *http.Request) {
+	if !s.sameHost(req.URL) {
+		for k := range s.headers {
+			if k != "User-Agent" {
+				req.Header.Del(k)
+			}
+		}
+		if ua := s.headers.Get("User-Agent"); ua != "" {
+			req.Header.Set("User-Agent", ua)
+		}
+		return
+	}
+
+	for k, v := range s.headers {
+		req.Header[k] = v
+	}
+
+	if s.token == "" && s.tokens == nil {
+		return
+	}
+	q := req.URL.Query()
+	if q.Get("token") == "" {
+		if s.tokens != nil {
+			q.Set("token", s.tokens.pick())
+		} else {
+			q.Set("token", s.token)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+}
+
+// do sends an authorized request, resting its token if it was rate limited
+// or rejected.
+func (s *EsriService) do(req *http.Request) (*http.Response, error) {
+	response, err := s.httpClient.Do(req)
+	if err == nil && s.tokens != nil {
+		s.tokens.observe(req.URL.Query().Get("token"), response)
+	}
+	return response, err
+}
+
+// checkRedirect reapplies headers and token on redirects to the service's
+// host, since they may otherwise be dropped on the way to a signed URL.
+// Other hosts don't get the configured headers, which Go would otherwise
+// copy.
+func (s *EsriService) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	log.Printf("Following redirect from %s to %s", redactURL(via[len(via)-1].URL), redactURL(req.URL))
+
+	s.authorize(req)
+	return nil
+}
+
+// sameHost reports whether u is on the service's host.
+func (s *EsriService) sameHost(u *url.URL) bool {
+	base, err := url.Parse(s.baseURL)
+	return err == nil && base.Host == u.Host
+}
+
+// redactURL returns u as a string with any token parameter hidden.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	if q.Get("token") == "" {
+		return u.String()
+	}
+
+	redacted := *u
+	q.Set("token", "REDACTED")
+	redacted.RawQuery = q.Encode()
+	return redacted.String()
+}
+
+// requestURL returns req's URL with any token hidden, and with a POST's form
+// parameters in its query string, so the request can be repeated from it.
+func requestURL(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	u := *req.URL
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := ioutil.ReadAll(body)
+			u.RawQuery = string(data)
+		}
+	}
+	return redactURL(&u)
+}
+
+// errorBodyBytes is how much of a response's body a RequestError keeps.
+const errorBodyBytes = 256
+
+func newRequestError(req *http.Request, response *http.Response, body []byte, err error) *RequestError {
+	if len(body) > errorBodyBytes {
+		body = body[:errorBodyBytes]
+	}
+	return &RequestError{URL: requestURL(req), StatusCode: response.StatusCode, Body: string(body), Err: err}
+}
+
+// url returns the URL of path under the service, with params added to any
+// query string the service's endpoint had.
+func (s *EsriService) url(path string, params url.Values) string {
+	query := s.withBaseQuery(params).Encode()
+	if query == "" {
+		return s.baseURL + path
+	}
+	return s.baseURL + path + "?" + query
+}
+
+// withBaseQuery returns params along with the endpoint's query parameters
+// that params doesn't override.
+func (s *EsriService) withBaseQuery(params url.Values) url.Values {
+	merged := url.Values{}
+	for k, v := range s.baseQuery {
+		merged[k] = v
+	}
+	for k, v := range params {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (s *EsriService) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := http.DefaultClient.Do(req)
+	s.authorize(req)
+
+	return s.do(req)
+}
+
+func (s *EsriService) GetDetails(ctx context.Context) (*ServiceDetails, error) {
+	response, err := s.get(ctx, s.url("", url.Values{"f": {s.responseFormat()}}))
 	if err != nil {
-		return nil, err
+		return nil, detailsError(ctx, err)
 	}
 
 	defer response.Body.Close()
 
 	data, err := ioutil.ReadAll(response.Body)
 	if err != nil {
+		return nil, detailsError(ctx, err)
+	}
+
+	if err := checkServiceError(data); err != nil {
 		return nil, err
 	}
 
@@ -41,15 +310,135 @@ func (s *EsriService) GetDetails(ctx context.Context) (*ServiceDetails, error) {
 	return details, nil
 }
 
+// ServiceType returns the kind of service the client talks to, like
+// ImageServer or MapServer, judging by its URL.
+func (s *EsriService) ServiceType() string {
+	parts := strings.Split(strings.TrimRight(s.baseURL, "/"), "/")
+	if last := parts[len(parts)-1]; strings.HasSuffix(last, "Server") {
+		return last
+	}
+	return "unknown"
+}
+
+// detailsError makes a timeout while fetching the service description
+// distinguishable from other failures.
+func detailsError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("service description timed out: %w", err)
+	}
+	return err
+}
+
+// ExportImage renders an image of the service. Services that reject the web
+// mercator code they're given as an unsupported spatial reference are
+// retried with its historical equivalents, and the code that works is used
+// for the rest of the client's requests.
 func (s *EsriService) ExportImage(ctx context.Context, input *ExportImageInput) (*ExportImageOutput, error) {
+	if !input.ImageSR.IsWebMercator() && !input.BoundingBox.SpatialReference.IsWebMercator() {
+		return s.exportImage(ctx, input)
+	}
+
+	if wkid := atomic.LoadInt32(&s.mercatorWkid); wkid != 0 {
+		return s.exportImage(ctx, withMercatorWkid(input, int(wkid)))
+	}
+
+	output, err := s.exportImage(ctx, input)
+	if err == nil || !isSpatialReferenceError(err) {
+		return output, err
+	}
+
+	for _, wkid := range webMercatorFallbacks {
+		if wkid == input.ImageSR.code() || wkid == input.BoundingBox.SpatialReference.code() {
+			continue
+		}
+
+		retryOutput, retryErr := s.exportImage(ctx, withMercatorWkid(input, wkid))
+		if isSpatialReferenceError(retryErr) {
+			continue
+		}
+		if retryErr != nil {
+			return nil, retryErr
+		}
+
+		if atomic.CompareAndSwapInt32(&s.mercatorWkid, 0, int32(wkid)) {
+			log.Printf("Service rejected the requested web mercator code, using wkid %d instead", wkid)
+		}
+		return retryOutput, nil
+	}
+
+	return nil, err
+}
+
+func withMercatorWkid(input *ExportImageInput, wkid int) *ExportImageInput {
+	replaced := *input
+	replaced.ImageSR = input.ImageSR.withMercatorWkid(wkid)
+	replaced.BoundingBox.SpatialReference = input.BoundingBox.SpatialReference.withMercatorWkid(wkid)
+	return &replaced
+}
+
+func (s *EsriService) exportImage(ctx context.Context, input *ExportImageInput) (*ExportImageOutput, error) {
+	req, err := s.newExportImageRequest(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, newRequestError(req, response, data, err)
+	}
+
+	if err := checkServiceError(data); err != nil {
+		// Services usually report rate limits and bad tokens in a 200.
+		var serviceErr *ServiceError
+		if s.tokens != nil && errors.As(err, &serviceErr) && isTokenFailure(serviceErr.Code) {
+			s.tokens.failed(req.URL.Query().Get("token"), 0)
+		}
+		return nil, newRequestError(req, response, data, err)
+	}
+
+	details := &ExportImageOutput{}
+	err = json.Unmarshal(data, details)
+	if err != nil {
+		return nil, newRequestError(req, response, data, err)
+	}
+
+	return details, nil
+}
+
+// exportImageArgs returns the exportImage parameters that render input.
+func (s *EsriService) exportImageArgs(input *ExportImageInput) (url.Values, error) {
 	args := url.Values{}
-	args.Set("f", "pjson")
+	args.Set("f", s.responseFormat())
 	args.Set("bbox", fmt.Sprintf("%f,%f,%f,%f", input.BoundingBox.XMin, input.BoundingBox.YMin, input.BoundingBox.XMax, input.BoundingBox.YMax))
-	args.Set("bboxSR", fmt.Sprintf("%d", input.BoundingBox.SpatialReference.Wkid))
+	bboxSR, err := input.BoundingBox.SpatialReference.param()
+	if err != nil {
+		return nil, fmt.Errorf("bboxSR: %w", err)
+	}
+	args.Set("bboxSR", bboxSR)
 	args.Set("size", fmt.Sprintf("%d,%d", input.Size.Width, input.Size.Height))
-	args.Set("imageSR", fmt.Sprintf("%d", input.ImageSR))
+	imageSR, err := input.ImageSR.param()
+	if err != nil {
+		return nil, fmt.Errorf("imageSR: %w", err)
+	}
+	args.Set("imageSR", imageSR)
 	args.Set("format", input.Format)
 	args.Set("pixelType", input.PixelType)
+	if input.OutputPixelType != "" {
+		args.Set("outputPixelType", input.OutputPixelType)
+	}
+	if input.SliceID != nil {
+		args.Set("sliceId", fmt.Sprintf("%d", *input.SliceID))
+	}
+	if input.Format == "lerc" && input.LercVersion > 0 {
+		args.Set("lercVersion", fmt.Sprintf("%d", input.LercVersion))
+	}
 
 	if len(input.NoData) > 0 {
 		stringNodata := make([]string, len(input.NoData))
@@ -60,36 +449,127 @@ func (s *EsriService) ExportImage(ctx context.Context, input *ExportImageInput)
 		args.Set("noData", strings.Join(stringNodata, ","))
 	}
 
-	url := fmt.Sprintf("%s/exportImage?%s", s.baseURL, args.Encode())
+	return args, nil
+}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+// newExportImageRequest returns an exportImage request for input, which is
+// a form POST if the client was created with WithPOST or the parameters are
+// too long to fit in a URL.
+func (s *EsriService) newExportImageRequest(ctx context.Context, input *ExportImageInput) (*http.Request, error) {
+	args, err := s.exportImageArgs(input)
 	if err != nil {
 		return nil, err
 	}
 
-	response, err := http.DefaultClient.Do(req)
+	endpoint := s.baseURL + "/exportImage"
+	encoded := s.withBaseQuery(args).Encode()
+
+	var req *http.Request
+	if s.post || len(encoded) > maxGETParamsLength {
+		req, err = http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(encoded))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "GET", endpoint+"?"+encoded, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.authorize(req)
+	return req, nil
+}
+
+// ExportImageRequest returns the request ExportImage would make first for
+// input, with the client's headers and token, without sending it.
+func (s *EsriService) ExportImageRequest(input *ExportImageInput) (*http.Request, error) {
+	if wkid := atomic.LoadInt32(&s.mercatorWkid); wkid != 0 {
+		input = withMercatorWkid(input, int(wkid))
+	}
+	return s.newExportImageRequest(context.Background(), input)
+}
+
+// checkServiceError returns the error in an ESRI JSON error envelope, if data
+// is one.
+func checkServiceError(data []byte) error {
+	resp := &errorResponse{}
+	if err := json.Unmarshal(data, resp); err != nil || resp.Error == nil {
+		return nil
+	}
+	return resp.Error
+}
+
+// GetImage downloads the image referred to by an ExportImageOutput's Href.
+func (s *EsriService) GetImage(ctx context.Context, href string) ([]byte, error) {
+	response, err := s.getImage(ctx, href)
 	if err != nil {
 		return nil, err
 	}
 
 	defer response.Body.Close()
 
-	data, err := ioutil.ReadAll(response.Body)
+	return ReadImage(response)
+}
+
+// OpenImage is like GetImage, but returns the image as a stream without
+// buffering or checking it. The caller must close it, which closes the
+// connection's response body.
+func (s *EsriService) OpenImage(ctx context.Context, href string) (io.ReadCloser, error) {
+	response, err := s.getImage(ctx, href)
 	if err != nil {
 		return nil, err
 	}
+	return openBody(response)
+}
 
-	details := &ExportImageOutput{}
-	err = json.Unmarshal(data, details)
+func (s *EsriService) getImage(ctx context.Context, href string) (*http.Response, error) {
+	response, err := s.get(ctx, href)
 	if err != nil {
 		return nil, err
 	}
 
-	return details, nil
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, errorBodyBytes))
+		response.Body.Close()
+		return nil, newRequestError(response.Request, response, body, &HTTPError{StatusCode: response.StatusCode, Status: response.Status})
+	}
+
+	if err := CheckContentType(response, s.imageContentTypes); err != nil {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, errorBodyBytes))
+		response.Body.Close()
+		return nil, newRequestError(response.Request, response, body, err)
+	}
+
+	return response, nil
+}
+
+// GetTile downloads a tile from the service's tile cache.
+func (s *EsriService) GetTile(ctx context.Context, level, row, col int) ([]byte, error) {
+	return s.GetImage(ctx, s.url(fmt.Sprintf("/tile/%d/%d/%d", level, row, col), nil))
 }
 
-func NewClient(baseURL string) *EsriService {
-	return &EsriService{
+func NewClient(baseURL string, opts ...Option) *EsriService {
+	s := &EsriService{
 		baseURL: baseURL,
+		headers: http.Header{},
+	}
+	if u, err := url.Parse(baseURL); err == nil {
+		s.baseQuery = u.Query()
+		u.RawQuery, u.ForceQuery = "", false
+		u.Fragment, u.RawFragment = "", ""
+		s.baseURL = u.String()
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.headers.Get("User-Agent") == "" {
+		s.headers.Set("User-Agent", DefaultUserAgent)
+	}
+
+	s.httpClient = &http.Client{Transport: s.transport, CheckRedirect: s.checkRedirect}
+
+	return s
 }
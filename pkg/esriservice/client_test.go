@@ -0,0 +1,193 @@
+package esriservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestRedirectAuthorization follows an image href through a redirect on the
+// same host and then to another one, and checks that the token and headers
+// are sent again on the first hop and not to the other host.
+func TestRedirectAuthorization(t *testing.T) {
+	type hop struct{ token, header string }
+	seen := map[string]hop{}
+	record := func(r *http.Request) {
+		seen[r.URL.Path] = hop{r.URL.Query().Get("token"), r.Header.Get("X-Api-Key")}
+	}
+
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("tile"))
+	}))
+	defer cdn.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		http.Redirect(w, r, "/signed", http.StatusFound)
+	})
+	mux.HandleFunc("/signed", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		http.Redirect(w, r, cdn.URL+"/cdn", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := NewClient(server.URL+"/svc/ImageServer", WithToken("secret"), WithHeader("X-Api-Key", "key"))
+	data, err := client.GetImage(context.Background(), server.URL+"/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "tile" {
+		t.Errorf("got %q, want the CDN's tile", data)
+	}
+
+	for path, want := range map[string]hop{
+		"/image":  {"secret", "key"},
+		"/signed": {"secret", "key"},
+		"/cdn":    {"", ""},
+	} {
+		if got, ok := seen[path]; !ok {
+			t.Errorf("%s was never requested", path)
+		} else if got != want {
+			t.Errorf("%s got token %q and X-Api-Key %q, want %q and %q", path, got.token, got.header, want.token, want.header)
+		}
+	}
+}
+
+// TestImageOnOtherHost downloads an image href on another host than the
+// service's, and checks that it isn't sent the token or headers.
+func TestImageOnOtherHost(t *testing.T) {
+	var token, header, userAgent string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, header, userAgent = r.URL.Query().Get("token"), r.Header.Get("X-Api-Key"), r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("tile"))
+	}))
+	defer cdn.Close()
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	client := NewClient(server.URL+"/svc/ImageServer", WithToken("secret"), WithHeader("X-Api-Key", "key"))
+	if _, err := client.GetImage(context.Background(), cdn.URL+"/image.png"); err != nil {
+		t.Fatal(err)
+	}
+	if token != "" || header != "" {
+		t.Errorf("the other host got token %q and X-Api-Key %q", token, header)
+	}
+	if userAgent != DefaultUserAgent {
+		t.Errorf("the other host got User-Agent %q, want %q", userAgent, DefaultUserAgent)
+	}
+}
+
+// TestBaseQuery checks that an endpoint given with a query string keeps its
+// parameters on every request, after the path, without a second "?".
+func TestBaseQuery(t *testing.T) {
+	s := NewClient("https://example.com/arcgis/rest/services/Ortho/ImageServer?token=abc&f=html")
+
+	check := func(name string, u *url.URL, wantPath string) {
+		t.Helper()
+		if u.Path != wantPath {
+			t.Errorf("%s: path is %q, want %q", name, u.Path, wantPath)
+		}
+		if strings.Contains(u.RawQuery, "?") {
+			t.Errorf("%s: query %q has a second ?", name, u.RawQuery)
+		}
+		if token := u.Query().Get("token"); token != "abc" {
+			t.Errorf("%s: token is %q, want the endpoint's", name, token)
+		}
+	}
+
+	details, err := url.Parse(s.url("", url.Values{"f": {"json"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("details", details, "/arcgis/rest/services/Ortho/ImageServer")
+	if f := details.Query()["f"]; len(f) != 1 || f[0] != "json" {
+		t.Errorf("details: f is %q, want the request's to replace the endpoint's", f)
+	}
+
+	tile, err := url.Parse(s.url("/tile/3/2/1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("tile", tile, "/arcgis/rest/services/Ortho/ImageServer/tile/3/2/1")
+
+	input, err := NewTileInput(ExtentType{XMin: 0, YMin: 0, XMax: 1, YMax: 1, SpatialReference: SpatialReferenceType{Wkid: 4326}}, SpatialReferenceType{Wkid: 3857}, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := s.ExportImageRequest(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("exportImage", req.URL, "/arcgis/rest/services/Ortho/ImageServer/exportImage")
+
+	s.post = true
+	req, err = s.ExportImageRequest(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.RawQuery != "" {
+		t.Errorf("POSTed exportImage has query %q", req.URL.RawQuery)
+	}
+	if err := req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if token := req.PostForm.Get("token"); token != "abc" {
+		t.Errorf("POSTed exportImage: token is %q, want the endpoint's", token)
+	}
+}
+
+// TestBaseQueryFragment checks that a fragment on the endpoint is dropped
+// rather than ending up in its last query parameter or its path.
+func TestBaseQueryFragment(t *testing.T) {
+	for _, endpoint := range []string{
+		"https://example.com/arcgis/rest/services/Ortho/ImageServer?token=abc#map",
+		"https://example.com/arcgis/rest/services/Ortho/ImageServer#map",
+		"https://example.com/arcgis/rest/services/Ortho/ImageServer?",
+	} {
+		s := NewClient(endpoint)
+		if want := "https://example.com/arcgis/rest/services/Ortho/ImageServer"; s.baseURL != want {
+			t.Errorf("%s: base URL is %q, want %q", endpoint, s.baseURL, want)
+		}
+		if token := s.baseQuery.Get("token"); strings.Contains(endpoint, "token") && token != "abc" {
+			t.Errorf("%s: token is %q, want abc", endpoint, token)
+		}
+	}
+}
+
+// TestUserAgent checks that requests carry DefaultUserAgent, with a
+// version, unless WithUserAgent replaces it.
+func TestUserAgent(t *testing.T) {
+	if !strings.HasPrefix(DefaultUserAgent, "imageservice-to-mbtiles/") || strings.HasSuffix(DefaultUserAgent, "/") {
+		t.Errorf("DefaultUserAgent %q doesn't have a version", DefaultUserAgent)
+	}
+
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, DefaultUserAgent},
+		{[]Option{WithUserAgent("tiler/1.0")}, "tiler/1.0"},
+	} {
+		if _, err := NewClient(server.URL+"/svc/ImageServer", test.opts...).GetDetails(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("User-Agent is %q, want %q", got, test.want)
+		}
+	}
+}
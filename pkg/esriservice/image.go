@@ -0,0 +1,173 @@
+package esriservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ErrIncompleteImage is returned when an image download ends early, such as
+// when the connection drops mid-transfer. Retrying usually succeeds.
+var ErrIncompleteImage = errors.New("incomplete image")
+
+// ErrUnexpectedContentType is returned when an image download has a
+// Content-Type that isn't allowed, like the HTML of an error or sign-in page
+// that a proxy served instead of the image.
+var ErrUnexpectedContentType = errors.New("unexpected content type")
+
+// DefaultImageContentTypes are the Content-Types ImageContentTypes always
+// allows.
+var DefaultImageContentTypes = []string{"image/png", "image/jpeg"}
+
+// formatContentTypes are the Content-Types images in each format are served
+// with. Raw raster formats have no image type of their own.
+var formatContentTypes = map[string][]string{
+	"png":    {"image/png"},
+	"png8":   {"image/png"},
+	"png24":  {"image/png"},
+	"png32":  {"image/png"},
+	"jpg":    {"image/jpeg"},
+	"jpeg":   {"image/jpeg"},
+	"jpgpng": {"image/jpeg", "image/png"},
+	"mixed":  {"image/jpeg", "image/png"},
+	"gif":    {"image/gif"},
+	"bmp":    {"image/bmp"},
+	"tif":    {"image/tiff"},
+	"tiff":   {"image/tiff"},
+	"webp":   {"image/webp"},
+	"lerc":   {"application/octet-stream"},
+	"bip":    {"application/octet-stream"},
+	"bsq":    {"application/octet-stream"},
+}
+
+// ImageContentTypes returns DefaultImageContentTypes plus the Content-Types
+// images in formats are served with. A format can be an exportImage format
+// like jpgpng, a tile cache format like MIXED, or a MIME type like
+// image/webp, which is allowed as it is.
+func ImageContentTypes(formats ...string) []string {
+	var types []string
+	seen := map[string]bool{}
+	add := func(candidates ...string) {
+		for _, t := range candidates {
+			if !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+	}
+
+	add(DefaultImageContentTypes...)
+	for _, format := range formats {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if strings.Contains(format, "/") {
+			add(format)
+		} else {
+			add(formatContentTypes[format]...)
+		}
+	}
+	return types
+}
+
+// CheckContentType returns an ErrUnexpectedContentType error if response's
+// Content-Type isn't one of allowed. Responses without a Content-Type pass,
+// since there's nothing to check, as does everything if allowed is empty.
+func CheckContentType(response *http.Response, allowed []string) error {
+	header := response.Header.Get("Content-Type")
+	if len(allowed) == 0 || header == "" {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrUnexpectedContentType, header, err)
+	}
+	for _, t := range allowed {
+		if strings.EqualFold(mediaType, t) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q, expected one of %s", ErrUnexpectedContentType, mediaType, strings.Join(allowed, ", "))
+}
+
+var pngEnd = []byte("\x00\x00\x00\x00IEND\xae\x42\x60\x82")
+
+// ReadImage reads an image response's body, checking that it's as long as
+// the response said it would be and, for PNG, JPEG and GIF images, that it
+// ends with the format's trailer rather than partway through the data. A
+// gzipped body is decompressed, since some servers compress images even
+// when they weren't asked to.
+func ReadImage(response *http.Response) ([]byte, error) {
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIncompleteImage, err)
+	}
+	if response.ContentLength >= 0 && int64(len(data)) != response.ContentLength {
+		return nil, fmt.Errorf("%w: got %d of %d bytes", ErrIncompleteImage, len(data), response.ContentLength)
+	}
+	if gzipped(response) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrIncompleteImage, err)
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrIncompleteImage, err)
+		}
+	}
+	if err := checkImageEnd(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// gzipped reports whether response's body is gzipped. Go's transport
+// decompresses bodies itself and removes the header when it asked for gzip,
+// but not when a server sends it unasked.
+func gzipped(response *http.Response) bool {
+	encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	return encoding == "gzip" || encoding == "x-gzip"
+}
+
+// openBody returns response's body, decompressing it if it's gzipped.
+func openBody(response *http.Response) (io.ReadCloser, error) {
+	if !gzipped(response) {
+		return response.Body, nil
+	}
+
+	r, err := gzip.NewReader(response.Body)
+	if err != nil {
+		response.Body.Close()
+		return nil, fmt.Errorf("%w: %v", ErrIncompleteImage, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, response.Body}, nil
+}
+
+// checkImageEnd reports an error if data starts like a PNG, JPEG or GIF but
+// doesn't end like one. Other data, like LERC or the service's blank
+// responses, isn't checked.
+func checkImageEnd(data []byte) error {
+	var complete bool
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		complete = bytes.HasSuffix(data, pngEnd)
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		complete = bytes.HasSuffix(bytes.TrimRight(data, "\x00"), []byte("\xff\xd9"))
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		complete = bytes.HasSuffix(data, []byte(";"))
+	default:
+		return nil
+	}
+
+	if !complete {
+		return fmt.Errorf("%w: %d byte image is truncated", ErrIncompleteImage, len(data))
+	}
+	return nil
+}
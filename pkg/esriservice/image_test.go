@@ -0,0 +1,178 @@
+package esriservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckContentType(t *testing.T) {
+	allowed := ImageContentTypes("png")
+	for _, test := range []struct {
+		header string
+		ok     bool
+	}{
+		{"image/png", true},
+		{"IMAGE/PNG", true},
+		{"image/jpeg", true},
+		{"image/png; charset=binary", true},
+		{"", true},
+		{"text/html", false},
+		{"text/html; charset=utf-8", false},
+		{"application/json", false},
+		{"not a media type;;", false},
+	} {
+		response := &http.Response{Header: http.Header{}}
+		if test.header != "" {
+			response.Header.Set("Content-Type", test.header)
+		}
+		err := CheckContentType(response, allowed)
+		if test.ok && err != nil {
+			t.Errorf("Content-Type %q was rejected: %v", test.header, err)
+		}
+		if !test.ok && !errors.Is(err, ErrUnexpectedContentType) {
+			t.Errorf("Content-Type %q gave %v, want ErrUnexpectedContentType", test.header, err)
+		}
+	}
+
+	response := &http.Response{Header: http.Header{"Content-Type": {"text/html"}}}
+	if err := CheckContentType(response, nil); err != nil {
+		t.Errorf("nothing allowed should allow anything, got %v", err)
+	}
+}
+
+// TestGetImageRejectsHTML checks that an HTML error page a proxy serves with
+// a 200 in place of an image is an error, rather than a tile.
+func TestGetImageRejectsHTML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>Please sign in</body></html>"))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL+"/svc/ImageServer", WithImageContentTypes(ImageContentTypes("png")...))
+	data, err := client.GetImage(context.Background(), server.URL+"/image.png")
+	if !errors.Is(err, ErrUnexpectedContentType) {
+		t.Fatalf("got %d bytes and error %v, want ErrUnexpectedContentType", len(data), err)
+	}
+	var requestErr *RequestError
+	if !errors.As(err, &requestErr) || requestErr.Body != "<html><body>Please sign in</body></html>" {
+		t.Errorf("error %v doesn't carry the page's body", err)
+	}
+}
+
+// TestGetImageConnectionClosedEarly serves images over connections that are
+// closed partway through the body, with and without a Content-Length, and
+// checks that the partial image is an ErrIncompleteImage rather than a tile.
+func TestGetImageConnectionClosedEarly(t *testing.T) {
+	img := testPNG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/complete.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(img)
+			return
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nConnection: close\r\n")
+		if r.URL.Path == "/sized.png" {
+			fmt.Fprintf(buf, "Content-Length: %d\r\n", len(img))
+		}
+		buf.WriteString("\r\n")
+		buf.Write(img[:len(img)/2])
+		buf.Flush()
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL + "/svc/ImageServer")
+	for _, path := range []string{"/sized.png", "/unsized.png"} {
+		data, err := client.GetImage(context.Background(), server.URL+path)
+		if !errors.Is(err, ErrIncompleteImage) {
+			t.Errorf("%s: got %d bytes and error %v, want ErrIncompleteImage", path, len(data), err)
+		}
+	}
+
+	data, err := client.GetImage(context.Background(), server.URL+"/complete.png")
+	if err != nil || !bytes.Equal(data, img) {
+		t.Errorf("complete image: got %d bytes and error %v", len(data), err)
+	}
+}
+
+// testPNG encodes a small image with noise in it, so it doesn't compress
+// to a handful of bytes.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestGetImageGzipped serves a gzipped image both when the client asked for
+// gzip, which Go's transport decompresses, and when it didn't, which is left
+// to ReadImage and openBody.
+func TestGetImageGzipped(t *testing.T) {
+	img := testPNG(t)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(img)
+	zw.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", fmt.Sprint(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	for name, transport := range map[string]*http.Transport{
+		"asked":   {},
+		"unasked": {DisableCompression: true},
+	} {
+		client := NewClient(server.URL+"/svc/ImageServer", WithTransport(transport))
+
+		data, err := client.GetImage(context.Background(), server.URL+"/image.png")
+		if err != nil || !bytes.Equal(data, img) {
+			t.Errorf("%s: GetImage got %d bytes and error %v, want the %d byte image", name, len(data), err, len(img))
+		}
+
+		r, err := client.OpenImage(context.Background(), server.URL+"/image.png")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(data, img) {
+			t.Errorf("%s: OpenImage read %d bytes and error %v, want the %d byte image", name, len(data), err, len(img))
+		}
+		transport.CloseIdleConnections()
+	}
+
+	// A gzipped body that's cut short is incomplete, not a tile.
+	response := &http.Response{
+		Header:        http.Header{"Content-Encoding": {"gzip"}},
+		ContentLength: -1,
+		Body:          ioutil.NopCloser(bytes.NewReader(compressed.Bytes()[:compressed.Len()/2])),
+	}
+	if data, err := ReadImage(response); !errors.Is(err, ErrIncompleteImage) {
+		t.Errorf("truncated gzip body gave %d bytes and error %v, want ErrIncompleteImage", len(data), err)
+	}
+}
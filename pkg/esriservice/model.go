@@ -1,8 +1,15 @@
 package esriservice
 
+import (
+	"fmt"
+	"strings"
+)
+
 type SpatialReferenceType struct {
 	Wkid       int
 	LatestWkid int
+	// Wkt is a well-known text definition for spatial references without a wkid.
+	Wkt string
 }
 
 type ExtentType struct {
@@ -14,9 +21,62 @@ type ExtentType struct {
 }
 
 type ServiceDetails struct {
-	Extent        ExtentType `json:"extent"`
-	InitialExtent ExtentType `json:"initialExtent"`
-	FullExtent    ExtentType `json:"fullExtent"`
+	Name             string               `json:"name"`
+	Description      string               `json:"description"`
+	CopyrightText    string               `json:"copyrightText"`
+	SpatialReference SpatialReferenceType `json:"spatialReference"`
+	Extent           ExtentType           `json:"extent"`
+	InitialExtent    ExtentType           `json:"initialExtent"`
+	FullExtent       ExtentType           `json:"fullExtent"`
+
+	// MaxImageWidth and MaxImageHeight are the largest image exportImage
+	// will render.
+	MaxImageWidth  int `json:"maxImageWidth"`
+	MaxImageHeight int `json:"maxImageHeight"`
+
+	// SupportedImageFormatTypes is a comma-separated list of the formats a
+	// MapServer can export.
+	SupportedImageFormatTypes string `json:"supportedImageFormatTypes,omitempty"`
+
+	// TileInfo describes the service's tile cache, if it has one.
+	TileInfo *TileInfo `json:"tileInfo,omitempty"`
+
+	// BandCount, PixelType and ServiceDataType describe an ImageServer's
+	// data, like 1 band of F32 esriImageServiceDataTypeElevation, and
+	// MinValues and MaxValues the range of each band.
+	BandCount       int       `json:"bandCount,omitempty"`
+	PixelType       string    `json:"pixelType,omitempty"`
+	ServiceDataType string    `json:"serviceDataType,omitempty"`
+	MinValues       []float64 `json:"minValues,omitempty"`
+	MaxValues       []float64 `json:"maxValues,omitempty"`
+
+	// PixelSizeX and PixelSizeY are an ImageServer's native resolution, in
+	// the units of its spatial reference.
+	PixelSizeX float64 `json:"pixelSizeX,omitempty"`
+	PixelSizeY float64 `json:"pixelSizeY,omitempty"`
+}
+
+type PointType struct {
+	X float64
+	Y float64
+}
+
+// TileInfo is the tiling scheme of a cached service.
+type TileInfo struct {
+	Rows             int                  `json:"rows"`
+	Cols             int                  `json:"cols"`
+	DPI              int                  `json:"dpi"`
+	Format           string               `json:"format"`
+	Origin           PointType            `json:"origin"`
+	SpatialReference SpatialReferenceType `json:"spatialReference"`
+	LODs             []LOD                `json:"lods"`
+}
+
+// LOD is one zoom level of a tile cache.
+type LOD struct {
+	Level      int     `json:"level"`
+	Resolution float64 `json:"resolution"`
+	Scale      float64 `json:"scale"`
 }
 
 type RectType struct {
@@ -27,11 +87,24 @@ type RectType struct {
 type ExportImageInput struct {
 	BoundingBox ExtentType
 	Size        RectType
-	ImageSR     int
-	// Format is the format of the rendered image. One of jpgpng, png, png8, png24, png32, jpg, bmp, gif, tiff.
+	// ImageSR is the spatial reference to render the image in. It used to
+	// be a bare wkid; SpatialReferenceType{Wkid: wkid} is the same request.
+	ImageSR SpatialReferenceType
+	// Format is the format of the rendered image. One of jpgpng, png, png8, png24, png32, jpg, bmp, gif, tiff, lerc.
 	Format string
+	// LercVersion is the LERC codec version to use with the lerc format, or
+	// the service's default if zero.
+	LercVersion int
 	// PixelType is how to represent a pixel in the image data. One of C128, C64, F32, F64, S16, S32, S8, U1, U16, U2, U32, U4, U8.
 	PixelType string
+	// OutputPixelType, if set, is the pixel type to convert the image to
+	// after rendering, like U8 to scale a 16-bit source down for display. The
+	// service converts after applying its rendering rule, so a rule that
+	// already stretches to 8 bits doesn't need it.
+	OutputPixelType string
+	// SliceID, if set, picks the slice of a multidimensional service to
+	// render, from GetSlices.
+	SliceID *int
 	// NoData is a list of values to treat as no data/transparent.
 	NoData []int
 }
@@ -41,5 +114,53 @@ type ExportImageOutput struct {
 	Width  int
 	Height int
 	Extent ExtentType
-	Scale  int
+	// Scale is the map scale denominator of the exported image.
+	Scale float64
+}
+
+// ServiceError is the error envelope ESRI services return in place of a
+// successful response.
+type ServiceError struct {
+	Code    int
+	Message string
+	Details []string
+}
+
+func (e *ServiceError) Error() string {
+	if len(e.Details) > 0 {
+		return fmt.Sprintf("service error %d: %s (%s)", e.Code, e.Message, strings.Join(e.Details, "; "))
+	}
+	return fmt.Sprintf("service error %d: %s", e.Code, e.Message)
+}
+
+type errorResponse struct {
+	Error *ServiceError
+}
+
+// HTTPError is returned when a request gets a non-200 response.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("unexpected status: %s", e.Status)
+}
+
+// RequestError wraps an error in response to a request with what's needed
+// to repeat it and see what went wrong: the request's URL, with any token
+// hidden, and the response's status and the start of its body.
+type RequestError struct {
+	URL        string
+	StatusCode int
+	Body       string
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
 }
@@ -0,0 +1,57 @@
+package esriservice
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Slice is one 2D slice of a multidimensional image service, like one
+// variable at one time, which exportImage renders when asked for its ID.
+type Slice struct {
+	ID         int              `json:"sliceId"`
+	Definition []SliceDimension `json:"multidimensionalDefinition"`
+}
+
+// SliceDimension is the value of a slice along one of its variable's
+// dimensions.
+type SliceDimension struct {
+	VariableName  string `json:"variableName"`
+	DimensionName string `json:"dimensionName"`
+	// Values are the dimension's values, either numbers or [start, end]
+	// intervals. Times are in milliseconds since the Unix epoch.
+	Values []interface{} `json:"values"`
+}
+
+// GetSlices lists the slices of a multidimensional image service.
+func (s *EsriService) GetSlices(ctx context.Context) ([]Slice, error) {
+	response, err := s.get(ctx, s.url("/slices", url.Values{"f": {s.responseFormat()}}))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &HTTPError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkServiceError(data); err != nil {
+		return nil, err
+	}
+
+	slices := struct {
+		Slices []Slice `json:"slices"`
+	}{}
+	if err := json.Unmarshal(data, &slices); err != nil {
+		return nil, err
+	}
+
+	return slices.Slices, nil
+}
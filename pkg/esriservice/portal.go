@@ -0,0 +1,58 @@
+package esriservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// DefaultPortalURL is ArcGIS Online.
+const DefaultPortalURL = "https://www.arcgis.com"
+
+// PortalItem is the part of an ArcGIS Online or Portal item's description
+// that says what service it refers to.
+type PortalItem struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+}
+
+// PortalItemURL returns the sharing API URL that describes an item in a
+// portal, to create a client for with NewClient.
+func PortalItemURL(portalURL, itemID string) string {
+	return fmt.Sprintf("%s/sharing/rest/content/items/%s", strings.TrimRight(portalURL, "/"), url.PathEscape(itemID))
+}
+
+// GetPortalItem describes the item of a client created with PortalItemURL.
+// Private items need a token, or a username and password passed to
+// GenerateToken.
+func (s *EsriService) GetPortalItem(ctx context.Context) (*PortalItem, error) {
+	response, err := s.get(ctx, s.url("", url.Values{"f": {s.responseFormat()}}))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkServiceError(data); err != nil {
+		return nil, err
+	}
+
+	item := &PortalItem{}
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, err
+	}
+	if item.URL == "" {
+		return nil, fmt.Errorf("item %s (%s) doesn't refer to a service", item.ID, item.Type)
+	}
+
+	return item, nil
+}
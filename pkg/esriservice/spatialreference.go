@@ -0,0 +1,135 @@
+package esriservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrMissingSpatialReference is returned for a request whose bboxSR or imageSR
+// has no wkid or WKT, which servers reject or silently misread as 0.
+var ErrMissingSpatialReference = errors.New("spatial reference has no wkid or wkt")
+
+// webMercatorWkids are the codes ESRI services have used for web mercator.
+var webMercatorWkids = map[int]bool{
+	3857:   true,
+	102100: true,
+	102113: true,
+	900913: true,
+}
+
+// webMercatorFallbacks is the order in which web mercator codes are tried when
+// a service rejects the one it was given.
+var webMercatorFallbacks = []int{3857, 102100, 102113}
+
+// isSpatialReferenceError reports whether err is a service error about the
+// spatial reference it was given, which is the only rejection worth retrying
+// with another web mercator code.
+func isSpatialReferenceError(err error) bool {
+	var serviceErr *ServiceError
+	if !errors.As(err, &serviceErr) {
+		return false
+	}
+	text := strings.ToLower(serviceErr.Message + " " + strings.Join(serviceErr.Details, " "))
+	return strings.Contains(text, "spatial reference") || strings.Contains(text, "wkid")
+}
+
+// NormalizeWkid maps the historical web mercator codes to 3857 and returns
+// any other wkid unchanged.
+func NormalizeWkid(wkid int) int {
+	if webMercatorWkids[wkid] {
+		return 3857
+	}
+	return wkid
+}
+
+// IsWebMercator reports whether sr refers to web mercator under any of its
+// historical codes.
+func (sr SpatialReferenceType) IsWebMercator() bool {
+	return webMercatorWkids[sr.Wkid] || webMercatorWkids[sr.LatestWkid]
+}
+
+// IsWGS84 reports whether sr is geographic WGS84, EPSG:4326.
+func (sr SpatialReferenceType) IsWGS84() bool {
+	return sr.code() == 4326
+}
+
+// Equivalent reports whether sr and other describe the same spatial
+// reference, treating the various web mercator codes as equal.
+func (sr SpatialReferenceType) Equivalent(other SpatialReferenceType) bool {
+	if sr.IsWebMercator() && other.IsWebMercator() {
+		return true
+	}
+
+	if sr.Wkt != "" || other.Wkt != "" {
+		return sr.Wkt == other.Wkt
+	}
+
+	return sr.code() != 0 && sr.code() == other.code()
+}
+
+// IsZero reports whether sr has neither a wkid nor WKT.
+func (sr SpatialReferenceType) IsZero() bool {
+	return sr.code() == 0 && sr.Wkt == ""
+}
+
+func (sr SpatialReferenceType) code() int {
+	if sr.Wkid != 0 {
+		return sr.Wkid
+	}
+	return sr.LatestWkid
+}
+
+// param formats sr for a bboxSR or imageSR request parameter. A bare wkid is
+// used where possible since every server version accepts it, falling back to
+// the JSON object form for WKT or when both wkid and latestWkid are known.
+func (sr SpatialReferenceType) param() (string, error) {
+	if sr.IsZero() {
+		return "", ErrMissingSpatialReference
+	}
+	if sr.Wkt == "" && (sr.Wkid == 0 || sr.LatestWkid == 0 || sr.Wkid == sr.LatestWkid) {
+		return fmt.Sprintf("%d", sr.code()), nil
+	}
+
+	data, err := json.Marshal(struct {
+		Wkid       int    `json:"wkid,omitempty"`
+		LatestWkid int    `json:"latestWkid,omitempty"`
+		Wkt        string `json:"wkt,omitempty"`
+	}{sr.Wkid, sr.LatestWkid, sr.Wkt})
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// NewTileInput returns exportImage parameters that render the size by size
+// pixel tile covering bbox, in bbox's spatial reference, as an image in
+// imageSR, like a tile bounded in 4326 rendered in 3857. Both spatial
+// references must be set.
+func NewTileInput(bbox ExtentType, imageSR SpatialReferenceType, size int) (*ExportImageInput, error) {
+	if bbox.SpatialReference.IsZero() {
+		return nil, fmt.Errorf("bboxSR: %w", ErrMissingSpatialReference)
+	}
+	if imageSR.IsZero() {
+		return nil, fmt.Errorf("imageSR: %w", ErrMissingSpatialReference)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid tile size %d", size)
+	}
+
+	return &ExportImageInput{
+		BoundingBox: bbox,
+		ImageSR:     imageSR,
+		Size:        RectType{Width: size, Height: size},
+	}, nil
+}
+
+// withMercatorWkid returns sr replaced by wkid if sr is web mercator.
+func (sr SpatialReferenceType) withMercatorWkid(wkid int) SpatialReferenceType {
+	if !sr.IsWebMercator() {
+		return sr
+	}
+	return SpatialReferenceType{Wkid: wkid}
+}
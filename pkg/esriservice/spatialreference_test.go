@@ -0,0 +1,133 @@
+package esriservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSpatialReferenceParam(t *testing.T) {
+	for _, test := range []struct {
+		sr   SpatialReferenceType
+		want string
+	}{
+		{SpatialReferenceType{Wkid: 4326}, "4326"},
+		{SpatialReferenceType{LatestWkid: 3857}, "3857"},
+		{SpatialReferenceType{Wkid: 3857, LatestWkid: 3857}, "3857"},
+		{SpatialReferenceType{Wkid: 102100, LatestWkid: 3857}, `{"wkid":102100,"latestWkid":3857}`},
+		{SpatialReferenceType{Wkt: `PROJCS["x"]`}, `{"wkt":"PROJCS[\"x\"]"}`},
+	} {
+		got, err := test.sr.param()
+		if err != nil || got != test.want {
+			t.Errorf("%+v formatted as %q, %v, want %q", test.sr, got, err, test.want)
+		}
+	}
+
+	if got, err := (SpatialReferenceType{}).param(); !errors.Is(err, ErrMissingSpatialReference) {
+		t.Errorf("the zero spatial reference formatted as %q, %v", got, err)
+	}
+}
+
+// TestZeroSpatialReferenceNotSent checks that an exportImage with a missing
+// bboxSR or imageSR fails before it's sent, rather than asking the server
+// for wkid 0.
+func TestZeroSpatialReferenceNotSent(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		t.Errorf("request was sent with bboxSR=%q imageSR=%q", r.FormValue("bboxSR"), r.FormValue("imageSR"))
+	}))
+	defer server.Close()
+	client := NewClient(server.URL + "/svc/ImageServer")
+
+	bbox := ExtentType{XMin: 0, YMin: 0, XMax: 1, YMax: 1, SpatialReference: SpatialReferenceType{Wkid: 4326}}
+	unset := bbox
+	unset.SpatialReference = SpatialReferenceType{}
+	for name, input := range map[string]*ExportImageInput{
+		"bboxSR":  {BoundingBox: unset, ImageSR: SpatialReferenceType{Wkid: 3857}, Size: RectType{Width: 256, Height: 256}},
+		"imageSR": {BoundingBox: bbox, Size: RectType{Width: 256, Height: 256}},
+	} {
+		if _, err := client.ExportImage(context.Background(), input); !errors.Is(err, ErrMissingSpatialReference) {
+			t.Errorf("missing %s gave %v, want ErrMissingSpatialReference", name, err)
+		}
+		if _, err := client.ExportImageRequest(input); !errors.Is(err, ErrMissingSpatialReference) {
+			t.Errorf("missing %s made a request, want ErrMissingSpatialReference, got %v", name, err)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("%d requests reached the server", requests)
+	}
+
+	if _, err := NewTileInput(unset, SpatialReferenceType{Wkid: 3857}, 256); !errors.Is(err, ErrMissingSpatialReference) {
+		t.Errorf("NewTileInput with no bboxSR gave %v", err)
+	}
+	if _, err := NewTileInput(bbox, SpatialReferenceType{}, 256); !errors.Is(err, ErrMissingSpatialReference) {
+		t.Errorf("NewTileInput with no imageSR gave %v", err)
+	}
+}
+
+// TestMercatorFallback has a service reject 3857 as an unsupported spatial
+// reference and accept 102100, and checks that the first export is retried
+// with 102100 and that later exports use it from the start.
+func TestMercatorFallback(t *testing.T) {
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.FormValue("bboxSR")+"/"+r.FormValue("imageSR"))
+		if r.FormValue("bboxSR") == "3857" || r.FormValue("imageSR") == "3857" {
+			fmt.Fprint(w, `{"error":{"code":400,"message":"Unable to complete operation.","details":["Invalid spatial reference: wkid 3857"]}}`)
+			return
+		}
+		fmt.Fprint(w, `{"href":"https://example.com/image.png","width":256,"height":256}`)
+	}))
+	defer server.Close()
+	client := NewClient(server.URL + "/svc/ImageServer")
+
+	mercator := SpatialReferenceType{Wkid: 3857}
+	input, err := NewTileInput(ExtentType{XMin: 0, YMin: 0, XMax: 1, YMax: 1, SpatialReference: mercator}, mercator, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.ExportImage(context.Background(), input); err != nil {
+			t.Fatalf("export %d: %v", i, err)
+		}
+	}
+
+	want := []string{"3857/3857", "102100/102100", "102100/102100", "102100/102100"}
+	if fmt.Sprint(requested) != fmt.Sprint(want) {
+		t.Errorf("requested bboxSR/imageSR %v, want %v", requested, want)
+	}
+	if req, err := client.ExportImageRequest(input); err != nil || req.URL.Query().Get("imageSR") != "102100" {
+		t.Errorf("ExportImageRequest doesn't use the working code: %v", err)
+	}
+}
+
+// TestMercatorFallbackOtherErrors checks that errors that aren't about the
+// spatial reference, like a bad token, aren't retried with other codes.
+func TestMercatorFallbackOtherErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"error":{"code":498,"message":"Invalid Token","details":[]}}`)
+	}))
+	defer server.Close()
+	client := NewClient(server.URL + "/svc/ImageServer")
+
+	mercator := SpatialReferenceType{Wkid: 3857}
+	input, err := NewTileInput(ExtentType{XMin: 0, YMin: 0, XMax: 1, YMax: 1, SpatialReference: mercator}, mercator, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		var serviceErr *ServiceError
+		if _, err := client.ExportImage(context.Background(), input); !errors.As(err, &serviceErr) || serviceErr.Code != 498 {
+			t.Errorf("export %d gave %v, want the 498", i, err)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("%d requests for 2 exports, want no retries", requests)
+	}
+}
@@ -0,0 +1,77 @@
+package esriservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// TileMap says which tiles in a block of a cached service's level exist.
+type TileMap struct {
+	// Adjusted is set when the service returned a different block than was
+	// asked for, which Location describes.
+	Adjusted bool `json:"adjusted"`
+	Location struct {
+		Left   int `json:"left"`
+		Top    int `json:"top"`
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	} `json:"location"`
+	// Data is 1 for each tile that exists and 0 for each that doesn't, row
+	// by row, or a single value if they're all the same.
+	Data []int `json:"data"`
+}
+
+// Has reports whether the tile at row and col exists, and whether it's in
+// the block at all.
+func (m *TileMap) Has(row, col int) (exists, ok bool) {
+	r, c := row-m.Location.Top, col-m.Location.Left
+	if r < 0 || c < 0 || r >= m.Location.Height || c >= m.Location.Width {
+		return false, false
+	}
+
+	switch len(m.Data) {
+	case 1:
+		return m.Data[0] != 0, true
+	case m.Location.Width * m.Location.Height:
+		return m.Data[r*m.Location.Width+c] != 0, true
+	}
+	return false, false
+}
+
+// GetTileMap asks a cached service which tiles exist in the block of height
+// rows and width columns at level whose top left tile is at row and col.
+func (s *EsriService) GetTileMap(ctx context.Context, level, row, col, height, width int) (*TileMap, error) {
+	response, err := s.get(ctx, s.url(fmt.Sprintf("/tilemap/%d/%d/%d/%d/%d", level, row, col, height, width), url.Values{"f": {s.responseFormat()}}))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &HTTPError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkServiceError(data); err != nil {
+		return nil, err
+	}
+
+	tileMap := &TileMap{}
+	if err := json.Unmarshal(data, tileMap); err != nil {
+		return nil, err
+	}
+	if tileMap.Location.Width == 0 {
+		tileMap.Location.Top, tileMap.Location.Left = row, col
+		tileMap.Location.Width, tileMap.Location.Height = width, height
+	}
+
+	return tileMap, nil
+}
@@ -0,0 +1,125 @@
+package esriservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type infoResponse struct {
+	AuthInfo struct {
+		IsTokenBasedSecurity bool   `json:"isTokenBasedSecurity"`
+		TokenServicesURL     string `json:"tokenServicesUrl"`
+	} `json:"authInfo"`
+}
+
+type tokenResponse struct {
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+// GenerateToken signs in to the service's token endpoint with username and
+// password and uses the resulting token for the client's requests.
+func (s *EsriService) GenerateToken(ctx context.Context, username, password string) error {
+	tokenURL, err := s.tokenServicesURL(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't find token service: %w", err)
+	}
+
+	form := url.Values{}
+	form.Set("username", username)
+	form.Set("password", password)
+	form.Set("client", "requestip")
+	form.Set("f", s.responseFormat())
+
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range s.headers {
+		req.Header[k] = v
+	}
+
+	response, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := checkServiceError(data); err != nil {
+		return err
+	}
+
+	token := &tokenResponse{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return err
+	}
+	if token.Token == "" {
+		return fmt.Errorf("token service didn't return a token")
+	}
+
+	s.token = token.Token
+	return nil
+}
+
+// tokenServicesURL looks up where the server or portal issues tokens from
+// its /rest/info resource.
+func (s *EsriService) tokenServicesURL(ctx context.Context) (string, error) {
+	i := strings.Index(s.baseURL, "/rest/services")
+	if j := strings.Index(s.baseURL, "/sharing/rest/"); i < 0 && j >= 0 {
+		i = j + len("/sharing")
+	}
+	if i < 0 {
+		return "", fmt.Errorf("%s isn't a /rest/services or portal URL", s.baseURL)
+	}
+
+	response, err := s.get(ctx, s.baseURL[:i]+"/rest/info?f=json")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkServiceError(data); err != nil {
+		return "", err
+	}
+
+	info := &infoResponse{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return "", err
+	}
+	if info.AuthInfo.TokenServicesURL == "" {
+		return "", fmt.Errorf("server doesn't use token based security")
+	}
+
+	return info.AuthInfo.TokenServicesURL, nil
+}
+
+// IsTokenRequired reports whether err means the service turned a request
+// away for lacking a valid token.
+func IsTokenRequired(err error) bool {
+	var serviceErr *ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Code == 498 || serviceErr.Code == 499
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return isTokenFailure(httpErr.StatusCode) && httpErr.StatusCode != http.StatusTooManyRequests
+	}
+	return false
+}
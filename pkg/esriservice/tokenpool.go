@@ -0,0 +1,129 @@
+package esriservice
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenRest is how long a rate limited token is passed over when the
+// response doesn't say how long to wait.
+const tokenRest = time.Minute
+
+// tokenPool hands out several tokens in turn, so each token's rate limit
+// only has to cover its share of the requests. A token that's rate limited
+// is passed over until its rest is up, unless every token is resting.
+type tokenPool struct {
+	mu     sync.Mutex
+	tokens []*pooledToken
+	next   int
+}
+
+type pooledToken struct {
+	value     string
+	requests  int
+	failures  int
+	restUntil time.Time
+}
+
+// TokenStats is how a token from WithTokens has fared. Tokens are numbered
+// in the order they were given rather than shown, to keep them out of logs.
+type TokenStats struct {
+	Index    int
+	Requests int
+	// Failures counts the token's rate limited and rejected requests.
+	Failures int
+}
+
+func (s TokenStats) String() string {
+	return fmt.Sprintf("token %d: %d requests, %d failed", s.Index+1, s.Requests, s.Failures)
+}
+
+// pick returns the next token that isn't resting, or the one whose rest
+// ends soonest if they all are.
+func (p *tokenPool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var best *pooledToken
+	for i := 0; i < len(p.tokens); i++ {
+		t := p.tokens[(p.next+i)%len(p.tokens)]
+		if !t.restUntil.After(now) {
+			best = t
+			p.next = (p.next + i + 1) % len(p.tokens)
+			break
+		}
+		if best == nil || t.restUntil.Before(best.restUntil) {
+			best = t
+		}
+	}
+	best.requests++
+	return best.value
+}
+
+// observe records how a request sent with token went, resting the token if
+// it failed, for as long as Retry-After says if it's set.
+func (p *tokenPool) observe(token string, response *http.Response) {
+	if isTokenFailure(response.StatusCode) {
+		p.failed(token, retryAfter(response))
+	}
+}
+
+// isTokenFailure reports whether an HTTP status or ESRI error code means a
+// token was rate limited (429) or rejected (401, 403, and ESRI's 498 for
+// invalid tokens and 499 for missing ones).
+func isTokenFailure(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusUnauthorized, http.StatusForbidden, 498, 499:
+		return true
+	}
+	return false
+}
+
+// failed rests token for rest, or tokenRest if that's zero.
+func (p *tokenPool) failed(token string, rest time.Duration) {
+	if rest <= 0 {
+		rest = tokenRest
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.tokens {
+		if t.value == token {
+			t.failures++
+			t.restUntil = time.Now().Add(rest)
+		}
+	}
+}
+
+func (p *tokenPool) stats() []TokenStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var stats []TokenStats
+	for i, t := range p.tokens {
+		stats = append(stats, TokenStats{Index: i, Requests: t.requests, Failures: t.failures})
+	}
+	return stats
+}
+
+// retryAfter returns how long a response's Retry-After header asks clients
+// to wait, or 0 if it doesn't have one in seconds.
+func retryAfter(response *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(response.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// TokenStats returns how each token from WithTokens has fared, or nil if
+// the client has a single token.
+func (s *EsriService) TokenStats() []TokenStats {
+	if s.tokens == nil {
+		return nil
+	}
+	return s.tokens.stats()
+}
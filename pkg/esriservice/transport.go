@@ -0,0 +1,113 @@
+package esriservice
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TransportConfig tunes the connections a client makes. Crawls send many
+// small requests to one host, so the defaults keep more idle connections
+// around than net/http's two per host.
+type TransportConfig struct {
+	// MaxConnsPerHost limits connections to each host, or 0 for no limit.
+	MaxConnsPerHost int
+
+	// MaxConns limits the connections open to all hosts at once, or 0 for
+	// no limit. Unlike MaxConnsPerHost, it covers the hosts rendered images
+	// are downloaded from too, so leaked connections run out of slots
+	// rather than file descriptors.
+	MaxConns int
+
+	// MaxIdleConnsPerHost is how many idle connections are kept for reuse
+	// with each host. Defaults to 32.
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout closes idle connections after this long. Defaults to
+	// 90 seconds.
+	IdleConnTimeout time.Duration
+
+	// HTTP1 disables HTTP/2, for servers that behave badly with it.
+	HTTP1 bool
+}
+
+// NewTransport returns an http.Transport configured by cfg.
+func NewTransport(cfg TransportConfig) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxConnsPerHost = cfg.MaxConnsPerHost
+	t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = 32
+	}
+	if t.MaxIdleConns < t.MaxIdleConnsPerHost {
+		t.MaxIdleConns = t.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+
+	if cfg.MaxConns > 0 {
+		t.DialContext = limitConns(t, t.DialContext, cfg.MaxConns)
+	}
+
+	if cfg.HTTP1 {
+		// A non-nil, empty TLSNextProto keeps the transport from
+		// negotiating HTTP/2.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else {
+		t.ForceAttemptHTTP2 = true
+	}
+
+	return t
+}
+
+// limitConns wraps dial so no more than max of the connections it makes are
+// open at once. Idle connections hold slots too, so they're closed to make
+// room before waiting for one.
+func limitConns(t *http.Transport, dial func(ctx context.Context, network, addr string) (net.Conn, error), max int) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	slots := make(chan struct{}, max)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			t.CloseIdleConnections()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			<-slots
+			return nil, err
+		}
+		return &slotConn{Conn: conn, slots: slots}, nil
+	}
+}
+
+// slotConn gives its slot back when it's closed.
+type slotConn struct {
+	net.Conn
+	slots  chan struct{}
+	closed sync.Once
+}
+
+func (c *slotConn) Close() error {
+	err := c.Conn.Close()
+	c.closed.Do(func() { <-c.slots })
+	return err
+}
+
+// WithTransport sends the client's requests through transport instead of
+// http.DefaultTransport.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(s *EsriService) {
+		s.transport = transport
+	}
+}
@@ -0,0 +1,183 @@
+package esriservice
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openFiles returns how many descriptors the process has open, or -1 where
+// that can't be counted.
+func openFiles() int {
+	entries, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// connCounter tracks the connections a test server has open.
+type connCounter struct {
+	mu        sync.Mutex
+	open, max int
+}
+
+func (c *connCounter) track(conn net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		c.open++
+		if c.open > c.max {
+			c.max = c.open
+		}
+	case http.StateHijacked, http.StateClosed:
+		c.open--
+	}
+}
+
+// TestFailedRequestsDontLeakConnections makes many requests that fail in
+// different ways through a transport limited to two connections. A response
+// body left open on any failure path would hold its connection's slot, so
+// the requests after it would wait for a slot until they timed out.
+func TestFailedRequestsDontLeakConnections(t *testing.T) {
+	// Error pages longer than the client reads of them, since a body read
+	// to the end frees its connection even if it isn't closed.
+	errorPage := []byte("<html><body>" + strings.Repeat("Bad gateway ", 1000) + "</body></html>")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/svc/ImageServer/exportImage", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("size") == "1,1" {
+			http.Error(w, "render failed", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"error":{"code":500,"message":"Error exporting image","details":[]}}`))
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(errorPage)
+	})
+	mux.HandleFunc("/gateway", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write(errorPage)
+	})
+	mux.HandleFunc("/truncated", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\nnot the rest of the image"))
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(errorPage)
+	})
+
+	var conns connCounter
+	server := httptest.NewUnstartedServer(mux)
+	server.Config.ConnState = conns.track
+	server.Start()
+	defer server.Close()
+
+	transport := NewTransport(TransportConfig{MaxConns: 2})
+	defer transport.CloseIdleConnections()
+	client := NewClient(server.URL+"/svc/ImageServer", WithTransport(transport), WithImageContentTypes(ImageContentTypes("png")...))
+
+	before := openFiles()
+	failures := []func(ctx context.Context) error{
+		func(ctx context.Context) error {
+			_, err := client.ExportImage(ctx, &ExportImageInput{Size: RectType{Width: 1, Height: 1}})
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := client.ExportImage(ctx, &ExportImageInput{Size: RectType{Width: 256, Height: 256}})
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := client.GetImage(ctx, server.URL+"/missing")
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := client.GetImage(ctx, server.URL+"/gateway")
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := client.GetImage(ctx, server.URL+"/truncated")
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := client.GetImage(ctx, server.URL+"/html")
+			return err
+		},
+	}
+	// Canceling a request's context closes its connection, which would
+	// hide a leak, so they share one.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 500; i++ {
+		err := failures[i%len(failures)](ctx)
+		if err == nil {
+			t.Fatalf("request %d succeeded", i)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("request %d timed out waiting for a connection, so an earlier one leaked: %v", i, err)
+		}
+	}
+
+	conns.mu.Lock()
+	max := conns.max
+	conns.mu.Unlock()
+	if max > 2 {
+		t.Errorf("the server saw %d connections open at once, want at most 2", max)
+	}
+
+	// The client's two connections, and the server's ends of them, can
+	// still be open for reuse.
+	if after := openFiles(); before >= 0 && after > before+4 {
+		t.Errorf("%d descriptors were open before the requests and %d after", before, after)
+	}
+}
+
+// TestMaxConnsHoldsLeakedBodies checks that connections whose bodies are
+// never closed keep their slots, so leaks stall requests at the limit rather
+// than using up descriptors, and that closing one lets the next through.
+func TestMaxConnsHoldsLeakedBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	transport := NewTransport(TransportConfig{MaxConns: 2})
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	var leaked []*http.Response
+	for i := 0; i < 2; i++ {
+		response, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaked = append(leaked, response)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if response, err := client.Do(req); err == nil {
+		response.Body.Close()
+		t.Fatal("a third connection was opened while two bodies were open")
+	}
+
+	leaked[0].Body.Close()
+	response, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request after closing a body failed: %v", err)
+	}
+	response.Body.Close()
+	leaked[1].Body.Close()
+}
@@ -0,0 +1,351 @@
+package tilesource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/project"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// ESRI renders tiles with an ArcGIS ImageServer or MapServer's exportImage
+// operation and downloads the result.
+type ESRI struct {
+	Client *esriservice.EsriService
+
+	// Grid is the tiling scheme, web mercator if nil.
+	Grid Grid
+
+	TileSize  int
+	Format    string
+	PixelType string
+	// OutputPixelType, if set, asks the service to convert rendered images
+	// to this pixel type.
+	OutputPixelType string
+	// SliceID, if set, is the slice of a multidimensional service to render.
+	SliceID *int
+	// LercVersion is passed along when requesting lerc tiles.
+	LercVersion int
+	// ZoomFormats overrides Format at particular zooms.
+	ZoomFormats map[maptile.Zoom]string
+	NoData      []int
+	// NoDataFallback retries requests without NoData when the service
+	// rejects it, and stops sending it after that.
+	NoDataFallback bool
+
+	// ExportTimeout and ImageTimeout, if set, bound the exportImage request
+	// and the download of the rendered image separately, since rendering can
+	// be much slower than the transfer.
+	ExportTimeout time.Duration
+	ImageTimeout  time.Duration
+	// TimeoutScale, if set, multiplies ExportTimeout and ImageTimeout for
+	// tiles at each zoom, like to give slow renders of coarse zooms longer.
+	TimeoutScale func(z maptile.Zoom) float64
+
+	// ExportConcurrency and ImageConcurrency, if set, limit how many
+	// exportImage requests and image downloads are in flight at once, for
+	// services that render and serve images from different backends.
+	ExportConcurrency int
+	ImageConcurrency  int
+
+	// ImageWkid, if set, is the spatial reference to render images in
+	// instead of the grid's, for callers that reproject them afterward.
+	ImageWkid int
+
+	// BoundsSR, if set, is the spatial reference tile bounds are sent in
+	// instead of WGS84, like the service's own so it doesn't have to
+	// reproject them. Only web mercator and WGS84 are supported.
+	BoundsSR esriservice.SpatialReferenceType
+
+	// EdgeBuffer renders this many extra pixels around each side of a tile,
+	// for the caller to crop off, which hides seams from resampling at tile
+	// edges.
+	EdgeBuffer int
+
+	// CheckScale compares the scale the service reports for each zoom with
+	// the web mercator scale for that zoom and warns when they disagree,
+	// which usually means the coordinates or spatial references are off.
+	CheckScale bool
+	// RecordScales keeps the scale the service reports for each zoom, for
+	// Scales, whether or not it's checked.
+	RecordScales bool
+
+	noDataUnsupported int32
+
+	slotsOnce   sync.Once
+	exportSlots chan struct{}
+	imageSlots  chan struct{}
+
+	scalesMu sync.Mutex
+	scales   map[maptile.Zoom]float64
+}
+
+func (e *ESRI) FetchTile(ctx context.Context, t maptile.Tile) ([]byte, error) {
+	resp, err := e.export(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	imageBytes, err := e.downloadImage(ctx, t.Z, resp.Href)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch referred image: %w", err)
+	}
+
+	return imageBytes, nil
+}
+
+// OpenTile is like FetchTile, but returns the rendered image as a stream
+// that the caller must close, rather than reading it into memory.
+func (e *ESRI) OpenTile(ctx context.Context, t maptile.Tile) (io.ReadCloser, error) {
+	resp, err := e.export(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	e.slotsOnce.Do(e.makeSlots)
+	if err := acquire(ctx, e.imageSlots); err != nil {
+		return nil, err
+	}
+
+	imageCtx, cancel := withOptionalTimeout(ctx, e.scaledTimeout(e.ImageTimeout, t.Z))
+	body, err := e.Client.OpenImage(imageCtx, resp.Href)
+	if err != nil {
+		cancel()
+		release(e.imageSlots)
+		return nil, fmt.Errorf("couldn't fetch referred image: %w", err)
+	}
+
+	// The download's slot and timeout last until the stream is closed.
+	return &closeFuncReader{ReadCloser: body, close: func() {
+		cancel()
+		release(e.imageSlots)
+	}}, nil
+}
+
+// export renders t, retrying without noData if the service rejects it.
+func (e *ESRI) export(ctx context.Context, t maptile.Tile) (*esriservice.ExportImageOutput, error) {
+	input, err := e.ExportInput(t)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := e.exportImage(ctx, t.Z, input)
+	if err != nil && e.NoDataFallback && len(input.NoData) > 0 && isNoDataError(err) {
+		if atomic.CompareAndSwapInt32(&e.noDataUnsupported, 0, 1) {
+			log.Printf("Service rejected noData, retrying without it: %+v", err)
+		}
+		input.NoData = nil
+		resp, err = e.exportImage(ctx, t.Z, input)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't export image: %w", err)
+	}
+
+	if (e.CheckScale || e.RecordScales) && resp.Scale > 0 {
+		e.recordScale(t.Z, resp.Scale)
+	}
+
+	return resp, nil
+}
+
+// ExportInput returns the exportImage parameters that render t.
+func (e *ESRI) ExportInput(t maptile.Tile) (*esriservice.ExportImageInput, error) {
+	grid := e.Grid
+	if grid == nil {
+		grid = WebMercator{}
+	}
+
+	tileBounds := grid.Bound(t)
+	size := e.TileSize
+	if e.EdgeBuffer > 0 {
+		tileBounds = grid.Pad(tileBounds, e.TileSize, e.EdgeBuffer)
+		size += 2 * e.EdgeBuffer
+	}
+
+	imageBounds, err := e.bbox(tileBounds)
+	if err != nil {
+		return nil, err
+	}
+
+	imageWkid := grid.Wkid()
+	if e.ImageWkid != 0 {
+		imageWkid = e.ImageWkid
+	}
+
+	input, err := esriservice.NewTileInput(imageBounds, esriservice.SpatialReferenceType{Wkid: imageWkid}, size)
+	if err != nil {
+		return nil, err
+	}
+	input.Format = e.format(t.Z)
+	input.LercVersion = e.LercVersion
+	input.PixelType = e.PixelType
+	input.OutputPixelType = e.OutputPixelType
+	input.SliceID = e.SliceID
+	input.NoData = e.NoData
+	if atomic.LoadInt32(&e.noDataUnsupported) != 0 {
+		input.NoData = nil
+	}
+
+	return input, nil
+}
+
+// bbox returns b, in WGS84 degrees, as an extent in BoundsSR. A rectangle in
+// degrees is still one in web mercator, so no accuracy is lost.
+func (e *ESRI) bbox(b orb.Bound) (esriservice.ExtentType, error) {
+	sr := esriservice.SpatialReferenceType{Wkid: 4326}
+	switch {
+	case e.BoundsSR.IsZero():
+	case e.BoundsSR.IsWebMercator():
+		b = project.Bound(b, project.WGS84.ToMercator)
+		sr = e.BoundsSR
+	case e.BoundsSR.IsWGS84():
+		sr = e.BoundsSR
+	default:
+		return esriservice.ExtentType{}, errors.New("tile bounds can only be sent in web mercator or WGS84")
+	}
+
+	return esriservice.ExtentType{
+		XMin:             b.Min.X(),
+		YMin:             b.Min.Y(),
+		XMax:             b.Max.X(),
+		YMax:             b.Max.Y(),
+		SpatialReference: sr,
+	}, nil
+}
+
+func (e *ESRI) exportImage(ctx context.Context, z maptile.Zoom, input *esriservice.ExportImageInput) (*esriservice.ExportImageOutput, error) {
+	e.slotsOnce.Do(e.makeSlots)
+	if err := acquire(ctx, e.exportSlots); err != nil {
+		return nil, err
+	}
+	defer release(e.exportSlots)
+
+	ctx, cancel := withOptionalTimeout(ctx, e.scaledTimeout(e.ExportTimeout, z))
+	defer cancel()
+	return e.Client.ExportImage(ctx, input)
+}
+
+func (e *ESRI) downloadImage(ctx context.Context, z maptile.Zoom, href string) ([]byte, error) {
+	e.slotsOnce.Do(e.makeSlots)
+	if err := acquire(ctx, e.imageSlots); err != nil {
+		return nil, err
+	}
+	defer release(e.imageSlots)
+
+	ctx, cancel := withOptionalTimeout(ctx, e.scaledTimeout(e.ImageTimeout, z))
+	defer cancel()
+	return e.Client.GetImage(ctx, href)
+}
+
+// scaledTimeout returns timeout scaled by TimeoutScale for tiles at z.
+func (e *ESRI) scaledTimeout(timeout time.Duration, z maptile.Zoom) time.Duration {
+	if e.TimeoutScale == nil || timeout <= 0 {
+		return timeout
+	}
+	return time.Duration(float64(timeout) * e.TimeoutScale(z))
+}
+
+func (e *ESRI) makeSlots() {
+	if e.ExportConcurrency > 0 {
+		e.exportSlots = make(chan struct{}, e.ExportConcurrency)
+	}
+	if e.ImageConcurrency > 0 {
+		e.imageSlots = make(chan struct{}, e.ImageConcurrency)
+	}
+}
+
+// acquire takes one of slots, waiting until one is free or ctx is done. A
+// nil slots has no limit.
+func acquire(ctx context.Context, slots chan struct{}) error {
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func release(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// isNoDataError reports whether err is a service error about the noData
+// parameter.
+func isNoDataError(err error) bool {
+	var serviceErr *esriservice.ServiceError
+	if !errors.As(err, &serviceErr) {
+		return false
+	}
+	text := strings.ToLower(serviceErr.Message + " " + strings.Join(serviceErr.Details, " "))
+	return strings.Contains(text, "nodata")
+}
+
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (e *ESRI) format(z maptile.Zoom) string {
+	if f, ok := e.ZoomFormats[z]; ok {
+		return f
+	}
+	return e.Format
+}
+
+// expectedScale returns the map scale denominator ArcGIS reports for a web
+// mercator tile at zoom z, which assumes 96 DPI.
+func expectedScale(z maptile.Zoom, tileSize int) float64 {
+	resolution := ResolutionAt(z, 0) * 256 / float64(tileSize)
+	return resolution * 96 / 0.0254
+}
+
+func (e *ESRI) recordScale(z maptile.Zoom, scale float64) {
+	e.scalesMu.Lock()
+	defer e.scalesMu.Unlock()
+
+	if _, ok := e.scales[z]; ok {
+		return
+	}
+	if e.scales == nil {
+		e.scales = map[maptile.Zoom]float64{}
+	}
+	e.scales[z] = scale
+	if !e.CheckScale {
+		return
+	}
+
+	expected := expectedScale(z, e.TileSize)
+	if ratio := scale / expected; ratio < 0.5 || ratio > 2 {
+		log.Printf("Service reported scale 1:%0.0f at z%d but 1:%0.0f was expected, check the extent and spatial references", scale, z, expected)
+	}
+}
+
+// Scales returns the first scale the service reported at each zoom, if
+// RecordScales or CheckScale is set.
+func (e *ESRI) Scales() map[maptile.Zoom]float64 {
+	e.scalesMu.Lock()
+	defer e.scalesMu.Unlock()
+
+	scales := make(map[maptile.Zoom]float64, len(e.scales))
+	for z, s := range e.scales {
+		scales[z] = s
+	}
+	return scales
+}
@@ -0,0 +1,57 @@
+package tilesource
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// TestScalesRecorded checks that the scale a service reports is kept with
+// RecordScales alone, without the web mercator check.
+func TestScalesRecorded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"href":  "http://" + r.Host + "/image",
+			"scale": 1234.5,
+		})
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		check, record bool
+		want          int
+	}{
+		{false, false, 0},
+		{false, true, 1},
+		{true, false, 1},
+	} {
+		e := &ESRI{
+			Client:       esriservice.NewClient(server.URL + "/svc/ImageServer"),
+			TileSize:     256,
+			Format:       "png",
+			CheckScale:   test.check,
+			RecordScales: test.record,
+		}
+		if _, err := e.FetchTile(context.Background(), maptile.New(1, 2, 3)); err != nil {
+			t.Fatal(err)
+		}
+		scales := e.Scales()
+		if len(scales) != test.want {
+			t.Errorf("CheckScale %v, RecordScales %v: recorded %v", test.check, test.record, scales)
+		}
+		if test.want > 0 && scales[3] != 1234.5 {
+			t.Errorf("CheckScale %v, RecordScales %v: recorded %v, want 1234.5 at z3", test.check, test.record, scales)
+		}
+	}
+}
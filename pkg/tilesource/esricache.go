@@ -0,0 +1,162 @@
+package tilesource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/project"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// StandardOrigin is the top left corner of the web mercator world, which is
+// the origin of almost every ESRI web mercator tile cache.
+var StandardOrigin = orb.Point{-20037508.342787, 20037508.342787}
+
+// ESRICache downloads tiles directly from an ArcGIS service's web mercator
+// tile cache instead of rendering them. Tiles missing from the cache are
+// returned as empty.
+type ESRICache struct {
+	Client   *esriservice.EsriService
+	TileInfo *esriservice.TileInfo
+
+	// Origin is the top left corner of the cache's grid in web mercator
+	// meters, which is usually StandardOrigin.
+	Origin orb.Point
+
+	// UseTileMap asks the service's tilemap which tiles exist, a block at a
+	// time, and returns the ones it says are missing as empty without
+	// requesting them. If the service has no tilemap, every tile is
+	// requested.
+	UseTileMap bool
+
+	tileMapsMu         sync.Mutex
+	tileMaps           map[tileMapKey]*tileMapBlock
+	tileMapUnsupported int32
+}
+
+// tileMapBlockSize is the number of rows and columns of tiles to ask the
+// tilemap about at once.
+const tileMapBlockSize = 32
+
+type tileMapKey struct {
+	level, row, col int
+}
+
+// tileMapBlock is fetched once by the first tile in it that's requested.
+type tileMapBlock struct {
+	once    sync.Once
+	tileMap *esriservice.TileMap
+	err     error
+}
+
+// NewESRICache checks that the cache described by tileInfo can be read as web
+// mercator tiles.
+func NewESRICache(client *esriservice.EsriService, tileInfo *esriservice.TileInfo, origin orb.Point) (*ESRICache, error) {
+	if tileInfo == nil {
+		return nil, errors.New("service doesn't have a tile cache")
+	}
+	if !tileInfo.SpatialReference.IsWebMercator() {
+		return nil, fmt.Errorf("tile cache is in wkid %d rather than web mercator", tileInfo.SpatialReference.Wkid)
+	}
+	if tileInfo.Rows != 256 || tileInfo.Cols != 256 {
+		return nil, fmt.Errorf("tile cache has %dx%d tiles, only 256x256 is supported", tileInfo.Cols, tileInfo.Rows)
+	}
+
+	return &ESRICache{Client: client, TileInfo: tileInfo, Origin: origin}, nil
+}
+
+// OriginAligned reports whether origin is a whole number of tiles from the
+// standard origin at every level of the cache, so its tiles line up with
+// web mercator tiles.
+func (e *ESRICache) OriginAligned() bool {
+	for _, lod := range e.TileInfo.LODs {
+		span := lod.Resolution * float64(e.TileInfo.Cols)
+		for _, offset := range []float64{e.Origin.X() - StandardOrigin.X(), StandardOrigin.Y() - e.Origin.Y()} {
+			tiles := offset / span
+			if math.Abs(tiles-math.Round(tiles)) > 0.01 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// level returns the cache level whose resolution matches zoom z.
+func (e *ESRICache) level(z maptile.Zoom) (esriservice.LOD, bool) {
+	resolution := ResolutionAt(z, 0)
+	for _, lod := range e.TileInfo.LODs {
+		if math.Abs(lod.Resolution-resolution)/resolution < 0.01 {
+			return lod, true
+		}
+	}
+	return esriservice.LOD{}, false
+}
+
+func (e *ESRICache) FetchTile(ctx context.Context, t maptile.Tile) ([]byte, error) {
+	lod, ok := e.level(t.Z)
+	if !ok {
+		return nil, fmt.Errorf("tile cache has no level for z%d", t.Z)
+	}
+
+	b := project.Bound(t.Bound(), project.WGS84.ToMercator)
+	span := lod.Resolution * float64(e.TileInfo.Cols)
+	col := int(math.Round((b.Min.X() - e.Origin.X()) / span))
+	row := int(math.Round((e.Origin.Y() - b.Max.Y()) / span))
+
+	if e.UseTileMap && !e.tileExists(ctx, lod.Level, row, col) {
+		return nil, nil
+	}
+
+	data, err := e.Client.GetTile(ctx, lod.Level, row, col)
+	var httpErr *esriservice.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return data, err
+}
+
+// tileExists reports whether the tilemap says the tile at row and col
+// exists, or true if it doesn't know.
+func (e *ESRICache) tileExists(ctx context.Context, level, row, col int) bool {
+	if atomic.LoadInt32(&e.tileMapUnsupported) != 0 {
+		return true
+	}
+
+	key := tileMapKey{level, row - row%tileMapBlockSize, col - col%tileMapBlockSize}
+	e.tileMapsMu.Lock()
+	if e.tileMaps == nil {
+		e.tileMaps = map[tileMapKey]*tileMapBlock{}
+	}
+	block, ok := e.tileMaps[key]
+	if !ok {
+		block = &tileMapBlock{}
+		e.tileMaps[key] = block
+	}
+	e.tileMapsMu.Unlock()
+
+	block.once.Do(func() {
+		block.tileMap, block.err = e.Client.GetTileMap(ctx, key.level, key.row, key.col, tileMapBlockSize, tileMapBlockSize)
+	})
+	if block.err != nil {
+		var httpErr *esriservice.HTTPError
+		var serviceErr *esriservice.ServiceError
+		if errors.As(block.err, &httpErr) || errors.As(block.err, &serviceErr) {
+			if atomic.CompareAndSwapInt32(&e.tileMapUnsupported, 0, 1) {
+				log.Printf("Service has no tilemap, requesting every tile: %+v", block.err)
+			}
+		}
+		return true
+	}
+
+	exists, ok := block.tileMap.Has(row, col)
+	return exists || !ok
+}
@@ -0,0 +1,219 @@
+package tilesource
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/maptile/tilecover"
+	"github.com/paulmach/orb/project"
+)
+
+// Grid is a tiling scheme, which maps tile coordinates to areas of the map.
+type Grid interface {
+	// Bound returns the area covered by t in WGS84 degrees.
+	Bound(t maptile.Tile) orb.Bound
+	// Cover returns the tiles at z that intersect b.
+	Cover(b orb.Bound, z maptile.Zoom) maptile.Set
+	// Valid reports whether t's column and row exist at its zoom.
+	Valid(t maptile.Tile) bool
+	// Pad grows a tile's bound by the given number of pixels on each side.
+	Pad(b orb.Bound, tileSize, pixels int) orb.Bound
+	// Wkid is the spatial reference tiles are rendered in.
+	Wkid() int
+	// Children returns the tiles at the next zoom that cover t.
+	Children(t maptile.Tile) []maptile.Tile
+	// Parent returns the tile at the previous zoom that covers t. Tiles at
+	// zoom 0 are their own parent.
+	Parent(t maptile.Tile) maptile.Tile
+}
+
+// quadChildren returns the four tiles at the next zoom that cover t in a
+// grid where each zoom doubles the columns and rows of the last.
+func quadChildren(t maptile.Tile) []maptile.Tile {
+	x, y, z := t.X<<1, t.Y<<1, t.Z+1
+	return []maptile.Tile{
+		maptile.New(x, y, z),
+		maptile.New(x+1, y, z),
+		maptile.New(x+1, y+1, z),
+		maptile.New(x, y+1, z),
+	}
+}
+
+// quadParent is the reverse of quadChildren.
+func quadParent(t maptile.Tile) maptile.Tile {
+	if t.Z == 0 {
+		return t
+	}
+	return maptile.New(t.X>>1, t.Y>>1, t.Z-1)
+}
+
+// MaxMercatorLatitude is the latitude at which web mercator is square, past
+// which it has no tiles.
+const MaxMercatorLatitude = 85.0511287798066
+
+// SplitAntimeridian splits a bound that crosses the antimeridian into the
+// parts on either side of it. A crossing bound is one with a minimum
+// longitude greater than its maximum, or a longitude past ±180.
+func SplitAntimeridian(b orb.Bound) []orb.Bound {
+	if b.Min[0] > b.Max[0] {
+		b.Max[0] += 360
+	}
+	for b.Min[0] >= 180 {
+		b.Min[0] -= 360
+		b.Max[0] -= 360
+	}
+	for b.Min[0] < -180 {
+		b.Min[0] += 360
+		b.Max[0] += 360
+	}
+
+	switch {
+	case b.Max[0] <= 180:
+		return []orb.Bound{b}
+	case b.Max[0]-b.Min[0] >= 360:
+		b.Min[0], b.Max[0] = -180, 180
+		return []orb.Bound{b}
+	}
+
+	return []orb.Bound{
+		{Min: b.Min, Max: orb.Point{180, b.Max[1]}},
+		{Min: orb.Point{-180, b.Min[1]}, Max: orb.Point{b.Max[0] - 360, b.Max[1]}},
+	}
+}
+
+// WebMercator is the standard web map tile grid, with one tile at zoom 0.
+type WebMercator struct{}
+
+func (WebMercator) Bound(t maptile.Tile) orb.Bound {
+	return t.Bound()
+}
+
+// Cover clamps b to the latitudes web mercator can represent.
+func (g WebMercator) Cover(b orb.Bound, z maptile.Zoom) maptile.Set {
+	set := maptile.Set{}
+	for _, part := range SplitAntimeridian(b) {
+		part.Min[1] = clampLatitude(part.Min[1])
+		part.Max[1] = clampLatitude(part.Max[1])
+		if part.Min[1] == part.Max[1] && b.Min[1] != b.Max[1] {
+			// The whole bound is past the poles.
+			continue
+		}
+		for t := range tilecover.Bound(part, z) {
+			// A bound ending at 180 covers a column past the last.
+			if g.Valid(t) {
+				set[t] = true
+			}
+		}
+	}
+	return set
+}
+
+func clampLatitude(lat float64) float64 {
+	return math.Max(-MaxMercatorLatitude, math.Min(MaxMercatorLatitude, lat))
+}
+
+func (WebMercator) Valid(t maptile.Tile) bool {
+	n := uint64(1) << uint64(t.Z)
+	return t.Z <= 32 && uint64(t.X) < n && uint64(t.Y) < n
+}
+
+// Pad measures pixels in web mercator so they stay square.
+func (WebMercator) Pad(b orb.Bound, tileSize, pixels int) orb.Bound {
+	m := project.Bound(b, project.WGS84.ToMercator)
+	pad := (m.Max.X() - m.Min.X()) / float64(tileSize) * float64(pixels)
+	m = m.Pad(pad)
+	return project.Bound(m, project.Mercator.ToWGS84)
+}
+
+func (WebMercator) Wkid() int {
+	return 3857
+}
+
+func (WebMercator) Children(t maptile.Tile) []maptile.Tile {
+	return quadChildren(t)
+}
+
+func (WebMercator) Parent(t maptile.Tile) maptile.Tile {
+	return quadParent(t)
+}
+
+// Geographic is the plate carrée grid in EPSG:4326, with two square tiles
+// at zoom 0 covering the western and eastern hemispheres.
+type Geographic struct{}
+
+// tileDegrees is the width and height of a geographic tile at z.
+func tileDegrees(z maptile.Zoom) float64 {
+	return 180 / math.Exp2(float64(z))
+}
+
+func (Geographic) Bound(t maptile.Tile) orb.Bound {
+	size := tileDegrees(t.Z)
+	minX := -180 + float64(t.X)*size
+	maxY := 90 - float64(t.Y)*size
+	return orb.Bound{
+		Min: orb.Point{minX, maxY - size},
+		Max: orb.Point{minX + size, maxY},
+	}
+}
+
+func (g Geographic) Cover(b orb.Bound, z maptile.Zoom) maptile.Set {
+	set := maptile.Set{}
+	for _, part := range SplitAntimeridian(b) {
+		for t := range g.cover(part, z) {
+			set[t] = true
+		}
+	}
+	return set
+}
+
+func (Geographic) cover(b orb.Bound, z maptile.Zoom) maptile.Set {
+	size := tileDegrees(z)
+	cols, rows := uint32(2)<<z, uint32(1)<<z
+
+	clamp := func(v float64, n uint32) uint32 {
+		if v < 0 {
+			return 0
+		}
+		if v >= float64(n) {
+			return n - 1
+		}
+		return uint32(v)
+	}
+
+	minX := clamp((b.Min.X()+180)/size, cols)
+	maxX := clamp((b.Max.X()+180)/size, cols)
+	minY := clamp((90-b.Max.Y())/size, rows)
+	maxY := clamp((90-b.Min.Y())/size, rows)
+
+	set := maptile.Set{}
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			set[maptile.New(x, y, z)] = true
+		}
+	}
+	return set
+}
+
+func (Geographic) Valid(t maptile.Tile) bool {
+	return t.Z < 32 && uint64(t.X) < uint64(2)<<uint64(t.Z) && uint64(t.Y) < uint64(1)<<uint64(t.Z)
+}
+
+func (Geographic) Pad(b orb.Bound, tileSize, pixels int) orb.Bound {
+	return b.Pad((b.Max.X() - b.Min.X()) / float64(tileSize) * float64(pixels))
+}
+
+func (Geographic) Wkid() int {
+	return 4326
+}
+
+// Children splits t into four, like web mercator, since zoom 0's two tiles
+// are each the root of their own quadtree.
+func (Geographic) Children(t maptile.Tile) []maptile.Tile {
+	return quadChildren(t)
+}
+
+// Parent of a tile at zoom 1 is the hemisphere it's in.
+func (Geographic) Parent(t maptile.Tile) maptile.Tile {
+	return quadParent(t)
+}
@@ -0,0 +1,170 @@
+package tilesource
+
+import (
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestGeographicRoots(t *testing.T) {
+	g := Geographic{}
+	world := orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}}
+	roots := g.Cover(world, 0)
+	if len(roots) != 2 {
+		t.Fatalf("the world is covered by %d tiles at zoom 0, want 2", len(roots))
+	}
+
+	for _, test := range []struct {
+		tile maptile.Tile
+		want orb.Bound
+	}{
+		{maptile.New(0, 0, 0), orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{0, 90}}},
+		{maptile.New(1, 0, 0), orb.Bound{Min: orb.Point{0, -90}, Max: orb.Point{180, 90}}},
+	} {
+		if !roots[test.tile] {
+			t.Errorf("%v isn't a root", test.tile)
+		}
+		if got := g.Bound(test.tile); got != test.want {
+			t.Errorf("%v has bound %v, want %v", test.tile, got, test.want)
+		}
+		if p := g.Parent(test.tile); p != test.tile {
+			t.Errorf("root %v has parent %v", test.tile, p)
+		}
+	}
+	if g.Valid(maptile.New(2, 0, 0)) || g.Valid(maptile.New(0, 1, 0)) {
+		t.Error("zoom 0 has tiles past its two roots")
+	}
+}
+
+// TestChildrenParent checks that every tile is the parent of each of its
+// children, and that the children exactly cover it.
+func TestChildrenParent(t *testing.T) {
+	for name, g := range map[string]Grid{"webmercator": WebMercator{}, "geographic": Geographic{}} {
+		tiles := []maptile.Tile{maptile.New(0, 0, 0)}
+		if _, ok := g.(Geographic); ok {
+			tiles = append(tiles, maptile.New(1, 0, 0))
+		}
+		for z := 0; z < 4; z++ {
+			var next []maptile.Tile
+			for _, tile := range tiles {
+				children := g.Children(tile)
+				if len(children) != 4 {
+					t.Fatalf("%s: %v has %d children", name, tile, len(children))
+				}
+				covered := g.Bound(children[0])
+				for _, child := range children {
+					if !g.Valid(child) {
+						t.Errorf("%s: %v has invalid child %v", name, tile, child)
+					}
+					if p := g.Parent(child); p != tile {
+						t.Errorf("%s: child %v of %v has parent %v", name, child, tile, p)
+					}
+					covered = covered.Union(g.Bound(child))
+				}
+				if !boundsNear(covered, g.Bound(tile)) {
+					t.Errorf("%s: %v's children cover %v, want %v", name, tile, covered, g.Bound(tile))
+				}
+				next = append(next, children...)
+			}
+			tiles = next
+		}
+	}
+}
+
+// boundsNear reports whether a and b are the same up to rounding.
+func boundsNear(a, b orb.Bound) bool {
+	for _, v := range []float64{a.Min[0] - b.Min[0], a.Min[1] - b.Min[1], a.Max[0] - b.Max[0], a.Max[1] - b.Max[1]} {
+		if v > 1e-9 || v < -1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSplitAntimeridian(t *testing.T) {
+	west := orb.Bound{Min: orb.Point{172, 51}, Max: orb.Point{180, 72}}
+	east := orb.Bound{Min: orb.Point{-180, 51}, Max: orb.Point{-130, 72}}
+	for _, test := range []struct {
+		b    orb.Bound
+		want []orb.Bound
+	}{
+		// Alaska, with the Aleutians past 180°, given with min > max and
+		// with longitudes past 180.
+		{orb.Bound{Min: orb.Point{172, 51}, Max: orb.Point{-130, 72}}, []orb.Bound{west, east}},
+		{orb.Bound{Min: orb.Point{172, 51}, Max: orb.Point{230, 72}}, []orb.Bound{west, east}},
+		{orb.Bound{Min: orb.Point{-188, 51}, Max: orb.Point{-130, 72}}, []orb.Bound{west, east}},
+		{orb.Bound{Min: orb.Point{-150, 51}, Max: orb.Point{-130, 72}}, []orb.Bound{{Min: orb.Point{-150, 51}, Max: orb.Point{-130, 72}}}},
+		{orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}}, []orb.Bound{{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}}}},
+		{orb.Bound{Min: orb.Point{10, 0}, Max: orb.Point{5, 1}}, []orb.Bound{{Min: orb.Point{10, 0}, Max: orb.Point{180, 1}}, {Min: orb.Point{-180, 0}, Max: orb.Point{5, 1}}}},
+		{orb.Bound{Min: orb.Point{-200, 0}, Max: orb.Point{200, 1}}, []orb.Bound{{Min: orb.Point{-180, 0}, Max: orb.Point{180, 1}}}},
+	} {
+		got := SplitAntimeridian(test.b)
+		if len(got) != len(test.want) {
+			t.Errorf("SplitAntimeridian(%v) = %v, want %v", test.b, got, test.want)
+			continue
+		}
+		for i := range got {
+			if !boundsNear(got[i], test.want[i]) {
+				t.Errorf("SplitAntimeridian(%v) = %v, want %v", test.b, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+// TestCoverAlaska covers an extent that crosses the antimeridian, which
+// should take the columns on both sides of it and none in between.
+func TestCoverAlaska(t *testing.T) {
+	alaska := orb.Bound{Min: orb.Point{172, 51}, Max: orb.Point{-130, 72}}
+	for name, test := range map[string]struct {
+		g    Grid
+		cols []uint32
+	}{
+		"webmercator": {WebMercator{}, []uint32{0, 1, 7}},
+		"geographic":  {Geographic{}, []uint32{0, 1, 2, 15}},
+	} {
+		cols := map[uint32]bool{}
+		for tile := range test.g.Cover(alaska, 3) {
+			if !test.g.Valid(tile) {
+				t.Errorf("%s: %v is out of range", name, tile)
+			}
+			if !BoundsOverlap(alaska, test.g.Bound(tile)) {
+				t.Errorf("%s: %v doesn't overlap Alaska", name, tile)
+			}
+			cols[tile.X] = true
+		}
+		if len(cols) != len(test.cols) {
+			t.Errorf("%s: covered columns %v, want %v", name, cols, test.cols)
+		}
+		for _, x := range test.cols {
+			if !cols[x] {
+				t.Errorf("%s: column %d isn't covered", name, x)
+			}
+		}
+	}
+}
+
+func TestWebMercatorCoverClampsLatitude(t *testing.T) {
+	g := WebMercator{}
+
+	arctic := orb.Bound{Min: orb.Point{-10, 80}, Max: orb.Point{10, 90}}
+	tiles := g.Cover(arctic, 4)
+	if len(tiles) == 0 {
+		t.Fatal("nothing covers the arctic below the mercator limit")
+	}
+	for tile := range tiles {
+		if !g.Valid(tile) || tile.Y > 1 {
+			t.Errorf("%v is past the top of the map, or too far south", tile)
+		}
+	}
+
+	antarctic := orb.Bound{Min: orb.Point{-10, -90}, Max: orb.Point{10, -85.5}}
+	if tiles := g.Cover(antarctic, 4); len(tiles) != 0 {
+		t.Errorf("a bound past the mercator limit is covered by %v", tiles)
+	}
+
+	if tiles := g.Cover(orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}}, 0); len(tiles) != 1 {
+		t.Errorf("the world is covered by %v at zoom 0, want one tile", tiles)
+	}
+}
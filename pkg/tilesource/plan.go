@@ -0,0 +1,181 @@
+package tilesource
+
+import (
+	"context"
+	"sort"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/planar"
+)
+
+// PlanTiles sends the tiles from minZoom to maxZoom that overlap extent, and
+// intersect clip if it isn't nil, then closes the channel. Each tile is sent
+// before its children, and only tiles whose parents were sent are
+// considered, so the tiles can be fetched in order as they arrive. A nil
+// grid is web mercator. Canceling ctx stops planning early.
+func PlanTiles(ctx context.Context, grid Grid, extent orb.Bound, minZoom, maxZoom maptile.Zoom, clip orb.Geometry) <-chan maptile.Tile {
+	if grid == nil {
+		grid = WebMercator{}
+	}
+
+	tiles := make(chan maptile.Tile)
+	go func() {
+		defer close(tiles)
+
+		var plan func(t maptile.Tile) bool
+		plan = func(t maptile.Tile) bool {
+			b := grid.Bound(t)
+			if !grid.Valid(t) || !BoundsOverlap(extent, b) || (clip != nil && !BoundIntersects(clip, b)) {
+				return true
+			}
+
+			select {
+			case tiles <- t:
+			case <-ctx.Done():
+				return false
+			}
+
+			if t.Z < maxZoom {
+				for _, child := range grid.Children(t) {
+					if !plan(child) {
+						return false
+					}
+				}
+			}
+			return true
+		}
+
+		for _, t := range sortedTiles(grid.Cover(extent, minZoom)) {
+			if !plan(t) {
+				return
+			}
+		}
+	}()
+
+	return tiles
+}
+
+// sortedTiles returns the tiles in a set in a stable order.
+func sortedTiles(set maptile.Set) []maptile.Tile {
+	tiles := make([]maptile.Tile, 0, len(set))
+	for t := range set {
+		tiles = append(tiles, t)
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].Y != tiles[j].Y {
+			return tiles[i].Y < tiles[j].Y
+		}
+		return tiles[i].X < tiles[j].X
+	})
+	return tiles
+}
+
+// boundEpsilon absorbs the rounding in tile bounds, which are computed
+// through the mercator projection, in degrees.
+const boundEpsilon = 1e-9
+
+// BoundsOverlap reports whether a and b share some area. Unlike
+// orb.Bound.Intersects, bounds that only touch along an edge don't overlap,
+// so a bbox on tile boundaries doesn't pull in the neighboring tiles.
+//
+// Bounds that cross the antimeridian are compared a side at a time.
+func BoundsOverlap(a, b orb.Bound) bool {
+	for _, a := range SplitAntimeridian(a) {
+		for _, b := range SplitAntimeridian(b) {
+			if a.Min.X() < b.Max.X()-boundEpsilon && a.Max.X() > b.Min.X()+boundEpsilon &&
+				a.Min.Y() < b.Max.Y()-boundEpsilon && a.Max.Y() > b.Min.Y()+boundEpsilon {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BoundContains reports whether inner, which doesn't cross the
+// antimeridian, is entirely inside outer.
+func BoundContains(outer, inner orb.Bound) bool {
+	for _, outer := range SplitAntimeridian(outer) {
+		if inner.Min.X() >= outer.Min.X()-boundEpsilon && inner.Max.X() <= outer.Max.X()+boundEpsilon &&
+			inner.Min.Y() >= outer.Min.Y()-boundEpsilon && inner.Max.Y() <= outer.Max.Y()+boundEpsilon {
+			return true
+		}
+	}
+	return false
+}
+
+// BoundIntersects reports whether g, which should be made of polygons,
+// intersects b.
+func BoundIntersects(g orb.Geometry, b orb.Bound) bool {
+	if !g.Bound().Intersects(b) {
+		return false
+	}
+
+	switch g := g.(type) {
+	case orb.Polygon:
+		return polygonIntersects(g, b)
+	case orb.MultiPolygon:
+		for _, p := range g {
+			if polygonIntersects(p, b) {
+				return true
+			}
+		}
+		return false
+	case orb.Collection:
+		for _, child := range g {
+			if BoundIntersects(child, b) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Bounds are close enough for points and lines, which don't make much
+	// sense as coverage areas anyway.
+	return true
+}
+
+func polygonIntersects(p orb.Polygon, b orb.Bound) bool {
+	if len(p) == 0 || !p.Bound().Intersects(b) {
+		return false
+	}
+
+	corners := []orb.Point{b.Min, {b.Max.X(), b.Min.Y()}, b.Max, {b.Min.X(), b.Max.Y()}}
+	for _, c := range corners {
+		if planar.PolygonContains(p, c) {
+			return true
+		}
+	}
+
+	for _, ring := range p {
+		for i, pt := range ring {
+			if b.Contains(pt) {
+				return true
+			}
+
+			if i == 0 {
+				continue
+			}
+			for j := range corners {
+				if segmentsIntersect(ring[i-1], pt, corners[j], corners[(j+1)%len(corners)]) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func segmentsIntersect(a1, a2, b1, b2 orb.Point) bool {
+	cross := func(o, a, b orb.Point) float64 {
+		return (a.X()-o.X())*(b.Y()-o.Y()) - (a.Y()-o.Y())*(b.X()-o.X())
+	}
+
+	d1 := cross(b1, b2, a1)
+	d2 := cross(b1, b2, a2)
+	d3 := cross(a1, a2, b1)
+	d4 := cross(a1, a2, b2)
+
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
@@ -0,0 +1,74 @@
+package tilesource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// TestPlanTilesOnBoundaries plans bboxes that lie exactly on tile edges,
+// which must not pull in the column or row on the other side of them.
+func TestPlanTilesOnBoundaries(t *testing.T) {
+	for name, g := range map[string]Grid{"webmercator": WebMercator{}, "geographic": Geographic{}} {
+		corner := maptile.New(163, 357, 10)
+		for _, test := range []struct {
+			tiles []maptile.Tile
+		}{
+			{[]maptile.Tile{corner}},
+			{[]maptile.Tile{corner, maptile.New(164, 357, 10), maptile.New(163, 358, 10), maptile.New(164, 358, 10)}},
+		} {
+			extent := g.Bound(test.tiles[0])
+			roots := map[maptile.Tile]bool{}
+			for _, tile := range test.tiles {
+				extent = extent.Union(g.Bound(tile))
+				roots[tile] = true
+			}
+
+			sent := map[maptile.Tile]bool{}
+			for tile := range PlanTiles(context.Background(), g, extent, 10, 12, nil) {
+				if sent[tile] {
+					t.Errorf("%s: %v was planned twice", name, tile)
+				}
+				if tile.Z > 10 && !sent[g.Parent(tile)] {
+					t.Errorf("%s: %v was planned before its parent", name, tile)
+				}
+				sent[tile] = true
+
+				root := tile
+				for root.Z > 10 {
+					root = g.Parent(root)
+				}
+				if !roots[root] {
+					t.Errorf("%s: %v is outside the %d tile bbox %v", name, tile, len(test.tiles), extent)
+				}
+			}
+			if want := len(test.tiles) * (1 + 4 + 16); len(sent) != want {
+				t.Errorf("%s: planned %d tiles for the %d tile bbox, want %d", name, len(sent), len(test.tiles), want)
+			}
+		}
+	}
+}
+
+func TestPlanTilesClip(t *testing.T) {
+	g := WebMercator{}
+	tile := maptile.New(163, 357, 10)
+	b := g.Bound(tile)
+	// A triangle over the tile's western half only reaches its western
+	// children.
+	clip := orb.Polygon{{b.Min, {b.Center().X() - 1e-6, b.Min.Y()}, {b.Center().X() - 1e-6, b.Max.Y()}, b.Min}}
+
+	var got []maptile.Tile
+	for t := range PlanTiles(context.Background(), g, b, 10, 11, clip) {
+		got = append(got, t)
+	}
+	if len(got) != 3 {
+		t.Errorf("planned %v, want the tile and its two western children", got)
+	}
+	for _, child := range got[1:] {
+		if child.X != tile.X*2 {
+			t.Errorf("planned eastern child %v", child)
+		}
+	}
+}
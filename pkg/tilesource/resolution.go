@@ -0,0 +1,18 @@
+package tilesource
+
+import (
+	"math"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// metersPerPixelZ0 is the web mercator resolution of a 256 pixel tile at
+// zoom 0.
+const metersPerPixelZ0 = 2 * math.Pi * 6378137 / 256
+
+// ResolutionAt returns the ground resolution, in meters per pixel, of a 256
+// pixel web mercator tile at zoom z and latitude lat. At the equator it's
+// the resolution in projected meters, which is what services report.
+func ResolutionAt(z maptile.Zoom, lat float64) float64 {
+	return metersPerPixelZ0 / math.Exp2(float64(z)) * math.Cos(lat*math.Pi/180)
+}
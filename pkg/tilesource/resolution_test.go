@@ -0,0 +1,29 @@
+package tilesource
+
+import (
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+func TestResolutionAt(t *testing.T) {
+	for _, test := range []struct {
+		z    maptile.Zoom
+		lat  float64
+		want float64
+	}{
+		{0, 0, 156543.03},
+		{1, 0, 78271.52},
+		{18, 0, 0.597164},
+		{0, 60, 78271.52},
+		{0, -60, 78271.52},
+		{10, 45, 152.874057 * math.Sqrt2 / 2},
+		{0, 90, 0},
+	} {
+		got := ResolutionAt(test.z, test.lat)
+		if math.Abs(got-test.want) > 0.01 {
+			t.Errorf("ResolutionAt(%d, %v) = %v, want %v", test.z, test.lat, got, test.want)
+		}
+	}
+}
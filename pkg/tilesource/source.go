@@ -0,0 +1,77 @@
+// Package tilesource fetches web mercator tiles from the various kinds of
+// imagery services the crawler can read from.
+package tilesource
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/paulmach/orb/maptile"
+
+	"github.com/iandees/imageservice-to-mbtiles/pkg/esriservice"
+)
+
+// Source fetches the image for a single web mercator tile.
+type Source interface {
+	FetchTile(ctx context.Context, t maptile.Tile) ([]byte, error)
+}
+
+// StreamingSource is a Source that can also return a tile as a stream, so
+// large tiles can be passed along without holding them in memory.
+type StreamingSource interface {
+	Source
+	OpenTile(ctx context.Context, t maptile.Tile) (io.ReadCloser, error)
+}
+
+// closeFuncReader calls close after closing its ReadCloser.
+type closeFuncReader struct {
+	io.ReadCloser
+	close  func()
+	closed sync.Once
+}
+
+func (r *closeFuncReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.closed.Do(r.close)
+	return err
+}
+
+// download fetches url with the given headers and returns the response body.
+// Requests without a User-Agent header send esriservice.DefaultUserAgent.
+// Non-200 responses are returned as an *esriservice.HTTPError so callers can
+// treat every source's failures alike, and responses whose Content-Type isn't
+// one of contentTypes, if it's set, are errors too.
+func download(ctx context.Context, client *http.Client, url string, header http.Header, contentTypes []string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", esriservice.DefaultUserAgent)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &esriservice.HTTPError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+
+	if err := esriservice.CheckContentType(response, contentTypes); err != nil {
+		return nil, err
+	}
+
+	return esriservice.ReadImage(response)
+}
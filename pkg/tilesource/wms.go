@@ -0,0 +1,66 @@
+package tilesource
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/project"
+)
+
+// WMS fetches tiles with an OGC WMS GetMap request in EPSG:3857.
+type WMS struct {
+	// BaseURL is the service endpoint, which may already have a query string.
+	BaseURL string
+	Layers  string
+	Styles  string
+	// Format is a MIME type like image/png.
+	Format string
+	// Version is the WMS version, 1.3.0 if empty.
+	Version  string
+	TileSize int
+
+	Client *http.Client
+	Header http.Header
+	// ContentTypes, if set, are the Content-Types tiles are allowed to have.
+	ContentTypes []string
+}
+
+func (w *WMS) FetchTile(ctx context.Context, t maptile.Tile) ([]byte, error) {
+	u, err := url.Parse(w.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	version := w.Version
+	if version == "" {
+		version = "1.3.0"
+	}
+
+	// Web mercator has east/north axis order in every WMS version, so the
+	// 1.3.0 axis order swap doesn't apply.
+	b := project.Bound(t.Bound(), project.WGS84.ToMercator)
+
+	q := u.Query()
+	q.Set("SERVICE", "WMS")
+	q.Set("REQUEST", "GetMap")
+	q.Set("VERSION", version)
+	q.Set("LAYERS", w.Layers)
+	q.Set("STYLES", w.Styles)
+	q.Set("FORMAT", w.Format)
+	q.Set("TRANSPARENT", "TRUE")
+	q.Set("WIDTH", fmt.Sprintf("%d", w.TileSize))
+	q.Set("HEIGHT", fmt.Sprintf("%d", w.TileSize))
+	q.Set("BBOX", fmt.Sprintf("%f,%f,%f,%f", b.Min.X(), b.Min.Y(), b.Max.X(), b.Max.Y()))
+	if strings.HasPrefix(version, "1.3") {
+		q.Set("CRS", "EPSG:3857")
+	} else {
+		q.Set("SRS", "EPSG:3857")
+	}
+	u.RawQuery = q.Encode()
+
+	return download(ctx, w.Client, u.String(), w.Header, w.ContentTypes)
+}
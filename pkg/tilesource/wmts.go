@@ -0,0 +1,52 @@
+package tilesource
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// WMTS fetches tiles with an OGC WMTS KVP GetTile request. The tile matrix
+// set must be a web mercator quadtree (like GoogleMapsCompatible) whose
+// matrices are identified by zoom level, optionally with a prefix.
+type WMTS struct {
+	// BaseURL is the service endpoint, which may already have a query string.
+	BaseURL   string
+	Layer     string
+	Style     string
+	Format    string
+	MatrixSet string
+	// MatrixPrefix is prepended to the zoom to form the TileMatrix
+	// identifier, e.g. "EPSG:3857:".
+	MatrixPrefix string
+
+	Client *http.Client
+	Header http.Header
+	// ContentTypes, if set, are the Content-Types tiles are allowed to have.
+	ContentTypes []string
+}
+
+func (w *WMTS) FetchTile(ctx context.Context, t maptile.Tile) ([]byte, error) {
+	u, err := url.Parse(w.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set("SERVICE", "WMTS")
+	q.Set("REQUEST", "GetTile")
+	q.Set("VERSION", "1.0.0")
+	q.Set("LAYER", w.Layer)
+	q.Set("STYLE", w.Style)
+	q.Set("FORMAT", w.Format)
+	q.Set("TILEMATRIXSET", w.MatrixSet)
+	q.Set("TILEMATRIX", fmt.Sprintf("%s%d", w.MatrixPrefix, t.Z))
+	q.Set("TILEROW", fmt.Sprintf("%d", t.Y))
+	q.Set("TILECOL", fmt.Sprintf("%d", t.X))
+	u.RawQuery = q.Encode()
+
+	return download(ctx, w.Client, u.String(), w.Header, w.ContentTypes)
+}
@@ -0,0 +1,45 @@
+package tilesource
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// XYZ fetches tiles from a slippy map server. The URL template can contain
+// {z}, {x}, {y}, {-y} (the TMS row), and {s}, which is replaced by one of the
+// subdomains.
+type XYZ struct {
+	URLTemplate string
+	Subdomains  []string
+
+	Client *http.Client
+	Header http.Header
+	// ContentTypes, if set, are the Content-Types tiles are allowed to have.
+	ContentTypes []string
+}
+
+func (s *XYZ) FetchTile(ctx context.Context, t maptile.Tile) ([]byte, error) {
+	return download(ctx, s.Client, s.tileURL(t), s.Header, s.ContentTypes)
+}
+
+func (s *XYZ) tileURL(t maptile.Tile) string {
+	replacements := []string{
+		"{z}", fmt.Sprintf("%d", t.Z),
+		"{x}", fmt.Sprintf("%d", t.X),
+		"{y}", fmt.Sprintf("%d", t.Y),
+		"{-y}", fmt.Sprintf("%d", (uint32(1)<<t.Z)-1-t.Y),
+	}
+
+	if len(s.Subdomains) > 0 {
+		// Picking the subdomain from the tile rather than round-robin means
+		// a tile always comes from the same host, which is kinder to caches.
+		subdomain := s.Subdomains[(t.X+t.Y)%uint32(len(s.Subdomains))]
+		replacements = append(replacements, "{s}", subdomain)
+	}
+
+	return strings.NewReplacer(replacements...).Replace(s.URLTemplate)
+}